@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+)
+
+// attributesController manages the vocabulary of attributes that designs
+// are described with.  Anyone can read it, only system admins can change
+// it.
+type attributesController struct{}
+
+// ReadMany lists the vocabulary, only of one kind with ?kind=.
+func (a *attributesController) ReadMany(ctx context.Context) error {
+	kind := ctx.QueryValue("kind")
+	if len(kind) > 0 && !models.IsAttributeKind(kind) {
+		return goweb.API.RespondWithError(ctx, 400, "unknown attribute kind "+kind)
+	}
+	attrs, err := models.GetAttributes(kind)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if attrs == nil {
+		attrs = []models.Attribute{}
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, attrs)
+}
+
+func (a *attributesController) Read(id string, ctx context.Context) error {
+	attr, err := models.FindAttributeById(id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, attr)
+}
+
+func (a *attributesController) Create(ctx context.Context) error {
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	var attr models.Attribute
+	data, err := ctx.RequestBody()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if err := json.Unmarshal(data, &attr); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if err := models.CreateAttribute(&attr); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 201, attr)
+}
+
+// Update applies the fields present in the request body to the attribute.
+// Renaming its slug renames it on every design, but its kind can't change.
+func (a *attributesController) Update(id string, ctx context.Context) error {
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	attr, err := models.FindAttributeById(id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	data, err := ctx.RequestBody()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	attrId, kind, slug := attr.Id, attr.Kind, attr.Slug
+	if err := json.Unmarshal(data, &attr); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	attr.Id, attr.Kind = attrId, kind
+	if err := models.UpdateAttribute(&attr, slug); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, attr)
+}
+
+// Delete removes an attribute from the vocabulary and from the designs
+// described with it.
+func (a *attributesController) Delete(id string, ctx context.Context) error {
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	attr, err := models.FindAttributeById(id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if err := models.DeleteAttribute(attr); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	return goweb.Respond.WithStatus(ctx, 200)
+}
+
+// attributeFilter reads the attributes that design listings are filtered
+// on from the query, one parameter per kind with a comma separated list of
+// slugs, e.g. ?shape=round,cat-eye&gender=unisex.  ?face_width= can also be
+// a face width in millimetres, which matches the face width attributes
+// whose range includes it.
+func attributeFilter(ctx context.Context) (models.Attributes, error) {
+	wanted := models.Attributes{}
+	for _, kind := range models.AttributeKinds {
+		value := ctx.QueryValue(kind)
+		if len(value) == 0 {
+			continue
+		}
+		if width, err := strconv.ParseFloat(value, 64); err == nil && kind == models.ATTRIBUTE_FACE_WIDTH {
+			vocabulary, err := models.GetAttributes(kind)
+			if err != nil {
+				return nil, err
+			}
+			// A face that no attribute suits matches no designs
+			wanted[kind] = models.FaceWidthAttributes(vocabulary, models.LengthOf(width))
+			continue
+		}
+		for _, slug := range strings.Split(value, ",") {
+			if slug = strings.TrimSpace(slug); len(slug) > 0 {
+				wanted[kind] = append(wanted[kind], slug)
+			}
+		}
+	}
+	return wanted, nil
+}
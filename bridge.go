@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+)
+
+// Limits on a parametric bridge, in millimetres and degrees.
+const (
+	minNoseRadius  = 2.0
+	maxBridgeSplay = 45
+	bridgeStep     = 1.0 // Spacing of the generated control points
+)
+
+// orderBridge is the bridge an order is made with: the design's bridge
+// with any values the order overrides.  Without a parametric bridge on the
+// design the order's bridge is ignored.
+func orderBridge(front models.Front, override *models.Bridge) *models.Bridge {
+	if front.Bridge == nil {
+		return nil
+	}
+	b := *front.Bridge
+	if override != nil {
+		if override.Extent > 0 {
+			b.Extent = override.Extent
+		}
+		if override.Height > 0 {
+			b.Height = override.Height
+		}
+		if override.Radius > 0 {
+			b.Radius = override.Radius
+		}
+		if override.Splay != 0 {
+			b.Splay = override.Splay
+		}
+	}
+	return &b
+}
+
+// bridgeForNose is the bridge override that fits someone's nose, with the
+// same clearance either side as fitDesign recommends.  The nose height
+// sets the order's vertical position rather than the bridge, and the ridge
+// angle doesn't show in the outline of a flat front.
+func bridgeForNose(size models.SizeInfo) *models.Bridge {
+	if size.NoseRadius <= 0 {
+		return nil
+	}
+	return &models.Bridge{
+		Radius: size.NoseRadius + models.LengthOf(bridgeClearance),
+		Splay:  size.Splay,
+	}
+}
+
+// applyBridge regenerates the outer curve of a front under its bridge.
+// scale is how much the front has been scaled: the extent and height of
+// the bridge are part of the frame and scale with it, but the radius and
+// splay fit a nose and don't.
+func applyBridge(front models.Front, b models.Bridge, scale float64) (models.Front, error) {
+	outer := front.Outercurve
+	if len(outer) < 4 {
+		return front, errors.New("front has no outer curve for the bridge")
+	}
+	extent := b.Extent.Millimetres() * scale
+	height := b.Height.Millimetres() * scale
+	radius := b.Radius.Millimetres()
+	splay := b.Splay.Radians()
+	switch {
+	case extent <= 0 || height <= 0:
+		return front, errors.New("bridge needs an extent and a height")
+	case radius < minNoseRadius:
+		return front, fmt.Errorf("bridge radius of %.2fmm is less than the %.2fmm minimum", radius, minNoseRadius)
+	case b.Splay < 0 || b.Splay > maxBridgeSplay:
+		return front, fmt.Errorf("bridge splay must be between 0 and %v degrees", maxBridgeSplay)
+	}
+
+	// The bridge is under the end of the outer curve that is lower on the
+	// centre line, as design y points down.  Work with the curve running
+	// from the top of the front round to the bridge.
+	pts := append(geometry.BSpline{}, outer...)
+	atEnd := pts[len(pts)-1][1] > pts[0][1]
+	if !atEnd {
+		for i, j := 0, len(pts)-1; i < j; i, j = i+1, j-1 {
+			pts[i], pts[j] = pts[j], pts[i]
+		}
+	}
+	top := pts[0][1]
+	side := 1.0
+	for _, pt := range pts {
+		if math.Abs(pt[0]) > extent {
+			side = math.Copysign(1, pt[0])
+			break
+		}
+	}
+	keep := len(pts)
+	for keep > 0 && math.Abs(pts[keep-1][0]) < extent {
+		keep--
+	}
+	if keep == 0 {
+		return front, fmt.Errorf("bridge extent of %.2fmm covers the whole outer curve", extent)
+	}
+	pts = pts[:keep]
+	base := pts[keep-1][1]
+
+	// The arch is round at the crest, then runs straight down the sides
+	// of the nose to the base.  The arc meets the side where its tangent is
+	// splayed out from vertical.
+	crest := base - height
+	if crest-top < minRimWall {
+		return front, fmt.Errorf("bridge leaves %.2fmm above it, minimum is %.2fmm", crest-top, minRimWall)
+	}
+	meet := math.Pi/2 - splay
+	meetY := crest + radius - radius*math.Cos(meet)
+	if meetY > base {
+		return front, fmt.Errorf("bridge %.2fmm tall is too low for a %.2fmm nose radius", height, radius)
+	}
+	sideLength := (base - meetY) / math.Cos(splay)
+	baseU := radius*math.Sin(meet) + sideLength*math.Sin(splay)
+	if baseU >= extent {
+		return front, fmt.Errorf("bridge is %.2fmm wide at its base, more than its %.2fmm extent", 2*baseU, 2*extent)
+	}
+
+	var arch []geometry.Point
+	steps := int(math.Ceil(radius*meet/bridgeStep)) + 1
+	for i := 0; i <= steps; i++ {
+		phi := meet * float64(i) / float64(steps)
+		arch = append(arch, geometry.Point{radius * math.Sin(phi), crest + radius - radius*math.Cos(phi)})
+	}
+	steps = int(math.Ceil(sideLength / bridgeStep))
+	for i := 1; i <= steps; i++ {
+		t := sideLength * float64(i) / float64(steps)
+		arch = append(arch, geometry.Point{radius*math.Sin(meet) + t*math.Sin(splay), meetY + t*math.Cos(splay)})
+	}
+	for i := len(arch) - 1; i >= 0; i-- {
+		pts = append(pts, geometry.Point{side * arch[i][0], arch[i][1]})
+	}
+
+	if !atEnd {
+		for i, j := 0, len(pts)-1; i < j; i, j = i+1, j-1 {
+			pts[i], pts[j] = pts[j], pts[i]
+		}
+	}
+	front.Outercurve = pts
+	return front, nil
+}
+
+// bridgeFront regenerates the outer curves of both sides of a front under
+// its bridge.
+func bridgeFront(front models.Front, b models.Bridge, scale float64) (models.Front, error) {
+	front, err := applyBridge(front, b, scale)
+	if err != nil || front.Right == nil {
+		return front, err
+	}
+	right := front
+	right.Outercurve = front.Right.Outercurve
+	if right, err = applyBridge(right, b, scale); err != nil {
+		return front, fmt.Errorf("right side: %v", err)
+	}
+	side := *front.Right
+	side.Outercurve = right.Outercurve
+	front.Right = &side
+	return front, nil
+}
+
+// checkBridge makes sure a front with its bridge regenerated can still be
+// made, returning the first error found.
+func checkBridge(des models.Design, front models.Front) error {
+	des.Front = front
+	for _, f := range validateDesign(des) {
+		if f.Severity == models.FINDING_ERROR {
+			return fmt.Errorf("bridge doesn't fit the front: %v", f.Message)
+		}
+	}
+	return nil
+}
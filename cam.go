@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+
+	"code.google.com/p/draw2d/draw2d"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+)
+
+// Machining parameters, in millimetres
+const (
+	camSafeZ         = 5.0 // Clearance height for rapid moves
+	camBreakthrough  = 0.2 // Through cuts go this far into the spoilboard
+	lensGrooveDepth  = 0.8 // Depth of the lens groove into the rim
+	camPreviewPPMM   = 10
+	camPreviewMargin = 5.0
+)
+
+// Machining operations.  Fronts are cut in this order, with the outer
+// profile last so the part stays held by the blank until the end.
+const (
+	opEngrave = "engrave"
+	opPocket  = "pocket"
+	opGroove  = "groove"
+	opProfile = "profile"
+)
+
+// camTool is a cutter in the tool library.  Operations lists what the
+// tool is used for; engraving tools are matched to the design by their
+// included angle.  Rates are in mm/min.
+type camTool struct {
+	Number     int      `json:"number"`
+	Name       string   `json:"name"`
+	Diameter   float64  `json:"diameter"`
+	Angle      float64  `json:"angle,omitempty"`
+	StepDown   float64  `json:"step_down"`
+	Feed       float64  `json:"feed"`
+	Plunge     float64  `json:"plunge"`
+	RPM        int      `json:"rpm"`
+	Operations []string `json:"operations"`
+}
+
+// toolLibrary is the tools loaded in the machine.  It can be replaced
+// with a JSON file named by TOOL_LIBRARY.
+var toolLibrary = []camTool{
+	{1, "3mm flat endmill", 3, 0, 1.5, 1200, 300, 16000, []string{opProfile, opPocket}},
+	{2, "1mm flat endmill", 1, 0, 0.5, 600, 150, 20000, []string{opPocket}},
+	{3, "60 degree engraver", 3, 60, 0.3, 800, 200, 18000, []string{opEngrave}},
+	{4, "90 degree engraver", 6, 90, 0.3, 800, 200, 18000, []string{opEngrave}},
+	{5, "lens groove cutter", 6, 0, 0, 500, 100, 12000, []string{opGroove}},
+}
+
+// check makes sure a tool can be used to plan toolpaths.  Tools with no
+// feed, plunge rate or diameter would stall the machine or break the
+// timings, so they are refused rather than skipped.
+func (t camTool) check() error {
+	switch {
+	case t.Diameter <= 0:
+		return fmt.Errorf("tool %d %v: diameter must be more than 0", t.Number, t.Name)
+	case t.Feed <= 0:
+		return fmt.Errorf("tool %d %v: feed must be more than 0", t.Number, t.Name)
+	case t.Plunge <= 0:
+		return fmt.Errorf("tool %d %v: plunge rate must be more than 0", t.Number, t.Name)
+	case t.RPM <= 0:
+		return fmt.Errorf("tool %d %v: rpm must be more than 0", t.Number, t.Name)
+	case t.StepDown < 0:
+		return fmt.Errorf("tool %d %v: step down can't be negative", t.Number, t.Name)
+	case len(t.Operations) == 0:
+		return fmt.Errorf("tool %d %v: no operations", t.Number, t.Name)
+	}
+	for _, op := range t.Operations {
+		switch op {
+		case opEngrave:
+			if t.Angle <= 0 || t.Angle >= 180 {
+				return fmt.Errorf("tool %d %v: engraving tools need an angle between 0 and 180 degrees", t.Number, t.Name)
+			}
+		case opPocket, opGroove, opProfile:
+		default:
+			return fmt.Errorf("tool %d %v: unknown operation %v", t.Number, t.Name, op)
+		}
+	}
+	return nil
+}
+
+// loadToolLibrary replaces the tool library with the tools in a JSON file,
+// if every tool in it is usable.
+func loadToolLibrary(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var tools []camTool
+	if err = json.Unmarshal(data, &tools); err != nil {
+		return err
+	}
+	if len(tools) == 0 {
+		return errors.New("tool library is empty")
+	}
+	numbers := make(map[int]bool, len(tools))
+	for _, t := range tools {
+		if err := t.check(); err != nil {
+			return err
+		}
+		if numbers[t.Number] {
+			return fmt.Errorf("tool number %d is used twice", t.Number)
+		}
+		numbers[t.Number] = true
+	}
+	toolLibrary = tools
+	return nil
+}
+
+// findTool returns the largest tool for an operation that is no wider than
+// maxDiameter, or the one with the given angle for engraving.
+func findTool(op string, maxDiameter, angle float64) (tool camTool, err error) {
+	found := false
+	for _, t := range toolLibrary {
+		if !containsString(t.Operations, op) || t.Diameter > maxDiameter {
+			continue
+		}
+		if op == opEngrave && math.Abs(t.Angle-angle) > 0.5 {
+			continue
+		}
+		if !found || t.Diameter > tool.Diameter {
+			tool, found = t, true
+		}
+	}
+	if !found {
+		if op == opEngrave {
+			return tool, fmt.Errorf("no %v degree engraving tool in the library", angle)
+		}
+		return tool, fmt.Errorf("no %v tool smaller than %.2fmm in the library", op, maxDiameter)
+	}
+	return
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// camOperation is a set of contours cut with one tool at a series of
+// depths. Depths are negative, measured down from the top of the blank.
+type camOperation struct {
+	Name     string
+	Op       string
+	Tool     camTool
+	Depths   []float64
+	Closed   bool
+	Contours [][]geometry.Point
+	Entry    []geometry.Point // Where the tool enters for each contour, if not at its start
+}
+
+// length is how far the tool cuts across all passes.
+func (o camOperation) length() (l float64) {
+	for _, c := range o.Contours {
+		for i := 1; i < len(c); i++ {
+			l += distance(c[i-1], c[i])
+		}
+		if o.Closed && len(c) > 1 {
+			l += distance(c[len(c)-1], c[0])
+		}
+	}
+	return l * float64(len(o.Depths))
+}
+
+// passDepths steps down to depth no more than stepDown at a time.
+func passDepths(depth, stepDown float64) []float64 {
+	if stepDown <= 0 || stepDown >= depth {
+		return []float64{-depth}
+	}
+	n := int(math.Ceil(depth / stepDown))
+	depths := make([]float64, n)
+	for i := range depths {
+		depths[i] = -depth * float64(i+1) / float64(n)
+	}
+	return depths
+}
+
+// openContour removes the closing point of a closed polyline.
+func openContour(pts []geometry.Point) []geometry.Point {
+	if len(pts) > 1 && distance(pts[0], pts[len(pts)-1]) < 1e-6 {
+		return pts[:len(pts)-1]
+	}
+	return pts
+}
+
+func signedArea(pts []geometry.Point) (a float64) {
+	for i := range pts {
+		j := (i + 1) % len(pts)
+		a += pts[i][0]*pts[j][1] - pts[j][0]*pts[i][1]
+	}
+	return a / 2
+}
+
+// offsetContour moves a closed contour outward by d, or inward if d is
+// negative.  Corners are mitred, with the mitre limited to 2d so that
+// sharp points don't send the tool wandering off.
+func offsetContour(pts []geometry.Point, d float64) []geometry.Point {
+	pts = openContour(pts)
+	n := len(pts)
+	if n < 3 {
+		return pts
+	}
+	if signedArea(pts) < 0 {
+		d = -d
+	}
+	normal := func(a, b geometry.Point) geometry.Point {
+		l := distance(a, b)
+		if l == 0 {
+			return geometry.Point{}
+		}
+		return geometry.Point{(b[1] - a[1]) / l, -(b[0] - a[0]) / l}
+	}
+	out := make([]geometry.Point, n)
+	for i := range pts {
+		n1 := normal(pts[(i+n-1)%n], pts[i])
+		n2 := normal(pts[i], pts[(i+1)%n])
+		m := geometry.Point{n1[0] + n2[0], n1[1] + n2[1]}
+		dot := (1 + n1[0]*n2[0] + n1[1]*n2[1]) / 2
+		scale := d / dot
+		if dot < 0.25 {
+			scale = 2 * d / math.Sqrt(math.Max(dot, 1e-9))
+		}
+		out[i] = geometry.Point{pts[i][0] + m[0]/2*scale, pts[i][1] + m[1]/2*scale}
+	}
+	return out
+}
+
+// smallestWidth is the narrower side of the bounding box of a contour,
+// which limits the size of tool that can cut inside it.
+func smallestWidth(pts []geometry.Point) float64 {
+	min, max := boundsOf(pts)
+	return math.Min(max[0]-min[0], max[1]-min[1])
+}
+
+// frontOperations plans the machining of a customized front from a blank
+// of the given thickness.
+func frontOperations(front models.Front, thickness float64) (ops []camOperation, err error) {
+	throughDepth := thickness + camBreakthrough
+
+	ops, err = engravingOperations(front.Engraving, thickness, func(pt geometry.Point) geometry.Point { return pt })
+	if err != nil {
+		return nil, err
+	}
+
+	// Holes and lenses are cut out from the inside, both sides of the front
+	var cutouts, lenses [][]geometry.Point
+	for _, side := range []models.FrontSide{front.FrontSide, frontRight(front)} {
+		for _, hole := range side.Holes {
+			cutouts = append(cutouts, polyline(hole, true))
+		}
+		lens := polyline(side.Lens, true)
+		if len(lens) == 0 {
+			return nil, errors.New("design has no lens")
+		}
+		lenses = append(lenses, lens)
+	}
+	for i, contours := range [][][]geometry.Point{cutouts, lenses} {
+		if len(contours) == 0 {
+			continue
+		}
+		width := math.Inf(1)
+		for _, c := range contours {
+			width = math.Min(width, smallestWidth(c))
+		}
+		tool, err := findTool(opPocket, width, 0)
+		if err != nil {
+			return nil, err
+		}
+		op := camOperation{Name: []string{"holes", "lenses"}[i], Op: opPocket, Tool: tool,
+			Depths: passDepths(throughDepth, tool.StepDown), Closed: true}
+		for _, c := range contours {
+			op.Contours = append(op.Contours, offsetContour(c, -tool.Diameter/2))
+		}
+		ops = append(ops, op)
+	}
+
+	// The groove cutter enters through the middle of the lens opening and
+	// cuts at half the thickness of the rim
+	tool, err := findTool(opGroove, math.Min(smallestWidth(lenses[0]), smallestWidth(lenses[1])), 0)
+	if err != nil {
+		return nil, err
+	}
+	groove := camOperation{Name: "lens grooves", Op: opGroove, Tool: tool,
+		Depths: []float64{-thickness / 2}, Closed: true}
+	for _, c := range lenses {
+		min, max := boundsOf(c)
+		groove.Contours = append(groove.Contours, offsetContour(c, lensGrooveDepth-tool.Diameter/2))
+		groove.Entry = append(groove.Entry, geometry.Point{(min[0] + max[0]) / 2, (min[1] + max[1]) / 2})
+	}
+	ops = append(ops, groove)
+
+	outline := frontOutline(front)
+	if len(outline) == 0 {
+		return nil, errors.New("design has no outer curve")
+	}
+	if tool, err = findTool(opProfile, math.Inf(1), 0); err != nil {
+		return nil, err
+	}
+	ops = append(ops, camOperation{Name: "outer profile", Op: opProfile, Tool: tool,
+		Depths: passDepths(throughDepth, tool.StepDown), Closed: true,
+		Contours: [][]geometry.Point{offsetContour(outline, tool.Diameter/2)}})
+	return
+}
+
+// templeOperations plans cutting a pair of temples from a blank.  The
+// temples are laid out as in the exports, with their text engraved.
+func templeOperations(temple models.Temple, thickness float64, text templeText) (ops []camOperation, err error) {
+	if len(polyline(temple.Contour, false)) == 0 {
+		return nil, errors.New("design has no temple")
+	}
+	tool, err := findTool(opProfile, math.Inf(1), 0)
+	if err != nil {
+		return nil, err
+	}
+	var profiles [][]geometry.Point
+	for _, t := range templePair(temple, 0) {
+		contour := polyline(t.Contour, false)
+		placed := make([]geometry.Point, len(contour))
+		for i, pt := range contour {
+			placed[i] = t.place(pt)
+		}
+		profiles = append(profiles, offsetContour(placed, tool.Diameter/2))
+		engraving, err := engravingOperations(t.Engraving, thickness, t.place)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, engraving...)
+	}
+	toLeft, toRight := templeSheet(temple, 0)
+	leftText, rightText, err := templeTextEngravings(temple, text, toLeft, toRight)
+	if err != nil {
+		return nil, err
+	}
+	same := func(pt geometry.Point) geometry.Point { return pt }
+	for _, eng := range []models.Engraving{leftText, rightText} {
+		engraving, err := engravingOperations(eng, thickness, same)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, engraving...)
+	}
+	ops = append(ops, camOperation{Name: "temple profiles", Op: opProfile, Tool: tool,
+		Depths: passDepths(thickness+camBreakthrough, tool.StepDown), Closed: true,
+		Contours: profiles})
+	return
+}
+
+// writeGcode writes the operations as a G-code program.  Machine y points
+// away from the operator, so design y is flipped.
+func writeGcode(w io.Writer, title string, ops []camOperation) {
+	xy := func(pt geometry.Point) string {
+		return fmt.Sprintf("X%.3f Y%.3f", pt[0], -pt[1])
+	}
+	fmt.Fprintf(w, "(%v)\n", title)
+	fmt.Fprintln(w, "G21 G90 G17 (mm, absolute, XY plane)")
+	fmt.Fprintf(w, "G0 Z%.3f\n", camSafeZ)
+	toolNumber := -1
+	for _, op := range ops {
+		fmt.Fprintf(w, "\n(%v with T%d %v)\n", op.Name, op.Tool.Number, op.Tool.Name)
+		if op.Tool.Number != toolNumber {
+			fmt.Fprintf(w, "M5\nG0 Z%.3f\nT%d M6\nS%d M3\n", camSafeZ, op.Tool.Number, op.Tool.RPM)
+			toolNumber = op.Tool.Number
+		}
+		for i, contour := range op.Contours {
+			if len(contour) == 0 {
+				continue
+			}
+			for _, z := range op.Depths {
+				start := contour[0]
+				if i < len(op.Entry) {
+					start = op.Entry[i]
+				}
+				fmt.Fprintf(w, "G0 %v\n", xy(start))
+				fmt.Fprintf(w, "G1 Z%.3f F%.0f\n", z, op.Tool.Plunge)
+				fmt.Fprintf(w, "G1 %v F%.0f\n", xy(contour[0]), op.Tool.Feed)
+				for _, pt := range contour[1:] {
+					fmt.Fprintf(w, "G1 %v\n", xy(pt))
+				}
+				if op.Closed {
+					fmt.Fprintf(w, "G1 %v\n", xy(contour[0]))
+				}
+				if i < len(op.Entry) {
+					fmt.Fprintf(w, "G1 %v\n", xy(start))
+				}
+				fmt.Fprintf(w, "G0 Z%.3f\n", camSafeZ)
+			}
+		}
+	}
+	fmt.Fprintln(w, "\nM5\nM30")
+}
+
+// writeCamSummary describes the operations for the machine operator.
+func writeCamSummary(w io.Writer, title string, ops []camOperation) {
+	fmt.Fprintln(w, title)
+	total := 0.0
+	for i, op := range ops {
+		minutes := op.length() / op.Tool.Feed
+		total += minutes
+		fmt.Fprintf(w, "%d. %v: T%d %v, %d contours, %d passes to %.2fmm, %.0fmm of cutting, %.1f min\n",
+			i+1, op.Name, op.Tool.Number, op.Tool.Name, len(op.Contours), len(op.Depths),
+			-op.Depths[len(op.Depths)-1], op.length(), minutes)
+	}
+	fmt.Fprintf(w, "Total cutting time %.1f min\n", total)
+}
+
+// camPreviewColors are the colors of each operation in the preview.
+var camPreviewColors = map[string]color.RGBA{
+	opEngrave: {0, 0, 200, 255},
+	opPocket:  {200, 0, 0, 255},
+	opGroove:  {0, 150, 0, 255},
+	opProfile: {0, 0, 0, 255},
+}
+
+// renderToolpaths draws the toolpaths from above.
+func renderToolpaths(ops []camOperation) *image.RGBA {
+	var pts []geometry.Point
+	for _, op := range ops {
+		for _, c := range op.Contours {
+			pts = append(pts, c...)
+		}
+	}
+	min, max := boundsOf(pts)
+	origin := geometry.Point{min[0] - camPreviewMargin, min[1] - camPreviewMargin}
+	width := int((max[0] - origin[0] + camPreviewMargin) * camPreviewPPMM)
+	height := int((max[1] - origin[1] + camPreviewMargin) * camPreviewPPMM)
+	im := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range im.Pix {
+		im.Pix[i] = 255
+	}
+
+	gc := draw2d.NewGraphicContext(im)
+	px := func(pt geometry.Point) (float64, float64) {
+		return (pt[0] - origin[0]) * camPreviewPPMM, (pt[1] - origin[1]) * camPreviewPPMM
+	}
+	for _, op := range ops {
+		gc.SetStrokeColor(camPreviewColors[op.Op])
+		gc.SetLineWidth(1)
+		for _, c := range op.Contours {
+			if len(c) == 0 {
+				continue
+			}
+			gc.MoveTo(px(c[0]))
+			for _, pt := range c[1:] {
+				gc.LineTo(px(pt))
+			}
+			if op.Closed {
+				gc.Close()
+			}
+			gc.Stroke()
+		}
+	}
+	return im
+}
+
+// orderMaterial is the material a part of an order is cut from.  Temples
+// are cut from the order's temple material, or else the temple material
+// that goes with its front material.
+func orderMaterial(order models.Order, part string) (material models.Material, err error) {
+	material, err = models.FindMaterialById(order.FrontMaterial.Hex())
+	if err != nil {
+		return material, fmt.Errorf("front material: %v", err)
+	}
+	if part == "temple" {
+		templeMaterial := order.TempleMaterial
+		if len(templeMaterial) == 0 {
+			templeMaterial = material.TempleMaterial
+		}
+		if len(templeMaterial) > 0 {
+			if material, err = models.FindMaterialById(templeMaterial.Hex()); err != nil {
+				return material, fmt.Errorf("temple material: %v", err)
+			}
+		}
+	}
+	return
+}
+
+// orderCamOperations plans the machining of one part of an order, "front"
+// or "temple", from the order's materials.  Material thicknesses are in
+// millimetres; laminated blanks are as thick as both layers.
+func orderCamOperations(id, part string) (order models.Order, ops []camOperation, err error) {
+	order, geom, err := orderDesignGeometry(id)
+	if err != nil {
+		return
+	}
+	material, err := orderMaterial(order, part)
+	if err != nil {
+		return
+	}
+	thickness := float64(material.TopThickness + material.BottomThickness)
+	if thickness <= 0 {
+		return order, nil, fmt.Errorf("material %v has no thickness", material.Name)
+	}
+
+	switch part {
+	case "front":
+		ops, err = frontOperations(geom.Front, thickness)
+	case "temple":
+		ops, err = templeOperations(geom.Temple, thickness, orderTempleText(order, geom.Temple))
+	default:
+		err = errors.New("part must be front or temple")
+	}
+	return
+}
+
+// getOrderGcode returns the G-code to machine a part of an order, or with
+// ?format=txt or ?format=png a summary or picture of the toolpaths.
+func getOrderGcode(ctx context.Context) error {
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	part := ctx.QueryValue("part")
+	if len(part) == 0 {
+		part = "front"
+	}
+	order, ops, err := orderCamOperations(ctx.PathValue("id"), part)
+	if err != nil {
+		log.Printf("Error planning toolpaths for order %v: %v", ctx.PathValue("id"), err)
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	title := fmt.Sprintf("Order %v %v", order.Id.Hex(), part)
+
+	var out bytes.Buffer
+	rw := ctx.HttpResponseWriter()
+	format := ctx.QueryValue("format")
+	switch format {
+	case "", "gcode":
+		format = "nc"
+		writeGcode(&out, title, ops)
+		rw.Header().Set("Content-Type", "text/plain")
+	case "txt":
+		writeCamSummary(&out, title, ops)
+		rw.Header().Set("Content-Type", "text/plain")
+	case "png":
+		if err = png.Encode(&out, renderToolpaths(ops)); err != nil {
+			return goweb.API.RespondWithError(ctx, 500, err.Error())
+		}
+		rw.Header().Set("Content-Type", "image/png")
+	default:
+		return goweb.API.RespondWithError(ctx, 400, "format must be gcode, txt or png")
+	}
+	rw.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"order-%v-%v.%v\"", order.Id.Hex(), part, format))
+	return goweb.Respond.With(ctx, 200, out.Bytes())
+}
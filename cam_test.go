@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+)
+
+func TestPassDepths(t *testing.T) {
+	cases := []struct {
+		depth, stepDown float64
+		want            []float64
+	}{
+		{3, 1.5, []float64{-1.5, -3}},
+		{3.2, 1.5, []float64{-3.2 / 3, -6.4 / 3, -3.2}},
+		{1, 2, []float64{-1}},
+		{1.5, 1.5, []float64{-1.5}},
+		{2, 0, []float64{-2}},
+	}
+	for _, c := range cases {
+		got := passDepths(c.depth, c.stepDown)
+		if len(got) != len(c.want) {
+			t.Errorf("passDepths(%v, %v) = %v, want %v", c.depth, c.stepDown, got, c.want)
+			continue
+		}
+		for i := range got {
+			if math.Abs(got[i]-c.want[i]) > 1e-9 {
+				t.Errorf("passDepths(%v, %v) = %v, want %v", c.depth, c.stepDown, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestOffsetContour(t *testing.T) {
+	square := []geometry.Point{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}}
+	reversed := []geometry.Point{{0, 0}, {0, 10}, {10, 10}, {10, 0}, {0, 0}}
+	cases := []struct {
+		pts      []geometry.Point
+		d        float64
+		min, max geometry.Point
+	}{
+		{square, 1, geometry.Point{-1, -1}, geometry.Point{11, 11}},
+		{reversed, 1, geometry.Point{-1, -1}, geometry.Point{11, 11}},
+		{square, -1.5, geometry.Point{1.5, 1.5}, geometry.Point{8.5, 8.5}},
+		{reversed, -1.5, geometry.Point{1.5, 1.5}, geometry.Point{8.5, 8.5}},
+	}
+	for _, c := range cases {
+		got := offsetContour(c.pts, c.d)
+		if len(got) != 4 {
+			t.Errorf("offset of %v has %v points, want 4", c.pts, len(got))
+		}
+		min, max := boundsOf(got)
+		if distance(min, c.min) > 1e-9 || distance(max, c.max) > 1e-9 {
+			t.Errorf("offset of %v by %v is from %v to %v, want %v to %v", c.pts, c.d, min, max, c.min, c.max)
+		}
+	}
+
+	// The mitre at a sharp point is limited to twice the offset
+	spike := []geometry.Point{{0, 0}, {100, 1}, {0, 2}}
+	for _, pt := range offsetContour(spike, 1) {
+		if pt[0] > 100+2+1e-9 {
+			t.Errorf("mitre of sharp point reaches %v", pt)
+		}
+	}
+}
+
+func TestToolCheck(t *testing.T) {
+	for _, tool := range toolLibrary {
+		if err := tool.check(); err != nil {
+			t.Errorf("built-in %v", err)
+		}
+	}
+	good := camTool{1, "3mm flat endmill", 3, 0, 1.5, 1200, 300, 16000, []string{opProfile}}
+	cases := []struct {
+		change func(*camTool)
+		want   string
+	}{
+		{func(t *camTool) { t.Diameter = 0 }, "diameter"},
+		{func(t *camTool) { t.Feed = 0 }, "feed"},
+		{func(t *camTool) { t.Feed = -100 }, "feed"},
+		{func(t *camTool) { t.Plunge = 0 }, "plunge"},
+		{func(t *camTool) { t.RPM = 0 }, "rpm"},
+		{func(t *camTool) { t.StepDown = -1 }, "step down"},
+		{func(t *camTool) { t.Operations = nil }, "no operations"},
+		{func(t *camTool) { t.Operations = []string{"drill"} }, "unknown operation drill"},
+		{func(t *camTool) { t.Operations = []string{opEngrave} }, "angle"},
+	}
+	for _, c := range cases {
+		tool := good
+		c.change(&tool)
+		if err := tool.check(); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%+v: error %v, want one about %v", tool, err, c.want)
+		}
+	}
+}
+
+func TestLoadToolLibrary(t *testing.T) {
+	defaults := toolLibrary
+	defer func() { toolLibrary = defaults }()
+	dir, err := ioutil.TempDir("", "tools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tools.json")
+
+	bad := []string{
+		`[]`,
+		`[{"number": 1, "name": "stalled", "diameter": 3, "step_down": 1, "feed": 0, "plunge": 300, "rpm": 16000, "operations": ["profile"]}]`,
+		`[{"number": 1, "name": "a", "diameter": 3, "step_down": 1, "feed": 1000, "plunge": 300, "rpm": 16000, "operations": ["profile"]},
+		  {"number": 1, "name": "b", "diameter": 1, "step_down": 1, "feed": 1000, "plunge": 300, "rpm": 16000, "operations": ["pocket"]}]`,
+	}
+	for _, library := range bad {
+		if err := ioutil.WriteFile(path, []byte(library), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadToolLibrary(path); err == nil {
+			t.Errorf("loaded %v", library)
+		}
+		if len(toolLibrary) != len(defaults) {
+			t.Errorf("failed load replaced the library with %v", toolLibrary)
+		}
+	}
+
+	good := `[{"number": 7, "name": "2mm endmill", "diameter": 2, "step_down": 1, "feed": 900, "plunge": 200, "rpm": 18000, "operations": ["profile", "pocket"]}]`
+	if err := ioutil.WriteFile(path, []byte(good), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadToolLibrary(path); err != nil || len(toolLibrary) != 1 || toolLibrary[0].Number != 7 {
+		t.Errorf("loading %v gave %v, %v", good, toolLibrary, err)
+	}
+}
+
+func TestFrontOperations(t *testing.T) {
+	var front models.Front
+	front.Outercurve = geometry.BSpline{{0, -15}, {-35, -20}, {-70, -5}, {-65, 15}, {-30, 20}, {0, 12}}
+	front.Lens = geometry.BSpline{{-10, -10}, {-55, -12}, {-58, 10}, {-12, 12}}
+	front.Engraving = models.Engraving{Depth: 30, Angle: 60, Paths: []geometry.BSpline{{{-20, -16}, {-40, -16}}}}
+
+	ops, err := frontOperations(front, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, op := range ops {
+		names = append(names, op.Name)
+		if op.Tool.Feed <= 0 || len(op.Depths) == 0 {
+			t.Errorf("%v has tool %+v and depths %v", op.Name, op.Tool, op.Depths)
+		}
+	}
+	if got := strings.Join(names, ", "); got != "engraving, lenses, lens grooves, outer profile" {
+		t.Errorf("operations are %v", got)
+	}
+	profile := ops[len(ops)-1]
+	if n := len(profile.Depths); n != 3 || math.Abs(profile.Depths[n-1]+4+camBreakthrough) > 1e-9 {
+		t.Errorf("profile depths %v, want 3 passes through 4mm", profile.Depths)
+	}
+	if ops[1].Tool.Number != 1 || len(ops[1].Contours) != 2 {
+		t.Errorf("lenses cut with %v, %v contours", ops[1].Tool.Name, len(ops[1].Contours))
+	}
+
+	var gcode, summary bytes.Buffer
+	writeGcode(&gcode, "test", ops)
+	writeCamSummary(&summary, "test", ops)
+	if strings.Contains(gcode.String(), " F0\n") {
+		t.Errorf("G-code has a move with no feed")
+	}
+	if n := strings.Count(gcode.String(), " M6\n"); n != 4 {
+		t.Errorf("G-code has %v tool changes, want 4", n)
+	}
+	if strings.Contains(summary.String(), "Inf") || strings.Contains(summary.String(), "NaN") {
+		t.Errorf("summary has a broken time:\n%v", summary.String())
+	}
+
+	if _, err := frontOperations(models.Front{}, 4); err == nil {
+		t.Errorf("front with no lens should fail")
+	}
+}
@@ -1,27 +1,153 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 
 	"github.com/guildeyewear/legoserver/models"
 	"github.com/stretchr/goweb"
 	"github.com/stretchr/goweb/context"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type collectionsController struct{}
 
 func (c *collectionsController) ReadMany(ctx context.Context) error {
-	//templates := []string{"Toronto Collection", "Untitled", "GUILD Everyday", "Experimental"}
-	templates := []string{"Toronto Collection", "Sunglasses"}
+	var collections []models.Collection
+	var err error
+	if at, preview := catalogueView(ctx); preview {
+		collections, err = models.GetAllCollections()
+	} else {
+		collections, err = models.GetPublishedCollections(at)
+	}
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
 	log.Println("Returning array")
-	return goweb.API.WriteResponseObject(ctx, 200, templates)
+	return goweb.API.WriteResponseObject(ctx, 200, collections)
 }
 
 func (c *collectionsController) Read(collection string, ctx context.Context) error {
-	log.Println("Getting designs in collections", collection)
-	designs, err := models.GetDesignsWithCollection(collection)
+	log.Println("Getting collection", collection)
+	coll, err := models.FindCollection(collection)
+	if at, preview := catalogueView(ctx); err != nil || (!preview && !coll.IsPublishedAt(at)) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, coll)
+}
+
+func (c *collectionsController) Create(ctx context.Context) error {
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	var coll models.Collection
+	data, err := ctx.RequestBody()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if err := json.Unmarshal(data, &coll); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	// Designs are added through /collections/{id}/designs, which keeps
+	// their references to the collection
+	coll.Designs = nil
+	if err := models.CreateCollection(&coll); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 201, coll)
+}
+
+// Update applies the fields present in the request body to the collection.
+// Membership is changed through /collections/{id}/designs instead.
+func (c *collectionsController) Update(id string, ctx context.Context) error {
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	coll, err := models.FindCollection(id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	data, err := ctx.RequestBody()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	collId, designs := coll.Id, coll.Designs
+	if err := json.Unmarshal(data, &coll); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	coll.Id, coll.Designs = collId, designs
+	if err := models.CheckCollectionSlug(&coll); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if err := models.UpdateCollection(&coll); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, coll)
+}
+
+func (c *collectionsController) Delete(id string, ctx context.Context) error {
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	coll, err := models.FindCollection(id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if err := models.DeleteCollection(coll.Id); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	return goweb.Respond.WithStatus(ctx, 200)
+}
+
+// collectionDesigns returns the designs of a collection in display
+// order on GET, filtered by attribute as in attributeFilter, and
+// replaces the ordered membership with the array of design ids in the
+// request body on PUT.
+func collectionDesigns(ctx context.Context) error {
+	coll, err := models.FindCollection(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	at, preview := catalogueView(ctx)
+
+	if ctx.MethodString() == "PUT" {
+		if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+			return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+		}
+		data, err := ctx.RequestBody()
+		if err != nil {
+			return goweb.API.RespondWithError(ctx, 400, err.Error())
+		}
+		var ids []string
+		if err := json.Unmarshal(data, &ids); err != nil {
+			return goweb.API.RespondWithError(ctx, 400, err.Error())
+		}
+		designs := make([]bson.ObjectId, len(ids))
+		for i, id := range ids {
+			if !bson.IsObjectIdHex(id) {
+				return goweb.API.RespondWithError(ctx, 400, "invalid design id "+id)
+			}
+			designs[i] = bson.ObjectIdHex(id)
+		}
+		if err := models.SetCollectionDesigns(&coll, designs); err != nil {
+			return goweb.API.RespondWithError(ctx, 500, err.Error())
+		}
+		preview = true
+	} else if !preview && !coll.IsPublishedAt(at) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+
+	log.Println("Getting designs in collection", coll.Slug)
+	designs, err := models.GetCollectionDesigns(coll)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if !preview {
+		designs = models.FilterPublishedDesigns(designs, at)
+	}
+	wanted, err := attributeFilter(ctx)
 	if err != nil {
 		return goweb.API.RespondWithError(ctx, 400, err.Error())
 	}
-	return goweb.API.WriteResponseObject(ctx, 200, designs)
+	return goweb.API.WriteResponseObject(ctx, 200, models.FilterDesignsByAttributes(designs, wanted))
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"time"
+
+	"code.google.com/p/draw2d/draw2d"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+)
+
+// Colours of the two designs in a comparison, chosen to be told apart by
+// people with the common colour blindnesses.
+var (
+	compareColorA = color.RGBA{230, 97, 0, 255}
+	compareColorB = color.RGBA{93, 58, 155, 255}
+)
+
+// measurementFields are the measurements compared between designs, by the
+// names they are stored under.
+var measurementFields = []struct {
+	name  string
+	value func(models.Measurements) models.Length
+}{
+	{"eye_size", func(m models.Measurements) models.Length { return m.EyeSize }},
+	{"b_measurement", func(m models.Measurements) models.Length { return m.BMeasurement }},
+	{"bridge", func(m models.Measurements) models.Length { return m.Bridge }},
+	{"temple_length", func(m models.Measurements) models.Length { return m.TempleLength }},
+	{"frame_pd", func(m models.Measurements) models.Length { return m.FramePD }},
+	{"effective_diameter", func(m models.Measurements) models.Length { return m.EffectiveDiameter }},
+	{"total_width", func(m models.Measurements) models.Length { return m.TotalWidth }},
+}
+
+// comparedDesign is one side of a comparison.
+type comparedDesign struct {
+	Id           string              `json:"id"`
+	Name         string              `json:"name"`
+	Revision     int                 `json:"revision"`
+	Color        string              `json:"color"`
+	Measurements models.Measurements `json:"measurements"`
+}
+
+type compareResponse struct {
+	Url           string             `json:"url"`
+	PixelsDensity int16              `json:"pixels_per_mm"`
+	A             comparedDesign     `json:"a"`
+	B             comparedDesign     `json:"b"`
+	Deltas        map[string]float64 `json:"deltas"`        // B - A, in mm
+	MaxDeviation  map[string]float64 `json:"max_deviation"` // By curve, in mm
+}
+
+// curveDeviation is the furthest that any point of either polyline is
+// from the other polyline.
+func curveDeviation(p, q []geometry.Point) float64 {
+	furthest := func(p, q []geometry.Point) (d float64) {
+		for _, pt := range p {
+			closest, _ := closestApproach([]geometry.Point{pt}, q)
+			d = math.Max(d, closest)
+		}
+		return
+	}
+	return math.Max(furthest(p, q), furthest(q, p))
+}
+
+// comparedRevision loads a design for comparison, at ?<side>_revision= if
+// given.  Drafts and earlier revisions can only be compared by the
+// designer and system admins.
+func comparedRevision(ctx context.Context, id, side string) (des models.Design, err error) {
+	if des, err = models.FindDesignById(id); err != nil {
+		return
+	}
+	if des.StatusAt(time.Now()) == models.PUBLISH_DRAFT && !canEditDesign(des, ctx) {
+		return des, fmt.Errorf("design %v not found", id)
+	}
+	v := ctx.QueryValue(side + "_revision")
+	if len(v) == 0 {
+		return
+	}
+	revision, err := strconv.Atoi(v)
+	if err != nil {
+		return des, fmt.Errorf("%v_revision must be a number", side)
+	}
+	if revision != des.Revision && !canEditDesign(des, ctx) {
+		return des, fmt.Errorf("revision %v of design %v not found", revision, id)
+	}
+	if des, err = models.FindDesignRevision(id, revision); err != nil {
+		return des, fmt.Errorf("revision %v of design %v not found", revision, id)
+	}
+	return
+}
+
+// compareDesigns overlays design ?a= and design ?b= at true scale in
+// contrasting colours, and gives the differences in their measurements and
+// the furthest their curves are apart.  Without ?b= two revisions of design
+// a are compared, chosen with ?a_revision= and ?b_revision=; each defaults
+// to the current revision.
+func compareDesigns(ctx context.Context) error {
+	idA, idB := ctx.QueryValue("a"), ctx.QueryValue("b")
+	if len(idA) == 0 {
+		return goweb.API.RespondWithError(ctx, 400, "a design to compare is required")
+	}
+	if len(idB) == 0 {
+		idB = idA
+	}
+	a, err := comparedRevision(ctx, idA, "a")
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, err.Error())
+	}
+	b, err := comparedRevision(ctx, idB, "b")
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, err.Error())
+	}
+
+	side := func(des models.Design, c color.RGBA) comparedDesign {
+		return comparedDesign{des.Id.Hex(), des.Name, des.Revision, fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B),
+			frameMeasurements(des.Front, des.Temple)}
+	}
+	response := compareResponse{
+		PixelsDensity: renderPPMM,
+		A:             side(a, compareColorA),
+		B:             side(b, compareColorB),
+		Deltas:        make(map[string]float64),
+		MaxDeviation:  make(map[string]float64),
+	}
+	for _, m := range measurementFields {
+		response.Deltas[m.name] = (m.value(response.B.Measurements) - m.value(response.A.Measurements)).Millimetres()
+	}
+	curves := []struct {
+		name   string
+		pa, pb []geometry.Point
+	}{
+		{"front", frontOutline(a.Front), frontOutline(b.Front)},
+		{"lens", polyline(a.Front.Lens, true), polyline(b.Front.Lens, true)},
+		{"right_lens", polyline(frontRight(a.Front).Lens, true), polyline(frontRight(b.Front).Lens, true)},
+		{"temple", polyline(a.Temple.Contour, false), polyline(b.Temple.Contour, false)},
+		{"right_temple", polyline(templeRight(a.Temple).Contour, false), polyline(templeRight(b.Temple).Contour, false)},
+	}
+	for _, c := range curves {
+		if len(c.pa) > 0 && len(c.pb) > 0 {
+			response.MaxDeviation[c.name] = curveDeviation(c.pa, c.pb)
+		}
+	}
+
+	filename := fmt.Sprintf("compare-%v-%v-%v-%v.png", a.Id.Hex(), a.Revision, b.Id.Hex(), b.Revision)
+	saveToPngFile(filename, drawComparison(a, b))
+	response.Url = fmt.Sprintf("http://%v/static/%v", ctx.HttpRequest().Host, filename)
+	return goweb.API.WriteResponseObject(ctx, 200, response)
+}
+
+// drawComparison outlines both designs on one image at renderPPMM.  The
+// fronts share their origin, and the temples are drawn below the fronts,
+// both moved the same way so that they line up as drawn.
+func drawComparison(a, b models.Design) image.Image {
+	const margin = 5.0 // mm
+	type outlined struct {
+		color  color.RGBA
+		closed [][]geometry.Point
+		open   [][]geometry.Point
+	}
+	var sides []outlined
+	var all []geometry.Point
+	for _, d := range []struct {
+		des   models.Design
+		color color.RGBA
+	}{{a, compareColorA}, {b, compareColorB}} {
+		o := outlined{color: d.color}
+		if outline := frontOutline(d.des.Front); len(outline) > 0 {
+			o.closed = append(o.closed, outline)
+		}
+		for _, side := range []models.FrontSide{d.des.Front.FrontSide, frontRight(d.des.Front)} {
+			if lens := polyline(side.Lens, true); len(lens) > 0 {
+				o.closed = append(o.closed, lens)
+			}
+			for _, hole := range side.Holes {
+				if pts := polyline(hole, true); len(pts) > 0 {
+					o.closed = append(o.closed, pts)
+				}
+			}
+		}
+		for _, pts := range o.closed {
+			all = append(all, pts...)
+		}
+		sides = append(sides, o)
+	}
+
+	// Temples go below the lower of the two fronts
+	_, frontMax := boundsOf(all)
+	var temples []geometry.Point
+	contours := make([][]geometry.Point, len(sides))
+	for i, des := range []models.Design{a, b} {
+		contours[i] = polyline(des.Temple.Contour, false)
+		temples = append(temples, contours[i]...)
+	}
+	if len(temples) > 0 {
+		tmin, tmax := boundsOf(temples)
+		dx, dy := -(tmin[0]+tmax[0])/2, frontMax[1]+exportTempleGap-tmin[1]
+		for i, contour := range contours {
+			moved := make([]geometry.Point, len(contour))
+			for j, pt := range contour {
+				moved[j] = geometry.Point{pt[0] + dx, pt[1] + dy}
+			}
+			sides[i].open = append(sides[i].open, moved)
+			all = append(all, moved...)
+		}
+	}
+
+	min, max := boundsOf(all)
+	if len(all) == 0 {
+		min, max = geometry.Point{}, geometry.Point{}
+	}
+	width := int((max[0] - min[0] + 2*margin) * renderPPMM)
+	height := int((max[1] - min[1] + 2*margin) * renderPPMM)
+	im := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(im, im.Bounds(), image.White, image.ZP, draw.Src)
+	gc := draw2d.NewGraphicContext(im)
+
+	px := func(pt geometry.Point) (float64, float64) {
+		return (pt[0] - min[0] + margin) * renderPPMM, (pt[1] - min[1] + margin) * renderPPMM
+	}
+	trace := func(pts []geometry.Point, closed bool) {
+		for i, pt := range pts {
+			x, y := px(pt)
+			if i == 0 {
+				gc.MoveTo(x, y)
+			} else {
+				gc.LineTo(x, y)
+			}
+		}
+		if closed {
+			gc.Close()
+		}
+	}
+	for _, o := range sides {
+		gc.SetStrokeColor(o.color)
+		gc.SetLineWidth(2)
+		for _, pts := range o.closed {
+			trace(pts, true)
+		}
+		for _, pts := range o.open {
+			trace(pts, false)
+		}
+		gc.Stroke()
+	}
+	return im
+}
+
+// getDesignRevisions lists the earlier revisions of a design, for its
+// designer and system admins.
+func getDesignRevisions(ctx context.Context) error {
+	des, err := models.FindDesignById(ctx.PathValue("id"))
+	if err != nil || !canEditDesign(des, ctx) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	revisions, err := models.GetDesignRevisions(des.Id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	if revisions == nil {
+		revisions = []models.DesignRevision{}
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, revisions)
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"log"
 	"strconv"
+	"time"
 
 	"github.com/guildeyewear/legoserver/models"
 	"github.com/stretchr/goweb"
@@ -35,11 +36,33 @@ func requireAuth(userLevel byte, ctx context.Context) bool {
 		log.Println("Returning unauthorized")
 		return false
 	}
-	ut := user.(models.User).Type
-	if ut == 0 {
-		return false
+	return user.(models.User).HasLevel(userLevel)
+}
+
+// isOwnerOrAdmin is true if the logged in user is the given designer or
+// is a system admin.
+func isOwnerOrAdmin(designer string, ctx context.Context) bool {
+	if requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		return true
 	}
-	return true
+	user, ok := ctx.Data()["user"].(models.User)
+	return ok && len(designer) > 0 && user.Id == designer
+}
+
+// catalogueView decides how publishing schedules apply to a request.
+// Everyone sees the content that is published now. System admins can
+// preview unpublished content with ?preview=true, or see the catalogue as
+// it will be at a future launch with ?at=<RFC3339 time>.
+func catalogueView(ctx context.Context) (at time.Time, preview bool) {
+	at = time.Now()
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		return
+	}
+	if t, err := time.Parse(time.RFC3339, ctx.QueryValue("at")); err == nil {
+		at = t
+	}
+	preview = ctx.QueryValue("preview") == "true"
+	return
 }
 
 // Orders
@@ -59,6 +82,48 @@ func (o *ordersController) Create(ctx context.Context) error {
 		user := ctx.Data()["user"].(models.User)
 		order.UserId = user.Id
 		order.AccountId = user.AccountId
+		if len(order.DesignId) > 0 {
+			design, err := models.FindDesignById(order.DesignId.Hex())
+			if err != nil {
+				return goweb.API.RespondWithError(ctx, 400, err.Error())
+			}
+			// A size is ordered as the design that is that size
+			if len(order.Size) > 0 {
+				if order.Scale != 0 && order.Scale != 1 {
+					return goweb.API.RespondWithError(ctx, 400, "order a size or a scale, not both")
+				}
+				if design, err = models.FindFamilySize(design, order.Size); err != nil {
+					return goweb.API.RespondWithError(ctx, 400, err.Error())
+				}
+				order.DesignId = design.Id
+				order.Scale = 1
+			}
+			if !design.IsOrderableAt(time.Now()) || !composedPartsPublished(design, time.Now()) {
+				return goweb.API.RespondWithError(ctx, 400, "design is not available for order")
+			}
+			// Without a vertical position the bridge rests on the
+			// customer's nose, as fitting recommends
+			if order.YPosition == nil {
+				y := noseYPosition(design, order.Scale, order.CustomerInfo.SizeInfo)
+				order.YPosition = &y
+			}
+			// Parametric bridges are cut to the customer's nose, unless
+			// the order gives the bridge to make
+			if order.Bridge == nil && design.Front.Bridge != nil {
+				order.Bridge = bridgeForNose(order.CustomerInfo.SizeInfo)
+			}
+			geom, err := customizeDesign(design, order.Scale, *order.YPosition, order.Bridge)
+			if err == nil && order.Bridge != nil {
+				err = checkBridge(design, geom.Front)
+			}
+			if err != nil {
+				return goweb.API.RespondWithError(ctx, 400, err.Error())
+			}
+			order.Measurements = geom.Measurements
+			if err = checkTempleText(geom.Temple, orderTempleText(order, geom.Temple)); err != nil {
+				return goweb.API.RespondWithError(ctx, 400, err.Error())
+			}
+		}
 		if err = models.CreateOrder(&order); err != nil {
 			log.Printf("Error creating order in database in POST /orders: %v", err)
 			return goweb.API.RespondWithError(ctx, 400, err.Error())
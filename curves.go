@@ -0,0 +1,220 @@
+package main
+
+import (
+	"math"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+)
+
+// The design curves are stored as b-spline control points in millimetres.
+// Measuring and checking them is easier with points that lie on the curve,
+// so these helpers sample the curves into polylines.
+
+// curveSteps is the number of line segments each bezier section of a
+// curve is sampled into.
+const curveSteps = 16
+
+// polyline samples a b-spline into points on the curve. Closed curves such
+// as lenses are sampled all the way round, so the last point equals the first.
+func polyline(s geometry.BSpline, closed bool) []geometry.Point {
+	if len(s) == 0 {
+		return nil
+	}
+	bzs := s.ConvertToBeziers(closed, !closed)
+	if len(bzs) == 0 {
+		// A copy, as callers move the points they are given
+		return append([]geometry.Point(nil), s...)
+	}
+	pts := []geometry.Point{bzs[0][0]}
+	for _, bez := range bzs {
+		for i := 1; i <= curveSteps; i++ {
+			pts = append(pts, bezierPoint(bez[0], bez[1], bez[2], bez[3], float64(i)/curveSteps))
+		}
+	}
+	return pts
+}
+
+// bezierPoint evaluates the cubic bezier with control points a, b, c, d at t.
+func bezierPoint(a, b, c, d geometry.Point, t float64) geometry.Point {
+	u := 1 - t
+	return geometry.Point{
+		u*u*u*a[0] + 3*u*u*t*b[0] + 3*u*t*t*c[0] + t*t*t*d[0],
+		u*u*u*a[1] + 3*u*u*t*b[1] + 3*u*t*t*c[1] + t*t*t*d[1],
+	}
+}
+
+// mirrorX reflects points about the y axis, which is the centre line of
+// the frame, turning left side geometry into right side geometry.
+func mirrorX(pts []geometry.Point) []geometry.Point {
+	mirrored := make([]geometry.Point, len(pts))
+	for i, pt := range pts {
+		mirrored[i] = geometry.Point{-pt[0], pt[1]}
+	}
+	return mirrored
+}
+
+// mirrorSpline reflects a b-spline about the centre line.  Reflection is
+// affine, so mirroring the control points mirrors the curve exactly.
+func mirrorSpline(s geometry.BSpline) geometry.BSpline {
+	if s == nil {
+		return nil
+	}
+	return geometry.BSpline(mirrorX(s))
+}
+
+// frontRight is the right side of a front, in place on its side of the
+// centre line: the front's own right side if it is asymmetric, or else the
+// mirror image of the left.
+func frontRight(front models.Front) models.FrontSide {
+	if front.Right != nil {
+		return *front.Right
+	}
+	right := models.FrontSide{Outercurve: mirrorSpline(front.Outercurve), Lens: mirrorSpline(front.Lens)}
+	for _, hole := range front.Holes {
+		right.Holes = append(right.Holes, mirrorSpline(hole))
+	}
+	return right
+}
+
+// orientRight makes the right outer curve of an asymmetric front run the
+// same way round as the left, from the same end on the centre line, as
+// the mirror image would.  Reversing the control points of a b-spline
+// reverses the curve.
+func orientRight(front *models.Front) {
+	if front.Right == nil || len(front.Outercurve) == 0 || len(front.Right.Outercurve) == 0 {
+		return
+	}
+	left, right := front.Outercurve, front.Right.Outercurve
+	start := geometry.Point{-left[0][0], left[0][1]}
+	if distance(start, right[0]) <= distance(start, right[len(right)-1]) {
+		return
+	}
+	reversed := make(geometry.BSpline, len(right))
+	for i, pt := range right {
+		reversed[len(right)-1-i] = pt
+	}
+	side := *front.Right
+	side.Outercurve = reversed
+	front.Right = &side
+}
+
+// templeRight is the right temple, drawn the same way as the left: the
+// temple's own right temple if they are asymmetric, or else the left.
+func templeRight(temple models.Temple) models.TempleSide {
+	if temple.Right != nil {
+		return *temple.Right
+	}
+	return temple.TempleSide
+}
+
+// boundsOf returns the minimum and maximum corners of the box around pts.
+func boundsOf(pts []geometry.Point) (min, max geometry.Point) {
+	min = geometry.Point{math.Inf(1), math.Inf(1)}
+	max = geometry.Point{math.Inf(-1), math.Inf(-1)}
+	for _, pt := range pts {
+		min[0], min[1] = math.Min(min[0], pt[0]), math.Min(min[1], pt[1])
+		max[0], max[1] = math.Max(max[0], pt[0]), math.Max(max[1], pt[1])
+	}
+	return
+}
+
+// distance is the euclidean distance between two points.
+func distance(a, b geometry.Point) float64 {
+	return math.Hypot(a[0]-b[0], a[1]-b[1])
+}
+
+// frontOutline is the closed outline of the whole front, made from the left
+// outer curve followed by the right outer curve traced back to the start.
+// Like a closed polyline the last point repeats the first.
+func frontOutline(front models.Front) []geometry.Point {
+	left := polyline(front.Outercurve, false)
+	right := polyline(frontRight(front).Outercurve, false)
+	if len(left) == 0 || len(right) == 0 {
+		return nil
+	}
+	outline := make([]geometry.Point, 0, len(left)+len(right)+1)
+	outline = append(outline, left...)
+	for i := len(right) - 1; i >= 0; i-- {
+		// The halves meet on the centre line, so don't repeat those points
+		if distance(outline[len(outline)-1], right[i]) > 1e-6 {
+			outline = append(outline, right[i])
+		}
+	}
+	if distance(outline[len(outline)-1], outline[0]) > 1e-6 {
+		outline = append(outline, outline[0])
+	}
+	return outline
+}
+
+// segmentIntersection returns the point where segments ab and cd cross,
+// if they do.
+func segmentIntersection(a, b, c, d geometry.Point) (geometry.Point, bool) {
+	r := geometry.Point{b[0] - a[0], b[1] - a[1]}
+	s := geometry.Point{d[0] - c[0], d[1] - c[1]}
+	denom := r[0]*s[1] - r[1]*s[0]
+	if math.Abs(denom) < 1e-12 {
+		return geometry.Point{}, false
+	}
+	t := ((c[0]-a[0])*s[1] - (c[1]-a[1])*s[0]) / denom
+	u := ((c[0]-a[0])*r[1] - (c[1]-a[1])*r[0]) / denom
+	if t < 0 || t > 1 || u < 0 || u > 1 {
+		return geometry.Point{}, false
+	}
+	return geometry.Point{a[0] + t*r[0], a[1] + t*r[1]}, true
+}
+
+// selfIntersections returns the points where a polyline crosses itself.
+// Neighbouring segments always touch so they are not compared.
+func selfIntersections(pts []geometry.Point, closed bool) (crossings []geometry.Point) {
+	n := len(pts) - 1
+	for i := 0; i < n; i++ {
+		for j := i + 2; j < n; j++ {
+			if closed && i == 0 && j == n-1 {
+				continue
+			}
+			if pt, ok := segmentIntersection(pts[i], pts[i+1], pts[j], pts[j+1]); ok {
+				crossings = append(crossings, pt)
+			}
+		}
+	}
+	return
+}
+
+// insidePolygon is true if pt is inside the closed polygon.
+func insidePolygon(pt geometry.Point, polygon []geometry.Point) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a[1] > pt[1]) != (b[1] > pt[1]) &&
+			pt[0] < (b[0]-a[0])*(pt[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// closestOnSegment returns the point on segment ab nearest to pt.
+func closestOnSegment(pt, a, b geometry.Point) geometry.Point {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	lenSq := dx*dx + dy*dy
+	if lenSq == 0 {
+		return a
+	}
+	t := math.Max(0, math.Min(1, ((pt[0]-a[0])*dx+(pt[1]-a[1])*dy)/lenSq))
+	return geometry.Point{a[0] + t*dx, a[1] + t*dy}
+}
+
+// closestApproach returns the smallest distance between two polylines and
+// the point on the first where it occurs.
+func closestApproach(p, q []geometry.Point) (dist float64, at geometry.Point) {
+	dist = math.Inf(1)
+	for _, pt := range p {
+		for j := 0; j+1 < len(q); j++ {
+			if d := distance(pt, closestOnSegment(pt, q[j], q[j+1])); d < dist {
+				dist, at = d, pt
+			}
+		}
+	}
+	return
+}
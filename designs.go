@@ -8,7 +8,9 @@ import (
 	"image/color"
 	"image/png"
 	"log"
+	"math"
 	"os"
+	"strconv"
 	"time"
 
 	"code.google.com/p/draw2d/draw2d"
@@ -21,99 +23,213 @@ import (
 
 type designController struct{}
 
+// Material used when rendering a design without a material
+const defaultMaterialId = "542c5f3bc296ec236005bffa" // black
+
+// Renders are drawn at true size, 1mm : 10px
+const renderPPMM = 10
+
+// canEditDesign is true if the logged in user designed the design or is a
+// system admin.
+func canEditDesign(des models.Design, ctx context.Context) bool {
+	return isOwnerOrAdmin(des.Designer, ctx)
+}
+
+// ReadMany lists the designs, optionally only those in ?collection=<id or slug>
+// and with the attributes asked for as in attributeFilter.  A collection
+// that isn't published is not found, unless the catalogue is previewed.
 func (m *designController) ReadMany(ctx context.Context) error {
-	designs, err := models.GetAllDesigns()
+	collection := ctx.QueryValue("collection")
+	wanted, err := attributeFilter(ctx)
 	if err != nil {
 		return goweb.API.RespondWithError(ctx, 400, err.Error())
 	}
-	//	return goweb.API.RespondWithData(ctx, designs)
-	return goweb.API.WriteResponseObject(ctx, 200, designs)
-}
-
-func getCollectionDesigns(ctx context.Context) error {
-	collection := ctx.QueryValue("collection")
 	log.Println("Collection is ", collection)
 	var designs []models.Design
-	var err error
-	if len(collection) == 0 {
+	at, preview := catalogueView(ctx)
+	if len(collection) > 0 {
+		// Collections that aren't published yet are hidden as in collectionDesigns
+		coll, findErr := models.FindCollection(collection)
+		if findErr != nil || (!preview && !coll.IsPublishedAt(at)) {
+			return goweb.API.RespondWithError(ctx, 404, "Not Found")
+		}
+		designs, err = models.GetCollectionDesigns(coll)
+	} else if preview {
 		designs, err = models.GetAllDesigns()
 	} else {
-		designs, err = models.GetDesignsWithCollection(collection)
+		designs, err = models.GetPublishedDesigns(at)
 	}
 	if err != nil {
 		return goweb.API.RespondWithError(ctx, 400, err.Error())
 	}
+	if !preview {
+		designs = models.FilterPublishedDesigns(designs, at)
+	}
+	designs = models.FilterDesignsByAttributes(designs, wanted)
 	//	return goweb.API.RespondWithData(ctx, designs)
-	return goweb.API.WriteResponseObject(ctx, 200, designs)
+	return writeInUnits(ctx, 200, designs)
 }
 
-func convertDesign(import_design map[string]interface{}) models.Design {
-	design := models.Design{}
-	design.Name = import_design["name"].(string)
-	design.Collections = []string{import_design["collection"].(string)}
-	design.Updated = time.Now()
-	//	design.Designer = user.Id
-	design.Designer = import_design["owner"].(string)
-	front := models.Front{}
-	o1 := import_design["outercurve"].(map[string]interface{})
-	o2 := o1["points"].([]interface{})
-	front.Outercurve = make(geometry.BSpline, len(o2))
-	for i, pt1 := range o2 {
-		pt := pt1.(map[string]interface{})
-		front.Outercurve[i] = [2]float64{pt["x"].(float64), pt["y"].(float64)}
-	}
-
-	lens := import_design["eyehole"].(map[string]interface{})
-	lenspts := lens["points"].([]interface{})
-	front.Lens = make(geometry.BSpline, len(lenspts))
-	for i, ptI := range lenspts {
-		pt := ptI.(map[string]interface{})
-		front.Lens[i] = [2]float64{pt["x"].(float64), pt["y"].(float64)}
-	}
-	design.Front = front
-
-	temple := models.Temple{}
-	templec := import_design["templecurve"].(map[string]interface{})
-	templepts := templec["points"].([]interface{})
-	temple.Contour = make(geometry.BSpline, len(templepts))
-	for i, ptI := range templepts {
-		pt := ptI.(map[string]interface{})
-		temple.Contour[i] = [2]float64{pt["x"].(float64), pt["y"].(float64)}
-	}
-
-	location := import_design["templelocation"].(map[string]interface{})
-	temple.TempleSeparation = int16(location["x"].(float64) * 100)
-	temple.TempleHeight = int16(location["y"].(float64) * 100)
-	design.Temple = temple
-	return design
+// Read returns a single design.  Archived designs can still be read so
+// that existing orders can resolve them, but drafts are only visible to
+// their designer and to system admins.
+func (m *designController) Read(id string, ctx context.Context) error {
+	des, err := models.FindDesignById(id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if des.StatusAt(time.Now()) == models.PUBLISH_DRAFT && !canEditDesign(des, ctx) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	return writeInUnits(ctx, 200, des)
 }
 
-func importDesign(ctx context.Context) error {
-	log.Println("Importing design")
-	//userdata := ctx.Data()["user"]
-	//if userdata == nil {
-	//		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
-	//	}
-	//	user := userdata.(models.User)
+func (m *designController) Create(ctx context.Context) error {
+	if !requireAuth(models.USER_NORMAL, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	var des models.Design
+	data, err := ctx.RequestBody()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if err := readInUnits(ctx, data, &des); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if err := des.Validate(); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	user := ctx.Data()["user"].(models.User)
+	des.Id = ""
+	des.Designer = user.Id
+	des.Updated = time.Now()
+	des.Collections = nil
+	des.Family = nil
+	des.Review = nil
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		des.Lifecycle = models.Lifecycle{}
+	}
+	if err := checkDesign(&des); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if err := models.InsertDesign(&des); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	return writeInUnits(ctx, 201, des)
+}
+
+// Update applies a partial design to an existing one, so that for example
+// {"temple": {"contour": [...]}} replaces the temple contour and leaves the
+// rest of the design alone.
+func (m *designController) Update(id string, ctx context.Context) error {
+	return m.save(id, ctx, true)
+}
+
+// Replace swaps out the whole design document.
+func (m *designController) Replace(id string, ctx context.Context) error {
+	return m.save(id, ctx, false)
+}
 
-	// Read the data
+// editDesign decodes an edit of a design, with its lengths in unit.  A
+// partial edit is decoded into a copy of the existing design, because
+// decoding reuses the slices, maps and pointers of what it decodes into
+// and would otherwise change the existing design, which is kept as the
+// previous revision, as well.
+func editDesign(existing models.Design, data []byte, unit *models.Unit, partial bool) (des models.Design, err error) {
+	if partial {
+		var copied []byte
+		if copied, err = json.Marshal(existing); err != nil {
+			return
+		}
+		if err = json.Unmarshal(copied, &des); err != nil {
+			return
+		}
+	}
+	err = decodeInUnits(unit, data, &des)
+	return
+}
+
+func (m *designController) save(id string, ctx context.Context, partial bool) error {
+	if !requireAuth(models.USER_NORMAL, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	existing, err := models.FindDesignById(id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if !canEditDesign(existing, ctx) {
+		return goweb.API.RespondWithError(ctx, 403, "Forbidden")
+	}
+	if reviewLocked(existing, ctx) {
+		return goweb.API.RespondWithError(ctx, 409, reviewLockedError(existing))
+	}
 	data, err := ctx.RequestBody()
 	if err != nil {
 		return goweb.API.RespondWithError(ctx, 400, err.Error())
 	}
 
-	var old_design interface{}
-	err = json.Unmarshal(data, &old_design)
+	unit, err := requestUnit(ctx)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	des, err := editDesign(existing, data, unit, partial)
 	if err != nil {
 		return goweb.API.RespondWithError(ctx, 400, err.Error())
 	}
-	import_design := old_design.(map[string]interface{})
-	design := convertDesign(import_design)
-	if err = models.InsertDesign(&design); err != nil {
+	if err := des.Validate(); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+
+	// Ownership, membership and review aren't changed by editing the
+	// design, and only system admins can publish.
+	des.Id = existing.Id
+	des.Designer = existing.Designer
+	des.Collections = existing.Collections
+	des.Family = existing.Family
+	des.Review = existing.Review
+	des.Revision = existing.Revision
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		des.Lifecycle = existing.Lifecycle
+	}
+	if err := checkDesign(&des); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if err := models.UpdateDesignRevision(existing, &des); err != nil {
 		return goweb.API.RespondWithError(ctx, 500, err.Error())
 	}
+	return writeInUnits(ctx, 200, des)
+}
+
+// Delete removes a design, unless orders reference it in which case it is
+// archived so that the orders can still be made.
+func (m *designController) Delete(id string, ctx context.Context) error {
+	if !requireAuth(models.USER_NORMAL, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	des, err := models.FindDesignById(id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if !canEditDesign(des, ctx) {
+		return goweb.API.RespondWithError(ctx, 403, "Forbidden")
+	}
 
-	return goweb.API.WriteResponseObject(ctx, 201, design)
+	orders, err := models.CountDesignOrders(des.Id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	if orders > 0 {
+		log.Printf("Archiving design %v referenced by %v orders", id, orders)
+		des.Status = models.PUBLISH_ARCHIVED
+		if err := models.UpdateDesign(&des); err != nil {
+			return goweb.API.RespondWithError(ctx, 500, err.Error())
+		}
+		return goweb.API.WriteResponseObject(ctx, 200, des)
+	}
+	if err := models.DeleteDesign(des.Id); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	return goweb.Respond.WithStatus(ctx, 200)
 }
 
 // Design controller
@@ -127,18 +243,30 @@ func getDesignRender(ctx context.Context) error {
 	}
 
 	// Load the frame material. Default to black.
-	materialId := "542c5f3bc296ec236005bffa" // black
+	materialId := defaultMaterialId
 	//materialId = "542d7ad1119e3247afd88f82"  // havana
 	if matId := ctx.FormValue("materialid"); len(matId) > 0 {
 		materialId = matId
 	}
 
-	//left := des.Front.Outercurve.Scale(10)
-	//right := des.Front.Outercurve.Scale(10)
-	left := des.Front.Outercurve.Scale(9.3)
-	right := des.Front.Outercurve.Scale(9.3)
+	// The render can preview an order's customization
+	scale, _ := strconv.ParseFloat(ctx.FormValue("scale"), 64)
+	yPos, _ := strconv.ParseFloat(ctx.FormValue("ypos"), 64)
+	geom, err := customizeDesign(des, scale, yPos, nil)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+
+	filename := fmt.Sprintf("%v-%v", designId.Str(), materialId)
+	if geom.Scale != 1 || geom.YPosition != 0 {
+		filename += fmt.Sprintf("-%g-%g", geom.Scale, geom.YPosition)
+	}
+	return renderFront(ctx, filename+".png", geom.Front, materialId)
+}
 
-	filename := fmt.Sprintf("%v-%v.png", designId.Str(), materialId)
+// renderFront draws a front in a material to a PNG in the static files,
+// and responds with where to find it.
+func renderFront(ctx context.Context, filename string, front models.Front, materialId string) error {
 	url := fmt.Sprintf("http://%v/static/%v", ctx.HttpRequest().Host, filename)
 	type renderResponse struct {
 		Url           string  `json:"url"`
@@ -161,86 +289,167 @@ func getDesignRender(ctx context.Context) error {
 	}
 	// PNG image.  Dimensions by convention, correspond to 1mm : 10px
 	im := image.NewRGBA(image.Rect(0, 0, 2000, 900))
-	//
-	//	// Offset the frame so it just fits on the canvas
-	_, miny := left.MinValues()
-	for i, pt := range left {
-		left[i] = geometry.Point{pt[0] + 1000, pt[1] - miny}     // Center on graphic
-		right[i] = geometry.Point{pt[0]*-1 + 1000, pt[1] - miny} // Center on graphic
-	}
-	log.Printf("Left endpoints: %v, %v", left[0], left[len(left)-1])
 
 	dc := material.TopColor
 	fillColor := color.RGBA{uint8(dc[0]), uint8(dc[1]), uint8(dc[2]), uint8(dc[3])}
 
-	// Get the curves for the outer contour
-	bzs := left.ConvertToBeziers(false, true)
-	bzs_r := right.ConvertToBeziers(false, true)
 	gc := draw2d.NewGraphicContext(im)
 	gc.SetFillColor(fillColor)
 	gc.SetStrokeColor(fillColor)
+	miny := drawFront(gc, front, renderPPMM, 1000, 0)
 
-	gc.MoveTo(bzs[0][0][0], bzs[0][0][1])
-	for _, bez := range bzs {
-		gc.CubicCurveTo(bez[1][0], bez[1][1], bez[2][0], bez[2][1], bez[3][0], bez[3][1])
+	log.Println("material:")
+	log.Println(material)
+	applyTexture(im, im.Bounds(), fillColor, material.TopTexture)
+	drawEngraving(gc, front.Engraving, renderPPMM, 1000, 0, miny, fillColor)
+
+	saveToPngFile(filename, im)
+
+	dinfo := renderResponse{url, miny / -renderPPMM, renderPPMM}
+	return goweb.API.WriteResponseObject(ctx, 200, dinfo)
+}
+
+// renderTemples draws a pair of temples laid out as for cutting, with their
+// text engraved, to a PNG in the static files and responds with where to
+// find it.
+func renderTemples(ctx context.Context, filename string, temple models.Temple, text templeText, material models.Material) error {
+	if len(polyline(temple.Contour, false)) == 0 {
+		return goweb.API.RespondWithError(ctx, 400, "design has no temple")
 	}
-	for i := len(bzs_r) - 1; i >= 0; i-- {
-		bez := bzs_r[i]
-		gc.CubicCurveTo(bez[2][0], bez[2][1], bez[1][0], bez[1][1], bez[0][0], bez[0][1])
+	toLeft, toRight := templeSheet(temple, 0)
+	left, right, err := templeTextEngravings(temple, text, toLeft, toRight)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
 	}
 
-	//lens_l := des.Front.Lens.Scale(10)
-	//lens_l := des.Front.Lens.Scale(10)
-	lens_l := des.Front.Lens.Scale(9.3)
-	lens_r := des.Front.Lens.Scale(9.3)
-	for i, pt := range lens_l {
-		lens_l[i] = geometry.Point{pt[0] + 1000, pt[1] - miny}
-		lens_r[i] = geometry.Point{-1*pt[0] + 1000, pt[1] - miny}
+	pair := templePair(temple, 0)
+	var sheet [][]geometry.Point
+	var all []geometry.Point
+	for _, t := range pair {
+		contour := polyline(t.Contour, false)
+		placed := make([]geometry.Point, len(contour))
+		for i, pt := range contour {
+			placed[i] = t.place(pt)
+		}
+		sheet = append(sheet, placed)
+		all = append(all, placed...)
 	}
-	lens_bzr := lens_l.ConvertToBeziers(true, false)
-	lens_bzr_r := lens_r.ConvertToBeziers(true, false)
-	gc.MoveTo(lens_bzr[0][0][0], lens_bzr[0][0][1])
-	for _, bez := range lens_bzr {
-		gc.CubicCurveTo(bez[1][0], bez[1][1], bez[2][0], bez[2][1], bez[3][0], bez[3][1])
+	min, max := boundsOf(all)
+	margin := 5.0
+	width, height := (max[0]-min[0]+2*margin)*renderPPMM, (max[1]-min[1]+2*margin)*renderPPMM
+	im := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+
+	dc := material.TopColor
+	fillColor := color.RGBA{uint8(dc[0]), uint8(dc[1]), uint8(dc[2]), uint8(dc[3])}
+	gc := draw2d.NewGraphicContext(im)
+	gc.SetFillColor(fillColor)
+	gc.SetStrokeColor(fillColor)
+	cx, top := width/2, (margin-min[1])*renderPPMM
+	for _, pts := range sheet {
+		for i, pt := range pts {
+			if i == 0 {
+				gc.MoveTo(pt[0]*renderPPMM+cx, pt[1]*renderPPMM+top)
+			} else {
+				gc.LineTo(pt[0]*renderPPMM+cx, pt[1]*renderPPMM+top)
+			}
+		}
+		gc.Close()
 	}
-	gc.MoveTo(lens_bzr_r[0][0][0], lens_bzr_r[0][0][1])
-	for _, bez := range lens_bzr_r {
-		gc.CubicCurveTo(bez[1][0], bez[1][1], bez[2][0], bez[2][1], bez[3][0], bez[3][1])
+	gc.FillStroke()
+	applyTexture(im, im.Bounds(), fillColor, material.TopTexture)
+	for _, eng := range []models.Engraving{placeEngraving(pair[0].Engraving, pair[0].place),
+		placeEngraving(pair[1].Engraving, pair[1].place), left, right} {
+		drawEngraving(gc, eng, renderPPMM, cx, top, 0, fillColor)
 	}
 
-	gc.FillStroke()
+	saveToPngFile(filename, im)
+	url := fmt.Sprintf("http://%v/static/%v", ctx.HttpRequest().Host, filename)
+	return goweb.API.WriteResponseObject(ctx, 200, map[string]interface{}{"url": url, "pixels_per_mm": renderPPMM})
+}
 
-	log.Println("material:")
-	log.Println(material)
-	log.Println("top:", material.TopTexture)
-	if len(material.TopTexture) > 0 {
-		log.Println("Applying top texture", material.TopTexture)
-		// load the image of top texture and apply it
-		if imFile, err := os.Open(material.TopTexture); err == nil {
-			defer imFile.Close()
-			if textIm, _, err2 := image.Decode(imFile); err2 == nil {
-				bounds := im.Bounds()
-				for i := bounds.Min.X; i <= bounds.Max.X; i++ {
-					for j := bounds.Min.Y; j <= bounds.Max.Y; j++ {
-						if im.At(i, j) == fillColor {
-							r, g, b, a := textIm.At(i, j).RGBA()
-							im.Set(i, j, color.RGBA{uint8(r), uint8(g), uint8(b), uint8(a) - 20})
-						}
-					}
-				}
-			} else {
-				log.Printf("Error! %v", err2.Error())
-			}
-		} else {
-			log.Printf("Error! %v", err.Error())
+// drawFront traces both sides of a front with its lens holes and fills it
+// with the current fill colour. The front is scaled to ppmm pixels per
+// millimetre, centred horizontally on cx and offset so that its lowest
+// control point sits at top. It returns the scaled minimum y of the outer
+// curve, which callers need to locate the design origin in the image.
+func drawFront(gc draw2d.GraphicContext, front models.Front, ppmm, cx, top float64) float64 {
+	right := frontRight(front)
+	left := front.Outercurve.Scale(ppmm)
+	_, miny := left.MinValues()
+	if len(right.Outercurve) > 0 {
+		_, rminy := right.Outercurve.Scale(ppmm).MinValues()
+		miny = math.Min(miny, rminy)
+	}
+
+	// Offset the frame so it just fits on the canvas
+	place := func(s geometry.BSpline) geometry.BSpline {
+		placed := make(geometry.BSpline, len(s))
+		for i, pt := range s {
+			placed[i] = geometry.Point{pt[0]*ppmm + cx, pt[1]*ppmm - miny + top} // Center on graphic
+		}
+		return placed
+	}
+	trace := func(bzs []cubic) {
+		if len(bzs) == 0 {
+			return
+		}
+		gc.MoveTo(bzs[0][0][0], bzs[0][0][1])
+		for _, bez := range bzs {
+			gc.CubicCurveTo(bez[1][0], bez[1][1], bez[2][0], bez[2][1], bez[3][0], bez[3][1])
 		}
+	}
 
+	// Get the curves for the outer contour
+	placed := place(front.Outercurve)
+	log.Printf("Left endpoints: %v, %v", placed[0], placed[len(placed)-1])
+	bzs := splineCubics(placed, false)
+	bzs_r := splineCubics(place(right.Outercurve), false)
+	trace(bzs)
+	for i := len(bzs_r) - 1; i >= 0; i-- {
+		bez := bzs_r[i]
+		gc.CubicCurveTo(bez[2][0], bez[2][1], bez[1][0], bez[1][1], bez[0][0], bez[0][1])
 	}
 
-	saveToPngFile(filename, im)
+	// Lenses and holes are cut out of both sides
+	for _, side := range []models.FrontSide{front.FrontSide, right} {
+		trace(splineCubics(place(side.Lens), true))
+		for _, hole := range side.Holes {
+			trace(splineCubics(place(hole), true))
+		}
+	}
 
-	dinfo := renderResponse{url, miny / -10.0, 10}
-	return goweb.API.WriteResponseObject(ctx, 200, dinfo)
+	gc.FillStroke()
+	return miny
+}
+
+// applyTexture replaces the pixels of im within bounds that were filled
+// with fillColor by the corresponding pixels of the texture image.
+func applyTexture(im *image.RGBA, bounds image.Rectangle, fillColor color.RGBA, texture string) {
+	log.Println("texture:", texture)
+	if len(texture) == 0 {
+		return
+	}
+	log.Println("Applying texture", texture)
+	// load the image of the texture and apply it
+	imFile, err := os.Open(texture)
+	if err != nil {
+		log.Printf("Error! %v", err.Error())
+		return
+	}
+	defer imFile.Close()
+	textIm, _, err := image.Decode(imFile)
+	if err != nil {
+		log.Printf("Error! %v", err.Error())
+		return
+	}
+	for i := bounds.Min.X; i <= bounds.Max.X; i++ {
+		for j := bounds.Min.Y; j <= bounds.Max.Y; j++ {
+			if im.At(i, j) == fillColor {
+				r, g, b, a := textIm.At(i, j).RGBA()
+				im.Set(i, j, color.RGBA{uint8(r), uint8(g), uint8(b), uint8(a) - 20})
+			}
+		}
+	}
 }
 
 func saveToPngFile(filePath string, m image.Image) {
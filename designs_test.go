@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+)
+
+func TestEditDesignLeavesExistingAlone(t *testing.T) {
+	existing := models.Design{Name: "Ada", Revision: 3}
+	existing.Front.Outercurve = geometry.BSpline{{0, 0}, {10, 0}, {10, 10}, {0, 10}}
+	existing.Front.Lens = geometry.BSpline{{2, 2}, {8, 2}, {8, 8}, {2, 8}}
+	existing.Temple.Contour = geometry.BSpline{{0, 0}, {100, 0}, {140, 20}}
+	existing.Attributes = models.Attributes{"shape": {"round"}}
+	existing.Review = &models.Review{State: models.REVIEW_CHANGES_REQUESTED, Revision: 2}
+	before := models.Design{Name: "Ada", Revision: 3}
+	before.Front.Outercurve = geometry.BSpline{{0, 0}, {10, 0}, {10, 10}, {0, 10}}
+	before.Front.Lens = geometry.BSpline{{2, 2}, {8, 2}, {8, 8}, {2, 8}}
+	before.Temple.Contour = geometry.BSpline{{0, 0}, {100, 0}, {140, 20}}
+	before.Attributes = models.Attributes{"shape": {"round"}}
+	before.Review = &models.Review{State: models.REVIEW_CHANGES_REQUESTED, Revision: 2}
+
+	data := []byte(`{"front": {"outer_curve": [[1, 1], [11, 1], [11, 11], [1, 11]], "lens": [[3, 3], [7, 3], [7, 7]]},
+		"temple": {"contour": [[5, 5], [105, 5], [145, 25]]}, "attributes": {"shape": ["square"]},
+		"review": {"state": "approved"}}`)
+	des, err := editDesign(existing, data, nil, true)
+	if err != nil {
+		t.Fatalf("editDesign: %v", err)
+	}
+	if !reflect.DeepEqual(existing, before) {
+		t.Errorf("partial edit changed the existing design to %+v", existing)
+	}
+	if des.Name != "Ada" || des.Front.Outercurve[0] != (geometry.Point{1, 1}) || len(des.Front.Lens) != 3 ||
+		des.Temple.Contour[2] != (geometry.Point{145, 25}) || des.Attributes["shape"][0] != "square" {
+		t.Errorf("partial edit wasn't applied: %+v", des)
+	}
+}
+
+func TestEditDesignInUnits(t *testing.T) {
+	existing := models.Design{Name: "Ada"}
+	existing.Temple.TempleHeight = 500
+	des, err := editDesign(existing, []byte(`{"temple": {"temple_separation": 5.5}}`), &models.UNIT_MM, true)
+	if err != nil {
+		t.Fatalf("editDesign: %v", err)
+	}
+	if des.Temple.TempleSeparation != 550 || des.Temple.TempleHeight != 500 {
+		t.Errorf("temple = %+v, want separation 550 and height 500", des.Temple)
+	}
+	des, err = editDesign(existing, []byte(`{"name": "Grace"}`), nil, false)
+	if err != nil || des.Name != "Grace" || des.Temple.TempleHeight != 0 {
+		t.Errorf("replacing the design gave %+v, %v", des, err)
+	}
+}
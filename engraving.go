@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+
+	"code.google.com/p/draw2d/draw2d"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+)
+
+// minEngravingFloor is the material that has to be left under the deepest
+// point of an engraving, in millimetres.
+const minEngravingFloor = 1.0
+
+// engravingDepth is the depth of an engraving in millimetres.
+func engravingDepth(eng models.Engraving) float64 {
+	return eng.Depth.Millimetres()
+}
+
+// grooveWidth is how wide the V-shaped groove cut by the engraving tool is
+// at the surface, in millimetres.
+func grooveWidth(eng models.Engraving) float64 {
+	return 2 * engravingDepth(eng) * math.Tan(float64(eng.Angle)*math.Pi/360)
+}
+
+// engravingClosed is true for engraving paths that outline a shape to be
+// carved out, rather than a line to be cut along.
+func engravingClosed(path geometry.BSpline) bool {
+	return len(path) > 2 && distance(path[0], path[len(path)-1]) < closeTolerance
+}
+
+// engravingPolyline is an engraving path as a polyline.
+func engravingPolyline(path geometry.BSpline) []geometry.Point {
+	return polyline(path, engravingClosed(path))
+}
+
+// placeEngraving moves an engraving with a transform that keeps straight
+// lines straight, such as those from templeSheet.
+func placeEngraving(eng models.Engraving, transform func(geometry.Point) geometry.Point) models.Engraving {
+	placed := eng
+	placed.Paths = make([]geometry.BSpline, len(eng.Paths))
+	for i, path := range eng.Paths {
+		placed.Paths[i] = make(geometry.BSpline, len(path))
+		for j, pt := range path {
+			placed.Paths[i][j] = transform(pt)
+		}
+	}
+	return placed
+}
+
+// checkEngraving makes sure an engraving can be cut with a tool in the
+// library and stays on its part, clear of any openings.
+func checkEngraving(dc *designCheck, eng models.Engraving, part string, boundary []geometry.Point, openings [][]geometry.Point) {
+	if len(eng.Paths) == 0 {
+		return
+	}
+	if eng.Depth <= 0 {
+		dc.add("engraving", models.FINDING_ERROR, part, nil, "engraving depth must be more than zero")
+		return
+	}
+	if _, err := findTool(opEngrave, math.Inf(1), float64(eng.Angle)); err != nil {
+		dc.add("engraving", models.FINDING_ERROR, part, nil, "%v", err)
+		return
+	}
+	halfWidth := grooveWidth(eng) / 2
+	for _, path := range eng.Paths {
+		pts := engravingPolyline(path)
+		if len(pts) == 0 {
+			continue
+		}
+		off := false
+		for _, pt := range pts {
+			if !insidePolygon(pt, boundary) {
+				dc.add("engraving", models.FINDING_ERROR, part, &pt, "engraving runs off the edge")
+				off = true
+				break
+			}
+		}
+		if d, at := closestApproach(pts, boundary); !off && d < halfWidth {
+			dc.add("engraving", models.FINDING_ERROR, part, &at,
+				"engraving groove is %.2fmm wide but only %.2fmm from the edge", 2*halfWidth, d)
+		}
+		for _, opening := range openings {
+			if d, at := closestApproach(pts, opening); d < halfWidth || insidePolygon(pts[0], opening) {
+				dc.add("engraving", models.FINDING_ERROR, part, &at, "engraving runs into an opening")
+				break
+			}
+		}
+	}
+}
+
+// checkEngravingMaterials makes sure the engravings leave enough material
+// under them in the thinnest acceptable material of each part.
+func checkEngravingMaterials(des models.Design) []models.Finding {
+	dc := &designCheck{findings: []models.Finding{}}
+	parts := []struct {
+		name      string
+		engraving models.Engraving
+		materials []string
+	}{
+		{"front.engraving", des.Front.Engraving, nil},
+		{"temple.engraving", des.Temple.Engraving, nil},
+	}
+	for _, id := range des.Front.Materials {
+		parts[0].materials = append(parts[0].materials, id.Hex())
+	}
+	for _, id := range des.Temple.Materials {
+		parts[1].materials = append(parts[1].materials, id.Hex())
+	}
+	if des.Temple.Right != nil {
+		parts = append(parts, parts[1])
+		parts[2].name, parts[2].engraving = "temple.right.engraving", des.Temple.Right.Engraving
+	}
+	for _, p := range parts {
+		if len(p.engraving.Paths) == 0 {
+			continue
+		}
+		for _, id := range p.materials {
+			m, err := models.FindMaterialById(id)
+			if err != nil {
+				continue
+			}
+			thickness := float64(m.TopThickness + m.BottomThickness)
+			if engravingDepth(p.engraving) > thickness-minEngravingFloor {
+				dc.add("engraving", models.FINDING_ERROR, p.name, nil,
+					"engraving is %.2fmm deep, %v is %.2fmm thick and needs %.2fmm left under the engraving",
+					engravingDepth(p.engraving), m.Name, thickness, minEngravingFloor)
+			}
+		}
+	}
+	return dc.findings
+}
+
+// drawEngraving shades the engraving on a render as a groove, darker than
+// the material with a highlight along one side.  Points are placed with
+// the same transform as drawFront.
+func drawEngraving(gc draw2d.GraphicContext, eng models.Engraving, ppmm, cx, top, miny float64, base color.RGBA) {
+	if len(eng.Paths) == 0 {
+		return
+	}
+	shade := func(f float64) color.RGBA {
+		return color.RGBA{uint8(float64(base.R) * f), uint8(float64(base.G) * f), uint8(float64(base.B) * f), 255}
+	}
+	highlight := color.RGBA{uint8(128 + base.R/2), uint8(128 + base.G/2), uint8(128 + base.B/2), 255}
+	width := math.Max(grooveWidth(eng)*ppmm, 1)
+
+	stroke := func(c color.RGBA, w, dy float64) {
+		gc.SetStrokeColor(c)
+		gc.SetLineWidth(w)
+		gc.SetLineCap(draw2d.RoundCap)
+		for _, path := range eng.Paths {
+			pts := engravingPolyline(path)
+			for i, pt := range pts {
+				x, y := pt[0]*ppmm+cx, pt[1]*ppmm-miny+top+dy
+				if i == 0 {
+					gc.MoveTo(x, y)
+				} else {
+					gc.LineTo(x, y)
+				}
+			}
+			gc.Stroke()
+		}
+	}
+	stroke(shade(0.5), width, 0)
+	stroke(highlight, width/4, width/4)
+	stroke(shade(0.3), width/4, -width/8)
+}
+
+// engravingOperations plans cutting an engraving with a V-bit.  Lines are
+// cut along their centre at the engraving depth.  Closed shapes are
+// V-carved from the outline inward: the tool goes deeper the further it is
+// from the edge so that the sides of the cutter trace the outline, down to
+// the engraving depth, and any floor left wider than that is cleared at
+// full depth.  transform places the design points on the blank.
+func engravingOperations(eng models.Engraving, thickness float64, transform func(geometry.Point) geometry.Point) (ops []camOperation, err error) {
+	if len(eng.Paths) == 0 {
+		return
+	}
+	depth := engravingDepth(eng)
+	if depth > thickness-minEngravingFloor {
+		return nil, fmt.Errorf("engraving %.2fmm deep is too deep for %.2fmm material", depth, thickness)
+	}
+	tool, err := findTool(opEngrave, math.Inf(1), float64(eng.Angle))
+	if err != nil {
+		return nil, err
+	}
+	tanHalf := math.Tan(float64(eng.Angle) * math.Pi / 360)
+
+	lines := camOperation{Name: "engraving", Op: opEngrave, Tool: tool, Depths: passDepths(depth, tool.StepDown)}
+	var carves []camOperation
+	for _, path := range eng.Paths {
+		pts := engravingPolyline(path)
+		for i := range pts {
+			pts[i] = transform(pts[i])
+		}
+		if !engravingClosed(path) {
+			lines.Contours = append(lines.Contours, pts)
+			continue
+		}
+
+		area := signedArea(openContour(pts))
+		step := math.Max(tool.StepDown*tanHalf, 0.05)
+		for r, level := step, 0; level < 200; level++ {
+			inset := offsetContour(pts, -r)
+			if a := signedArea(inset); a*area <= 0 || math.Abs(a) < 0.01 {
+				break
+			}
+			z := math.Min(r/tanHalf, depth)
+			if level >= len(carves) {
+				carves = append(carves, camOperation{Name: "v-carving", Op: opEngrave, Tool: tool,
+					Depths: []float64{-z}, Closed: true})
+			}
+			carves[level].Contours = append(carves[level].Contours, inset)
+			if z < depth {
+				r += step
+			} else {
+				r += math.Max(grooveWidth(eng)*0.8, step)
+			}
+		}
+	}
+	if len(lines.Contours) > 0 {
+		ops = append(ops, lines)
+	}
+	return append(ops, carves...), nil
+}
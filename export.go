@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+)
+
+// Layout of exported drawings, in millimetres
+const (
+	exportMargin    = 10.0
+	exportTempleGap = 10.0 // Between the front and the temples, and between temples
+)
+
+// vectorPath is one path of an exported drawing.
+type vectorPath struct {
+	closed bool
+	curves []cubic
+}
+
+// vectorLayer is a named layer of an exported drawing. CAM software uses
+// the layers to pick the operation for each path.
+type vectorLayer struct {
+	name  string
+	color int // AutoCAD color index, for DXF
+	paths []vectorPath
+}
+
+// splineCubics converts a b-spline into bezier sections.
+func splineCubics(s geometry.BSpline, closed bool) []cubic {
+	if len(s) == 0 {
+		return nil
+	}
+	bzs := s.ConvertToBeziers(closed, !closed)
+	curves := make([]cubic, len(bzs))
+	for i, bez := range bzs {
+		for j := range curves[i] {
+			curves[i][j] = bez[j]
+		}
+	}
+	return curves
+}
+
+// transformCubics moves bezier sections with a transform that keeps
+// straight lines straight, such as those from templeSheet.
+func transformCubics(curves []cubic, transform func(geometry.Point) geometry.Point) []cubic {
+	moved := make([]cubic, len(curves))
+	for i, c := range curves {
+		for j, pt := range c {
+			moved[i][j] = transform(pt)
+		}
+	}
+	return moved
+}
+
+// reverseCubics reverses the direction of a path.
+func reverseCubics(curves []cubic) []cubic {
+	reversed := make([]cubic, len(curves))
+	for i, c := range curves {
+		reversed[len(curves)-1-i] = cubic{c[3], c[2], c[1], c[0]}
+	}
+	return reversed
+}
+
+// templeSheet places a pair of temples flat for cutting, centred on x = 0.
+// The left temple is as drawn with its top at top, and the right temple is
+// flipped and placed below it.
+func templeSheet(temple models.Temple, top float64) (toLeft, toRight func(geometry.Point) geometry.Point) {
+	lmin, lmax := boundsOf(polyline(temple.Contour, false))
+	rmin, rmax := boundsOf(polyline(templeRight(temple).Contour, false))
+	toLeft = func(pt geometry.Point) geometry.Point {
+		return geometry.Point{pt[0] - lmin[0] - (lmax[0]-lmin[0])/2, pt[1] - lmin[1] + top}
+	}
+	toRight = func(pt geometry.Point) geometry.Point {
+		return geometry.Point{-(pt[0] - rmin[0] - (rmax[0]-rmin[0])/2), pt[1] - rmin[1] + lmax[1] - lmin[1] + top + exportTempleGap}
+	}
+	return
+}
+
+// placedTemple is one temple of a pair and where templeSheet places it.
+type placedTemple struct {
+	models.TempleSide
+	place func(geometry.Point) geometry.Point
+}
+
+// templePair is both temples as placed by templeSheet, left first.
+func templePair(temple models.Temple, top float64) []placedTemple {
+	toLeft, toRight := templeSheet(temple, top)
+	return []placedTemple{{temple.TempleSide, toLeft}, {templeRight(temple), toRight}}
+}
+
+// exportLayers lays out a front and a pair of temples for cutting, at true
+// scale. Unless a design is asymmetric it only describes the left side, so
+// the front, lenses and holes are mirrored to make the right side.
+// Engraving is exported as drawn. The temples are laid out flat below the
+// front, the right one flipped, with their text set along them.
+func exportLayers(front models.Front, temple models.Temple, text templeText) ([]vectorLayer, error) {
+	frontLayer := vectorLayer{name: "front", color: 7}
+	lenses := vectorLayer{name: "lenses", color: 1}
+	holes := vectorLayer{name: "holes", color: 3}
+	engraving := vectorLayer{name: "engraving", color: 5}
+	temples := vectorLayer{name: "temples", color: 4}
+	templeEngraving := vectorLayer{name: "temple_engraving", color: 6}
+	templeTextLayer := vectorLayer{name: "temple_text", color: 2}
+
+	rightSide := frontRight(front)
+	leftOuter, rightOuter := splineCubics(front.Outercurve, false), splineCubics(rightSide.Outercurve, false)
+	if len(leftOuter) > 0 && len(rightOuter) > 0 {
+		outline := append(leftOuter, reverseCubics(rightOuter)...)
+		frontLayer.paths = append(frontLayer.paths, vectorPath{true, outline})
+	}
+	for _, side := range []models.FrontSide{front.FrontSide, rightSide} {
+		if lens := splineCubics(side.Lens, true); len(lens) > 0 {
+			lenses.paths = append(lenses.paths, vectorPath{true, lens})
+		}
+		for _, hole := range side.Holes {
+			if curves := splineCubics(hole, true); len(curves) > 0 {
+				holes.paths = append(holes.paths, vectorPath{true, curves})
+			}
+		}
+	}
+	for _, path := range front.Engraving.Paths {
+		closed := engravingClosed(path)
+		if curves := splineCubics(path, closed); len(curves) > 0 {
+			engraving.paths = append(engraving.paths, vectorPath{closed, curves})
+		}
+	}
+
+	_, frontMax := boundsOf(frontOutline(front))
+	if contour := polyline(temple.Contour, false); len(contour) > 0 {
+		top := frontMax[1] + exportTempleGap
+		for _, t := range templePair(temple, top) {
+			if curves := splineCubics(t.Contour, false); len(curves) > 0 {
+				temples.paths = append(temples.paths, vectorPath{false, transformCubics(curves, t.place)})
+			}
+			for _, path := range t.Engraving.Paths {
+				closed := engravingClosed(path)
+				if curves := splineCubics(path, closed); len(curves) > 0 {
+					templeEngraving.paths = append(templeEngraving.paths,
+						vectorPath{closed, transformCubics(curves, t.place)})
+				}
+			}
+		}
+
+		toLeft, toRight := templeSheet(temple, top)
+		left, right, err := templeTextEngravings(temple, text, toLeft, toRight)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range append(left.Paths, right.Paths...) {
+			closed := engravingClosed(path)
+			if curves := splineCubics(path, closed); len(curves) > 0 {
+				templeTextLayer.paths = append(templeTextLayer.paths, vectorPath{closed, curves})
+			}
+		}
+	}
+
+	return []vectorLayer{frontLayer, lenses, holes, engraving, temples, templeEngraving, templeTextLayer}, nil
+}
+
+// layersBounds returns the extent of everything in the layers.
+func layersBounds(layers []vectorLayer) (min, max geometry.Point) {
+	var pts []geometry.Point
+	for _, l := range layers {
+		for _, p := range l.paths {
+			pts = append(pts, sampleCubics(p.curves)...)
+		}
+	}
+	if len(pts) == 0 {
+		return
+	}
+	return boundsOf(pts)
+}
+
+// writeSvg writes the layers as an SVG drawing in millimetres, each layer
+// a group so that it shows up as a layer in Illustrator.  Empty paths are
+// left out.
+func writeSvg(w io.Writer, layers []vectorLayer) {
+	min, max := layersBounds(layers)
+	min = geometry.Point{min[0] - exportMargin, min[1] - exportMargin}
+	width, height := max[0]-min[0]+exportMargin, max[1]-min[1]+exportMargin
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%.3fmm" height="%.3fmm" viewBox="%.3f %.3f %.3f %.3f">`+"\n",
+		width, height, min[0], min[1], width, height)
+	for _, l := range layers {
+		fmt.Fprintf(w, `<g id="%v" fill="none" stroke="black" stroke-width="0.1">`+"\n", l.name)
+		for _, p := range l.paths {
+			if len(p.curves) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, `<path d="M%.4f,%.4f`, p.curves[0][0][0], p.curves[0][0][1])
+			for _, c := range p.curves {
+				fmt.Fprintf(w, " C%.4f,%.4f %.4f,%.4f %.4f,%.4f", c[1][0], c[1][1], c[2][0], c[2][1], c[3][0], c[3][1])
+			}
+			if p.closed {
+				fmt.Fprint(w, " Z")
+			}
+			fmt.Fprint(w, "\"/>\n")
+		}
+		fmt.Fprint(w, "</g>\n")
+	}
+	fmt.Fprint(w, "</svg>\n")
+}
+
+// writeDxf writes the layers as an AutoCAD R12 DXF drawing in millimetres,
+// which every CAM package reads. Curves are written as polylines, and the
+// y axis is flipped since DXF y points up.  Empty paths are left out.
+func writeDxf(w io.Writer, layers []vectorLayer) {
+	pair := func(code int, value interface{}) {
+		fmt.Fprintf(w, "%d\n%v\n", code, value)
+	}
+	coord := func(v float64) string {
+		return fmt.Sprintf("%.4f", v)
+	}
+
+	pair(0, "SECTION")
+	pair(2, "HEADER")
+	pair(9, "$INSUNITS")
+	pair(70, 4) // Millimetres
+	pair(0, "ENDSEC")
+
+	pair(0, "SECTION")
+	pair(2, "TABLES")
+	pair(0, "TABLE")
+	pair(2, "LAYER")
+	pair(70, len(layers))
+	for _, l := range layers {
+		pair(0, "LAYER")
+		pair(2, l.name)
+		pair(70, 0)
+		pair(62, l.color)
+		pair(6, "CONTINUOUS")
+	}
+	pair(0, "ENDTAB")
+	pair(0, "ENDSEC")
+
+	pair(0, "SECTION")
+	pair(2, "ENTITIES")
+	for _, l := range layers {
+		for _, p := range l.paths {
+			pts := sampleCubics(p.curves)
+			if len(pts) == 0 {
+				continue
+			}
+			flags := 0
+			if p.closed {
+				flags = 1
+				if len(pts) > 1 && distance(pts[0], pts[len(pts)-1]) < 1e-6 {
+					pts = pts[:len(pts)-1]
+				}
+			}
+			pair(0, "POLYLINE")
+			pair(8, l.name)
+			pair(66, 1)
+			pair(70, flags)
+			pair(10, coord(0))
+			pair(20, coord(0))
+			pair(30, coord(0))
+			for _, pt := range pts {
+				pair(0, "VERTEX")
+				pair(8, l.name)
+				pair(10, coord(pt[0]))
+				pair(20, coord(-pt[1]))
+				pair(30, coord(0))
+			}
+			pair(0, "SEQEND")
+			pair(8, l.name)
+		}
+	}
+	pair(0, "ENDSEC")
+	pair(0, "EOF")
+}
+
+// respondWithExport writes the front and temples in the format asked for
+// in ?format=svg|dxf.
+func respondWithExport(ctx context.Context, name string, front models.Front, temple models.Temple, text templeText) error {
+	layers, err := exportLayers(front, temple, text)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	var out bytes.Buffer
+	rw := ctx.HttpResponseWriter()
+	format := ctx.QueryValue("format")
+	switch format {
+	case "", "svg":
+		format = "svg"
+		writeSvg(&out, layers)
+		rw.Header().Set("Content-Type", "image/svg+xml")
+	case "dxf":
+		writeDxf(&out, layers)
+		rw.Header().Set("Content-Type", "application/dxf")
+	default:
+		return goweb.API.RespondWithError(ctx, 400, "format must be svg or dxf")
+	}
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%v.%v\"", name, format))
+	return goweb.Respond.With(ctx, 200, out.Bytes())
+}
+
+// getDesignExport exports a design as drawn. Drafts can only be exported
+// by their designer and by system admins.
+func getDesignExport(ctx context.Context) error {
+	des, err := models.FindDesignById(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if des.StatusAt(time.Now()) == models.PUBLISH_DRAFT && !canEditDesign(des, ctx) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	text := templeText{Left: des.Temple.LeftText, Right: des.Temple.RightText}
+	return respondWithExport(ctx, "design-"+des.Id.Hex(), des.Front, des.Temple, text)
+}
+
+// getOrderExport exports the customized geometry of an order for cutting,
+// with the order's temple text.
+func getOrderExport(ctx context.Context) error {
+	order, geom, err := orderDesignGeometry(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, err.Error())
+	}
+	return respondWithExport(ctx, "order-"+order.Id.Hex(), geom.Front, geom.Temple, orderTempleText(order, geom.Temple))
+}
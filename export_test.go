@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+)
+
+func TestExportSkipsShortEngraving(t *testing.T) {
+	var front models.Front
+	front.Outercurve = geometry.BSpline{{0, -10}, {-30, -12}, {-60, 0}, {-30, 15}, {0, 10}}
+	front.Lens = geometry.BSpline{{-10, -5}, {-50, -5}, {-50, 10}, {-10, 10}}
+	front.Engraving.Paths = []geometry.BSpline{{{-20, 0}, {-25, 1}}}
+	var temple models.Temple
+	temple.Contour = geometry.BSpline{{0, 0}, {40, 2}, {100, 0}, {140, 20}}
+	temple.Engraving.Paths = []geometry.BSpline{{{10, 1}, {20, 1}}, {{30, 1}, {40, 1}, {50, 2}, {60, 1}}}
+
+	layers, err := exportLayers(front, temple, templeText{})
+	if err != nil {
+		t.Fatalf("exportLayers: %v", err)
+	}
+	for _, l := range layers {
+		for _, p := range l.paths {
+			if len(p.curves) == 0 {
+				t.Errorf("layer %v has an empty path", l.name)
+			}
+		}
+		if l.name == "temple_engraving" && len(l.paths) != 2 {
+			t.Errorf("temple engraving has %v paths, want the long path on each temple", len(l.paths))
+		}
+	}
+
+	layers = append(layers, vectorLayer{name: "empty", paths: []vectorPath{{closed: true}}})
+	var svg, dxf bytes.Buffer
+	writeSvg(&svg, layers)
+	writeDxf(&dxf, layers)
+	if n := strings.Count(svg.String(), "<path"); n != 7 {
+		t.Errorf("svg has %v paths, want 7", n)
+	}
+	if n := strings.Count(dxf.String(), "POLYLINE"); n != 7 {
+		t.Errorf("dxf has %v polylines, want 7", n)
+	}
+}
+
+func TestPolylineOfShortSplineIsACopy(t *testing.T) {
+	s := geometry.BSpline{{1, 2}, {3, 4}}
+	pts := polyline(s, false)
+	pts[0] = geometry.Point{9, 9}
+	if s[0] != (geometry.Point{1, 2}) {
+		t.Errorf("changing the polyline changed the spline to %v", s)
+	}
+}
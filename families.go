@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+)
+
+const (
+	defaultFamilyStep = 200 // Eye sizes of the default sizes are 2mm apart
+	familyBlend       = 3.0 // mm either side of the lens box that the height blends over
+)
+
+// familyTransform sizes a front by growing its lenses by scale while the
+// bridge and the end pieces with the hinges keep their shape.  Across the
+// lens box, x is scaled out from the nasal edge of the box, the bridge
+// between the lens boxes is left alone, and everything outside the lens
+// box is moved out by as much as the lens grew.  Heights are scaled about
+// the middle of the lens box, blending back to unscaled over familyBlend
+// millimetres either side of the box so that the bridge and the hinges stay
+// the same height.  The transform is continuous, so applying it to control
+// points keeps curves smooth.  Each side of an asymmetric front is sized
+// about its own lens.
+func familyTransform(front models.Front, scale float64) (func(geometry.Point) geometry.Point, error) {
+	left, err := lensTransform(front.Lens, scale)
+	if err != nil {
+		return nil, err
+	}
+	right, err := lensTransform(frontRight(front).Lens, scale)
+	if err != nil {
+		return nil, err
+	}
+	lmin, lmax := boundsOf(polyline(front.Lens, true))
+	leftPositive := lmin[0]+lmax[0] > 0
+	return func(pt geometry.Point) geometry.Point {
+		if (pt[0] > 0) == leftPositive {
+			return left(pt)
+		}
+		return right(pt)
+	}, nil
+}
+
+// lensTransform is familyTransform for the side of a front with the lens.
+func lensTransform(s geometry.BSpline, scale float64) (func(geometry.Point) geometry.Point, error) {
+	lens := polyline(s, true)
+	if len(lens) == 0 {
+		return nil, errors.New("design has no lens to size")
+	}
+	lmin, lmax := boundsOf(lens)
+	inner := math.Min(math.Abs(lmin[0]), math.Abs(lmax[0]))
+	outer := math.Max(math.Abs(lmin[0]), math.Abs(lmax[0]))
+	centreY := (lmin[1] + lmax[1]) / 2
+	grown := (outer - inner) * (scale - 1)
+
+	return func(pt geometry.Point) geometry.Point {
+		x := math.Abs(pt[0])
+		weight := 1.0
+		switch {
+		case x < inner:
+			weight = math.Max(0, 1-(inner-x)/familyBlend)
+		case x <= outer:
+			x = inner + (x-inner)*scale
+		default:
+			weight = math.Max(0, 1-(x-outer)/familyBlend)
+			x += grown
+		}
+		return geometry.Point{
+			math.Copysign(x, pt[0]),
+			centreY + (pt[1]-centreY)*(1+(scale-1)*weight),
+		}
+	}, nil
+}
+
+// sizeDesign makes a size of a design.  The temples are mounted on the end
+// pieces, so they move out with them, but their contour is not changed.
+// A parametric bridge is kept as it is.
+func sizeDesign(base models.Design, size models.FamilySize) (des models.Design, err error) {
+	transform, err := familyTransform(base.Front, size.Scale)
+	if err != nil {
+		return
+	}
+	des = base
+	des.Front.FrontSide = transformSide(base.Front.FrontSide, transform)
+	if base.Front.Right != nil {
+		right := transformSide(*base.Front.Right, transform)
+		des.Front.Right = &right
+	}
+	des.Front.Engraving.Paths = make([]geometry.BSpline, len(base.Front.Engraving.Paths))
+	for i, path := range base.Front.Engraving.Paths {
+		des.Front.Engraving.Paths[i] = transformSpline(path, transform)
+	}
+	hinge := templeHinge(base)
+	left, right := transform(hinge), transform(geometry.Point{-hinge[0], hinge[1]})
+	des.Temple.TempleSeparation = models.LengthOf(math.Abs(left[0]) + math.Abs(right[0]))
+	des.Temple.TempleHeight = models.LengthOf(left[1])
+	des.Family = &models.FamilyMember{Base: base.Id, FamilySize: size}
+	return
+}
+
+// createDesignFamily generates the sizes of a design from the sizes in the
+// request body, {"sizes": [{"size": "S", "eye_size": 4800}, ...]}, each with
+// an eye size or a scale.  Without sizes the family is small, medium and
+// large, with eye sizes ?step= 1/100 mm apart and the design as the medium.
+// One of the sizes must have the design's eye size, and is the design
+// itself.  Generating the family again updates the sizes it already has,
+// and leaves sizes that are no longer asked for as they are since orders
+// may be made in them.  Sizes that come out the same aren't saved again.
+// New sizes are drafts until they have been checked and published.
+func createDesignFamily(ctx context.Context) error {
+	if !requireAuth(models.USER_NORMAL, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	base, err := models.FindDesignById(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if !canEditDesign(base, ctx) {
+		return goweb.API.RespondWithError(ctx, 403, "Forbidden")
+	}
+	if base.Family != nil && base.Family.Base != base.Id {
+		return goweb.API.RespondWithError(ctx, 400, "design is a size of another design, size that design instead")
+	}
+
+	var request struct {
+		Sizes []models.FamilySize `json:"sizes"`
+	}
+	if data, err := ctx.RequestBody(); err == nil && len(data) > 0 {
+		if err := json.Unmarshal(data, &request); err != nil {
+			return goweb.API.RespondWithError(ctx, 400, err.Error())
+		}
+	}
+	eyeSize := frameMeasurements(base.Front, base.Temple).EyeSize
+	if len(request.Sizes) == 0 {
+		step := int64(defaultFamilyStep)
+		if v := ctx.QueryValue("step"); len(v) > 0 {
+			if step, err = strconv.ParseInt(v, 10, 16); err != nil || step <= 0 {
+				return goweb.API.RespondWithError(ctx, 400, "step must be a positive number of 1/100 mm")
+			}
+		}
+		request.Sizes = models.DefaultFamilySizes(eyeSize, models.Length(step))
+	}
+	sizes, err := models.ResolveFamilySizes(eyeSize, request.Sizes)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+
+	existing, err := models.GetFamilyDesigns(base.Id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	// Every size is made and checked before any is saved, so that a size
+	// that can't be made or changed leaves the family as it was
+	family := make([]models.Design, 0, len(sizes))
+	siblings := make([]*models.Design, 0, len(sizes))
+	changed := make([]bool, 0, len(sizes))
+	for _, size := range sizes {
+		des, err := sizeDesign(base, size)
+		if err != nil {
+			return goweb.API.RespondWithError(ctx, 400, err.Error())
+		}
+		var sibling *models.Design
+		for i := range existing {
+			if existing[i].Family.Name == size.Name {
+				sibling = &existing[i]
+			}
+		}
+		switch {
+		case size.Scale == 1:
+			des = base
+			des.Family = &models.FamilyMember{Base: base.Id, FamilySize: size}
+			sibling = &base
+		case sibling != nil:
+			// Keep what is particular to the sibling
+			des.Id, des.Name, des.Revision = sibling.Id, sibling.Name, sibling.Revision
+			des.Collections, des.Lifecycle, des.Review = sibling.Collections, sibling.Lifecycle, sibling.Review
+		default:
+			des.Id = ""
+			des.Name = base.Name + " " + size.Name
+			des.Revision = 0
+			des.Collections = nil
+			des.Lifecycle = models.Lifecycle{}
+			des.Review = nil
+		}
+		if err := checkDesign(&des); err != nil {
+			return goweb.API.RespondWithError(ctx, 400, "size "+size.Name+": "+err.Error())
+		}
+		if sibling != nil {
+			// A size that comes out the same keeps its revision
+			des.Updated = sibling.Updated
+			if reflect.DeepEqual(des, *sibling) {
+				family, siblings, changed = append(family, des), append(siblings, sibling), append(changed, false)
+				continue
+			}
+			if reviewLocked(*sibling, ctx) {
+				return goweb.API.RespondWithError(ctx, 409, reviewLockedError(*sibling))
+			}
+		}
+		des.Updated = time.Now()
+		family, siblings, changed = append(family, des), append(siblings, sibling), append(changed, true)
+	}
+	for i := range family {
+		var err error
+		if siblings[i] == nil {
+			err = models.InsertDesign(&family[i])
+		} else if changed[i] {
+			err = models.UpdateDesignRevision(*siblings[i], &family[i])
+		}
+		if err != nil {
+			return goweb.API.RespondWithError(ctx, 500, err.Error())
+		}
+	}
+	return writeInUnits(ctx, 201, family)
+}
+
+// getDesignFamily lists the sizes of the family a design is a member of,
+// smallest first.  Drafts are only listed for their designer and system
+// admins.
+func getDesignFamily(ctx context.Context) error {
+	des, err := models.FindDesignById(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if des.StatusAt(time.Now()) == models.PUBLISH_DRAFT && !canEditDesign(des, ctx) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	family := []models.Design{}
+	if des.Family == nil {
+		return goweb.API.WriteResponseObject(ctx, 200, family)
+	}
+	designs, err := models.GetFamilyDesigns(des.Family.Base)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	for _, d := range designs {
+		if d.StatusAt(time.Now()) != models.PUBLISH_DRAFT || canEditDesign(d, ctx) {
+			family = append(family, d)
+		}
+	}
+	return writeInUnits(ctx, 200, family)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Limits on how far a design can be customized to fit someone.
+const (
+	minFitScale      = 0.90
+	maxFitScale      = 1.10
+	maxDecentration  = 3.0 // mm each lens centre can be from the pupil
+	templeLengthStep = 5.0 // temples are made in 5mm steps
+	bridgeClearance  = 1.0 // mm of space either side of the nose
+)
+
+// fitRecommendation is how a design should be customized to fit a
+// customer, and how well it will fit. Lengths are in millimetres.
+type fitRecommendation struct {
+	DesignId           bson.ObjectId `json:"design_id"`
+	Name               string        `json:"name"`
+	Score              float64       `json:"score"`
+	Scale              float64       `json:"scale"`
+	YPosition          float64       `json:"y_position"`
+	TempleLength       float64       `json:"temple_length,omitempty"`
+	TempleLengthChange float64       `json:"temple_length_change"`
+	BridgeWidth        float64       `json:"bridge_width,omitempty"`
+	BridgeWidthChange  float64       `json:"bridge_width_change"`
+	Violations         []string      `json:"violations,omitempty"`
+}
+
+// noseYPosition is the vertical position that puts the middle of the
+// lenses at pupil height when the bridge of a design, scaled by scale,
+// rests on a nose at the customer's nose height.  It is 0 if the nose
+// height isn't known.
+func noseYPosition(des models.Design, scale float64, size models.SizeInfo) float64 {
+	if scale <= 0 {
+		scale = 1
+	}
+	// The design y axis points down, as in the renders, so the bridge is
+	// the lowest point of the outline on the centre line.
+	rest := heightBelow(frontOutline(des.Front), 0)
+	if size.NoseHeight <= 0 || math.IsInf(rest, 0) {
+		return 0
+	}
+	return size.NoseHeight.Millimetres() - scale*(rest-designDatum(des.Front)[1])
+}
+
+// fitDesign recommends the scale, vertical position, temple length and
+// bridge width of a design for someone, and scores the fit out of 100.
+//
+// The scale makes the frame as wide as the face, or failing that puts the
+// lens centres in front of the pupils. The vertical position puts the
+// middle of the lenses at pupil height given where the bridge rests on the
+// nose. Anything that can't be fixed within the limits on customization is
+// explained in the violations.
+func fitDesign(des models.Design, size models.SizeInfo) fitRecommendation {
+	fit := fitRecommendation{DesignId: des.Id, Name: des.Name, Scale: 1, Score: 100}
+	violation := func(penalty float64, format string, args ...interface{}) {
+		fit.Violations = append(fit.Violations, fmt.Sprintf(format, args...))
+		fit.Score -= penalty
+	}
+
+	lens := polyline(des.Front.Lens, true)
+	outline := frontOutline(des.Front)
+	if len(lens) == 0 || len(outline) == 0 {
+		fit.Score = 0
+		violation(0, "design has no front geometry")
+		return fit
+	}
+	right := polyline(frontRight(des.Front).Lens, true)
+	omin, omax := boundsOf(outline)
+	frameWidth := omax[0] - omin[0]
+	framePD := frameMeasurements(des.Front, des.Temple).FramePD.Millimetres() // Distance between the two lens centres
+	pd := size.PD.Millimetres()
+
+	switch {
+	case size.FaceWidth > 0:
+		fit.Scale = size.FaceWidth.Millimetres() / frameWidth
+	case pd > 0:
+		fit.Scale = pd / framePD
+	}
+	if fit.Scale < minFitScale || fit.Scale > maxFitScale {
+		want := fit.Scale
+		fit.Scale = math.Max(minFitScale, math.Min(maxFitScale, fit.Scale))
+		violation(25, "frame would need scaling by %.2f, limit is %.2f to %.2f", want, minFitScale, maxFitScale)
+	}
+	fit.Score -= 200 * math.Abs(fit.Scale-1)
+
+	// Lens centres should be in front of the pupils
+	if pd > 0 {
+		decentration := (fit.Scale*framePD - pd) / 2
+		if decentration < -maxDecentration {
+			violation(20, "PD of %.1fmm is too wide for lens centres %.1fmm apart", pd, fit.Scale*framePD)
+		} else if decentration > maxDecentration {
+			violation(20, "PD of %.1fmm is too narrow for lens centres %.1fmm apart", pd, fit.Scale*framePD)
+		}
+		fit.Score -= 2 * math.Abs(decentration)
+	}
+
+	// The bridge rests on the nose, so move the front until the middle of
+	// the lenses is at pupil height
+	fit.YPosition = noseYPosition(des, fit.Scale, size)
+
+	// Temples are made to the nearest step of the customer's temple length
+	contour := polyline(des.Temple.Contour, false)
+	if size.TempleLength > 0 && len(contour) > 0 {
+		tmin, tmax := boundsOf(contour)
+		fit.TempleLength = math.Floor(size.TempleLength.Millimetres()/templeLengthStep+0.5) * templeLengthStep
+		fit.TempleLengthChange = fit.TempleLength - (tmax[0] - tmin[0])
+		fit.Score -= math.Abs(fit.TempleLengthChange) / 2
+	}
+
+	// The bridge is cut to the nose with some clearance either side
+	if size.NoseRadius > 0 {
+		bridge, _ := closestApproach(lens, right)
+		fit.BridgeWidth = 2 * (size.NoseRadius.Millimetres() + bridgeClearance)
+		fit.BridgeWidthChange = fit.BridgeWidth - fit.Scale*bridge
+		if fit.BridgeWidth < minBridgeWidth {
+			violation(10, "bridge of %.1fmm is narrower than the %.1fmm minimum", fit.BridgeWidth, minBridgeWidth)
+		}
+		if fit.BridgeWidth > fit.Scale*bridge {
+			violation(10, "nose is wider than the %.1fmm between the lenses", fit.Scale*bridge)
+		}
+	}
+
+	fit.Score = math.Max(0, math.Floor(fit.Score+0.5))
+	return fit
+}
+
+// heightBelow is the lowest point (largest y) where a closed outline
+// crosses the vertical line x.
+func heightBelow(outline []geometry.Point, x float64) float64 {
+	y := math.Inf(-1)
+	for i := 0; i+1 < len(outline); i++ {
+		a, b := outline[i], outline[i+1]
+		if (a[0] <= x) == (b[0] <= x) {
+			continue
+		}
+		y = math.Max(y, a[1]+(x-a[0])*(b[1]-a[1])/(b[0]-a[0]))
+	}
+	return y
+}
+
+// byScore sorts fit recommendations best first.
+type byScore []fitRecommendation
+
+func (f byScore) Len() int           { return len(f) }
+func (f byScore) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f byScore) Less(i, j int) bool { return f[i].Score > f[j].Score }
+
+func readSizeInfo(ctx context.Context) (size models.SizeInfo, err error) {
+	data, err := ctx.RequestBody()
+	if err == nil {
+		err = json.Unmarshal(data, &size)
+	}
+	return
+}
+
+// fitDesignHandler recommends how to customize a design for the SizeInfo
+// in the request body.  Drafts are only fitted for their designer and
+// system admins.
+func fitDesignHandler(ctx context.Context) error {
+	des, err := models.FindDesignById(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if des.StatusAt(time.Now()) == models.PUBLISH_DRAFT && !canEditDesign(des, ctx) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	size, err := readSizeInfo(ctx)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, fitDesign(des, size))
+}
+
+// fitCollectionHandler scores how well every design in a collection fits
+// the SizeInfo in the request body, best fit first.
+func fitCollectionHandler(ctx context.Context) error {
+	coll, err := models.FindCollection(ctx.PathValue("id"))
+	at, preview := catalogueView(ctx)
+	if err != nil || (!preview && !coll.IsPublishedAt(at)) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	size, err := readSizeInfo(ctx)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	designs, err := models.GetCollectionDesigns(coll)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if !preview {
+		designs = models.FilterPublishedDesigns(designs, at)
+	}
+
+	fits := make([]fitRecommendation, len(designs))
+	for i, des := range designs {
+		fits[i] = fitDesign(des, size)
+	}
+	sort.Stable(byScore(fits))
+	return goweb.API.WriteResponseObject(ctx, 200, fits)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+)
+
+func fittingDesign() models.Design {
+	var des models.Design
+	des.Front.Outercurve = geometry.BSpline{{0, 8}, {-10, 10}, {-40, 30}, {-75, 20}, {-75, -20}, {-40, -25}, {-10, -20}, {0, -18}}
+	des.Front.Lens = geometry.BSpline{{-12, -15}, {-55, -15}, {-55, 15}, {-12, 15}}
+	des.Temple.Contour = geometry.BSpline{{0, 0}, {60, -5}, {120, 0}, {140, 20}}
+	return des
+}
+
+func TestHeightBelow(t *testing.T) {
+	square := []geometry.Point{{-10, -5}, {10, -5}, {10, 15}, {-10, 15}, {-10, -5}}
+	tests := []struct {
+		x, want float64
+	}{
+		{0, 15},
+		{5, 15},
+		{20, math.Inf(-1)},
+	}
+	for _, test := range tests {
+		if got := heightBelow(square, test.x); got != test.want {
+			t.Errorf("heightBelow(%v) = %v, want %v", test.x, got, test.want)
+		}
+	}
+}
+
+func TestNoseYPosition(t *testing.T) {
+	des := fittingDesign()
+	if y := noseYPosition(des, 1, models.SizeInfo{}); y != 0 {
+		t.Errorf("without a nose height the position is %v, want 0", y)
+	}
+	// Raising the nose raises the frame by as much, and the distance from
+	// the bridge to the lens middle grows with the scale
+	low := noseYPosition(des, 1, models.SizeInfo{NoseHeight: 1000})
+	high := noseYPosition(des, 1, models.SizeInfo{NoseHeight: 1500})
+	if math.Abs(high-low-5) > 1e-9 {
+		t.Errorf("5mm higher nose moved the frame %vmm", high-low)
+	}
+	rest := heightBelow(frontOutline(des.Front), 0) - designDatum(des.Front)[1]
+	double := noseYPosition(des, 2, models.SizeInfo{NoseHeight: 1000})
+	if math.Abs(low-double-rest) > 1e-9 {
+		t.Errorf("doubling the scale moved the frame %vmm, want %vmm", low-double, rest)
+	}
+}
+
+func TestFitDesign(t *testing.T) {
+	des := fittingDesign()
+	omin, omax := boundsOf(frontOutline(des.Front))
+	width := omax[0] - omin[0]
+	tests := []struct {
+		name         string
+		size         models.SizeInfo
+		scale        float64
+		templeLength float64
+		violations   int
+	}{
+		{"nothing known", models.SizeInfo{}, 1, 0, 0},
+		{"wider face", models.SizeInfo{FaceWidth: models.LengthOf(width * 1.05)}, 1.05, 0, 0},
+		{"face too wide", models.SizeInfo{FaceWidth: models.LengthOf(width * 1.3)}, maxFitScale, 0, 1},
+		{"temple length", models.SizeInfo{TempleLength: 14300}, 1, 145, 0},
+	}
+	for _, test := range tests {
+		fit := fitDesign(des, test.size)
+		if math.Abs(fit.Scale-test.scale) > 0.001 {
+			t.Errorf("%s: scale %v, want %v", test.name, fit.Scale, test.scale)
+		}
+		if fit.TempleLength != test.templeLength {
+			t.Errorf("%s: temple length %v, want %v", test.name, fit.TempleLength, test.templeLength)
+		}
+		if len(fit.Violations) != test.violations {
+			t.Errorf("%s: violations %v, want %d", test.name, fit.Violations, test.violations)
+		}
+		if fit.Score < 0 || fit.Score > 100 {
+			t.Errorf("%s: score %v out of range", test.name, fit.Score)
+		}
+	}
+	if fit := fitDesign(models.Design{}, models.SizeInfo{}); fit.Score != 0 || len(fit.Violations) != 1 {
+		t.Errorf("design without geometry scored %v with %v", fit.Score, fit.Violations)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Designs exported from the legacy design tool.  Coordinates are
+// pointers so that missing values can be told apart from zeros.
+type (
+	legacyPoint struct {
+		X *float64 `json:"x"`
+		Y *float64 `json:"y"`
+	}
+	legacyCurve struct {
+		Points []legacyPoint `json:"points"`
+	}
+	legacyDesign struct {
+		Id             json.RawMessage `json:"id"`
+		Name           string          `json:"name"`
+		Owner          string          `json:"owner"`
+		Collection     string          `json:"collection"`
+		Outercurve     *legacyCurve    `json:"outercurve"`
+		Eyehole        *legacyCurve    `json:"eyehole"`
+		Holes          []legacyCurve   `json:"holes"`
+		Templecurve    *legacyCurve    `json:"templecurve"`
+		Templelocation *legacyPoint    `json:"templelocation"`
+	}
+)
+
+// Outcomes of importing a legacy design
+const (
+	importCreated   = "created"
+	importValid     = "valid" // Would be created, but this is a dry run
+	importDuplicate = "duplicate"
+	importInvalid   = "invalid"
+)
+
+// fieldError is a problem with one field of an imported design.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// importResult is what happened to one design in an import.
+type importResult struct {
+	Index    int           `json:"index"`
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	DesignId bson.ObjectId `json:"design_id,omitempty"`
+	Errors   []fieldError  `json:"errors,omitempty"`
+}
+
+// legacyImport imports a batch of legacy designs for a designer.  Each
+// design is imported or rejected on its own, so one bad design doesn't
+// stop the rest.  Only system admins' imports are approved and added to
+// collections directly, and designers' imports are submitted for review
+// instead.
+type legacyImport struct {
+	designer string
+	admin    bool
+	dryRun   bool
+	seen     map[string]bool // Designs earlier in the batch
+	results  []importResult
+}
+
+func newLegacyImport(designer string, admin, dryRun bool) *legacyImport {
+	return &legacyImport{designer: designer, admin: admin, dryRun: dryRun, seen: make(map[string]bool)}
+}
+
+// importJson imports a single design object or an array of them.
+func (li *legacyImport) importJson(data []byte) error {
+	var raw []json.RawMessage
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+	} else {
+		raw = []json.RawMessage{data}
+	}
+	for _, r := range raw {
+		li.importOne(r)
+	}
+	return nil
+}
+
+func (li *legacyImport) importOne(data []byte) {
+	result := importResult{Index: len(li.results)}
+	defer func() { li.results = append(li.results, result) }()
+
+	var old legacyDesign
+	if err := json.Unmarshal(data, &old); err != nil {
+		result.Status = importInvalid
+		result.Errors = []fieldError{{"", err.Error()}}
+		return
+	}
+	result.Name = old.Name
+	design, errs := convertDesign(old)
+	design.Designer = li.designer
+	if len(errs) > 0 {
+		result.Status, result.Errors = importInvalid, errs
+		return
+	}
+
+	// Skip designs that were already imported, here or in an earlier batch
+	key := fmt.Sprintf("%d/%v", design.LegacyId, design.Name)
+	if design.LegacyId != 0 {
+		key = strconv.Itoa(design.LegacyId)
+	}
+	if li.seen[key] {
+		result.Status = importDuplicate
+		return
+	}
+	li.seen[key] = true
+	existing, err := models.FindLegacyDesign(design.LegacyId, design.Name)
+	if err == nil {
+		result.Status, result.DesignId = importDuplicate, existing.Id
+		return
+	} else if err != mgo.ErrNotFound {
+		result.Status = importInvalid
+		result.Errors = []fieldError{{"", err.Error()}}
+		return
+	}
+
+	analyzeDesign(&design)
+	if li.dryRun {
+		result.Status = importValid
+		return
+	}
+	if err = models.InsertDesign(&design); err != nil {
+		result.Status = importInvalid
+		result.Errors = []fieldError{{"", err.Error()}}
+		return
+	}
+	result.Status, result.DesignId = importCreated, design.Id
+
+	// Legacy designs name their collection rather than referencing it
+	if len(old.Collection) > 0 {
+		var coll models.Collection
+		if li.admin {
+			if coll, err = models.EnsureCollectionNamed(old.Collection); err == nil {
+				err = approveIntoCollections(&design, li.designer, []bson.ObjectId{coll.Id}, "imported")
+			}
+		} else if coll, err = models.FindCollectionByName(old.Collection); err == nil {
+			err = submitForReview(&design, li.designer, []bson.ObjectId{coll.Id}, "")
+		} else if err == mgo.ErrNotFound {
+			err = fmt.Errorf("no collection named %v", old.Collection)
+		}
+		if err != nil {
+			result.Errors = []fieldError{{"collection", err.Error()}}
+		}
+	}
+}
+
+// convertDesign converts a legacy design, reporting every missing or
+// invalid field rather than stopping at the first.
+func convertDesign(old legacyDesign) (design models.Design, errs []fieldError) {
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, fieldError{field, fmt.Sprintf(format, args...)})
+	}
+	curve := func(field string, c *legacyCurve, minPoints int) geometry.BSpline {
+		if c == nil {
+			fail(field, "missing")
+			return nil
+		}
+		if len(c.Points) < minPoints {
+			fail(field+".points", "has %d points, needs at least %d", len(c.Points), minPoints)
+		}
+		s := make(geometry.BSpline, len(c.Points))
+		for i, pt := range c.Points {
+			if pt.X == nil || pt.Y == nil {
+				fail(fmt.Sprintf("%v.points[%d]", field, i), "needs both x and y")
+				continue
+			}
+			s[i] = geometry.Point{*pt.X, *pt.Y}
+		}
+		return s
+	}
+
+	design.Name = old.Name
+	if len(old.Name) == 0 {
+		fail("name", "missing")
+	}
+	if len(old.Id) > 0 && string(old.Id) != "null" {
+		// Legacy ids were numbers, but some exports quote them
+		var id interface{}
+		json.Unmarshal(old.Id, &id)
+		switch v := id.(type) {
+		case float64:
+			design.LegacyId = int(v)
+		case string:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				fail("id", "%q is not a legacy design id", v)
+			}
+			design.LegacyId = n
+		default:
+			fail("id", "%s is not a legacy design id", old.Id)
+		}
+	}
+	design.Front.Outercurve = curve("outercurve", old.Outercurve, 4)
+	design.Front.Lens = curve("eyehole", old.Eyehole, 3)
+	for i := range old.Holes {
+		design.Front.Holes = append(design.Front.Holes, curve(fmt.Sprintf("holes[%d]", i), &old.Holes[i], 3))
+	}
+	design.Temple.Contour = curve("templecurve", old.Templecurve, 4)
+	if loc := old.Templelocation; loc == nil || loc.X == nil || loc.Y == nil {
+		fail("templelocation", "needs both x and y")
+	} else {
+		var err error
+		if design.Temple.TempleSeparation, err = models.CheckedLength(*loc.X); err != nil {
+			fail("templelocation.x", "%v", err)
+		}
+		if design.Temple.TempleHeight, err = models.CheckedLength(*loc.Y); err != nil {
+			fail("templelocation.y", "%v", err)
+		}
+	}
+	design.Updated = time.Now()
+	return
+}
+
+// importDesign imports legacy designs, one object or an array of them,
+// for the logged in designer.  With ?dryrun=true the designs are only
+// checked.  Designs that name a collection are added to it if the designer
+// is a system admin, and otherwise submitted for review for it.
+func importDesign(ctx context.Context) error {
+	log.Println("Importing design")
+	if !requireAuth(models.USER_NORMAL, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	user := ctx.Data()["user"].(models.User)
+
+	data, err := ctx.RequestBody()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	li := newLegacyImport(user.Id, requireAuth(models.USER_SYSTEM_ADMIN, ctx), ctx.QueryValue("dryrun") == "true")
+	if err = li.importJson(data); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+
+	status := 200
+	for _, r := range li.results {
+		if r.Status == importCreated {
+			status = 201
+			break
+		}
+		if r.Status == importInvalid {
+			status = 422
+		}
+	}
+	return goweb.API.WriteResponseObject(ctx, status, li.results)
+}
+
+// importDesignDirectory imports every .json file in a directory, for the
+// -import command line option.
+func importDesignDirectory(dir, designer string, dryRun bool) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	li := newLegacyImport(designer, true, dryRun)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		first := len(li.results)
+		if err = li.importJson(data); err != nil {
+			log.Printf("%v: %v", file, err)
+			continue
+		}
+		for _, r := range li.results[first:] {
+			log.Printf("%v: %v %q %v %v", file, r.Status, r.Name, r.DesignId.Hex(), r.Errors)
+		}
+	}
+	log.Printf("Imported %v designs from %v files", len(li.results), len(files))
+	return nil
+}
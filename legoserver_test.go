@@ -5,10 +5,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/stretchr/goweb"
 )
 
 func TestGetUser(t *testing.T) {
-	handler := http.HandlerFunc(handleUserReq)
+	mapRoutes()
+	handler := goweb.DefaultHttpHandler()
 	recorder := httptest.NewRecorder()
 	url := fmt.Sprintf("http://localhost:3000/user")
 	req, _ := http.NewRequest("GET", url, nil)
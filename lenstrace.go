@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+)
+
+// omaRadii is how many radii each lens shape is traced with, the usual
+// resolution of frame tracers.
+const omaRadii = 400
+
+// lensTrace is the shape of one lens as a lab's edger takes it: radii from
+// the centre of the lens box at equal angles, counter-clockwise as seen
+// from the front of the frame starting at 3 o'clock.  Side is the wearer's
+// eye, R or L.  Lengths are in millimetres and radii in 1/100 mm.
+type lensTrace struct {
+	Side  string  `json:"side"`
+	Radii []int   `json:"radii"`
+	HBox  float64 `json:"hbox"`
+	VBox  float64 `json:"vbox"`
+	FED   float64 `json:"fed"`
+	Circ  float64 `json:"circ"`
+}
+
+// lensJob is everything a lab needs to cut the lenses of an order.
+type lensJob struct {
+	Job    string      `json:"job"`
+	DBL    float64     `json:"dbl"`
+	Traces []lensTrace `json:"traces"` // Right then left
+}
+
+// rayDistance is how far along a ray from c in direction d it is to the
+// furthest point where it leaves a closed polygon.
+func rayDistance(c, d geometry.Point, polygon []geometry.Point) (dist float64, ok bool) {
+	for i := 0; i+1 < len(polygon); i++ {
+		a, b := polygon[i], polygon[i+1]
+		e := geometry.Point{b[0] - a[0], b[1] - a[1]}
+		denom := d[0]*e[1] - d[1]*e[0]
+		if denom == 0 {
+			continue
+		}
+		ac := geometry.Point{a[0] - c[0], a[1] - c[1]}
+		t := (ac[0]*e[1] - ac[1]*e[0]) / denom
+		s := (ac[0]*d[1] - ac[1]*d[0]) / denom
+		if t >= 0 && s >= 0 && s <= 1 && t > dist {
+			dist, ok = t, true
+		}
+	}
+	return
+}
+
+// traceLens measures the radii of a closed lens polyline about its box
+// centre.  Design y points down, so angles are turned the other way.
+func traceLens(side string, lens []geometry.Point) (trace lensTrace, err error) {
+	min, max := boundsOf(lens)
+	centre := geometry.Point{(min[0] + max[0]) / 2, (min[1] + max[1]) / 2}
+	trace = lensTrace{Side: side, Radii: make([]int, omaRadii), HBox: max[0] - min[0], VBox: max[1] - min[1]}
+	for i := range trace.Radii {
+		angle := 2 * math.Pi * float64(i) / omaRadii
+		r, ok := rayDistance(centre, geometry.Point{math.Cos(angle), -math.Sin(angle)}, lens)
+		if !ok {
+			return trace, fmt.Errorf("lens can't be traced from the centre of its box at %.1f degrees", angle*180/math.Pi)
+		}
+		trace.Radii[i] = int(math.Floor(r*100 + 0.5))
+		trace.FED = math.Max(trace.FED, 2*r)
+	}
+	for i := 0; i+1 < len(lens); i++ {
+		trace.Circ += distance(lens[i], lens[i+1])
+	}
+	return
+}
+
+// frontLensJob traces both lenses of a front.  Seen from the front, the
+// wearer's right lens is on the left, at negative x.
+func frontLensJob(job string, front models.Front) (lj lensJob, err error) {
+	lens, other := polyline(front.Lens, true), polyline(frontRight(front).Lens, true)
+	if len(lens) == 0 || len(other) == 0 {
+		return lj, errors.New("design has no lens")
+	}
+	right, left := lens, other
+	if min, max := boundsOf(lens); min[0]+max[0] > 0 {
+		right, left = left, right
+	}
+	lj = lensJob{Job: job}
+	for _, side := range []struct {
+		name string
+		pts  []geometry.Point
+	}{{"R", right}, {"L", left}} {
+		trace, err := traceLens(side.name, side.pts)
+		if err != nil {
+			return lj, err
+		}
+		lj.Traces = append(lj.Traces, trace)
+	}
+	_, rmax := boundsOf(right)
+	lmin, _ := boundsOf(left)
+	lj.DBL = math.Max(lmin[0]-rmax[0], 0)
+	return
+}
+
+// writeOma writes a lens job as an OMA (VCA) data file, with the records
+// for both eyes separated by semicolons, right first.
+func writeOma(w io.Writer, lj lensJob) {
+	record := func(label, format string, args ...interface{}) {
+		fmt.Fprintf(w, "%v="+format+"\r\n", append([]interface{}{label}, args...)...)
+	}
+	both := func(label string, value func(lensTrace) float64) {
+		record(label, "%.2f;%.2f", value(lj.Traces[0]), value(lj.Traces[1]))
+	}
+	record("REQ", "FIL")
+	record("JOB", "%v", lj.Job)
+	record("DO", "B")
+	both("HBOX", func(t lensTrace) float64 { return t.HBox })
+	both("VBOX", func(t lensTrace) float64 { return t.VBox })
+	both("FED", func(t lensTrace) float64 { return t.FED })
+	both("CIRC", func(t lensTrace) float64 { return t.Circ })
+	record("DBL", "%.2f", lj.DBL)
+	for _, t := range lj.Traces {
+		record("TRCFMT", "1;%d;E;%v;F", len(t.Radii), t.Side)
+		for i := 0; i < len(t.Radii); i += 10 {
+			var line bytes.Buffer
+			for j := i; j < i+10 && j < len(t.Radii); j++ {
+				if j > i {
+					line.WriteByte(';')
+				}
+				fmt.Fprint(&line, t.Radii[j])
+			}
+			record("R", "%v", line.String())
+		}
+	}
+}
+
+// getOrderLensTrace returns the lens shapes of an order, scaled for the
+// order, as an OMA file to send to a lab or with ?format=json for attaching
+// to a lab order.  ?job= gives the lab's job number, which defaults to the
+// order id.
+func getOrderLensTrace(ctx context.Context) error {
+	if !requireAuth(models.USER_NORMAL, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	order, geom, err := orderDesignGeometry(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, err.Error())
+	}
+	if !isOwnerOrAdmin(order.UserId, ctx) {
+		return goweb.API.RespondWithError(ctx, 403, "Forbidden")
+	}
+	job := ctx.QueryValue("job")
+	if len(job) == 0 {
+		job = order.Id.Hex()
+	}
+	lj, err := frontLensJob(job, geom.Front)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+
+	switch ctx.QueryValue("format") {
+	case "", "oma":
+		var out bytes.Buffer
+		writeOma(&out, lj)
+		rw := ctx.HttpResponseWriter()
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"order-%v.oma\"", order.Id.Hex()))
+		return goweb.Respond.With(ctx, 200, out.Bytes())
+	case "json":
+		return goweb.API.WriteResponseObject(ctx, 200, lj)
+	}
+	return goweb.API.RespondWithError(ctx, 400, "format must be oma or json")
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"sync"
+
+	"code.google.com/p/draw2d/draw2d"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+)
+
+// Lookbook sheets are laid out for A4 landscape at 150dpi.  Each design is
+// drawn at a fixed scale so that the frames on a sheet can be compared.
+const (
+	lookbookWidth   = 1754
+	lookbookHeight  = 1240
+	lookbookMargin  = 60
+	lookbookHeader  = 80
+	lookbookColumns = 3
+	lookbookRows    = 3
+	lookbookPPMM    = 3.0 // Pixels per millimetre of frame
+	a4WidthPt       = 842
+	a4HeightPt      = 595
+)
+
+var (
+	lookbookBackground = color.RGBA{255, 255, 255, 255}
+	lookbookText       = color.RGBA{40, 40, 40, 255}
+)
+
+// lookbookLabels are the faces the labels of a lookbook are set in, the
+// bundled Go fonts at the sizes of the title, design names and their
+// dimensions.  Faces can't be shared between renders, so each render
+// makes its own.
+type lookbookLabels struct {
+	title, name, dims font.Face
+}
+
+var (
+	labelFonts     [2]*opentype.Font // Regular and bold
+	labelFontsErr  error
+	labelFontsOnce sync.Once
+)
+
+func newLookbookLabels() (labels lookbookLabels, err error) {
+	labelFontsOnce.Do(func() {
+		for i, data := range [][]byte{goregular.TTF, gobold.TTF} {
+			if labelFonts[i], labelFontsErr = opentype.Parse(data); labelFontsErr != nil {
+				return
+			}
+		}
+	})
+	if labelFontsErr != nil {
+		return labels, fmt.Errorf("lookbook font: %v", labelFontsErr)
+	}
+	face := func(f *opentype.Font, size float64) font.Face {
+		if err != nil {
+			return nil
+		}
+		var fc font.Face
+		fc, err = opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 92, Hinting: font.HintingFull})
+		return fc
+	}
+	labels = lookbookLabels{face(labelFonts[1], 24), face(labelFonts[1], 16), face(labelFonts[0], 11)}
+	return
+}
+
+// drawLabel sets text on an image with its baseline starting at x, y.
+func drawLabel(im *image.RGBA, face font.Face, text string, x, y float64) {
+	d := font.Drawer{Dst: im, Src: image.NewUniform(lookbookText), Face: face,
+		Dot: fixed.Point26_6{X: fixed.Int26_6(x * 64), Y: fixed.Int26_6(y * 64)}}
+	d.DrawString(text)
+}
+
+// defaultMaterial returns the first acceptable front material of a design,
+// falling back to black.
+func defaultMaterial(des models.Design, cache map[string]models.Material) (models.Material, error) {
+	materialId := defaultMaterialId
+	if len(des.Front.Materials) > 0 {
+		materialId = des.Front.Materials[0].Hex()
+	}
+	if mat, ok := cache[materialId]; ok {
+		return mat, nil
+	}
+	mat, err := models.FindMaterialById(materialId)
+	if err == nil {
+		cache[materialId] = mat
+	}
+	return mat, err
+}
+
+// renderLookbook draws the designs of a collection into a labelled grid.
+// With rowsPerPage > 0 the grid is split into pages of that many rows;
+// otherwise all of the designs go onto one tall sheet.
+func renderLookbook(coll models.Collection, designs []models.Design, rowsPerPage int) ([]*image.RGBA, error) {
+	rows := (len(designs) + lookbookColumns - 1) / lookbookColumns
+	if rows == 0 {
+		rows = 1
+	}
+	cellWidth := float64(lookbookWidth-2*lookbookMargin) / lookbookColumns
+	cellHeight := float64(lookbookHeight-2*lookbookMargin-lookbookHeader) / lookbookRows
+	if rowsPerPage <= 0 {
+		rowsPerPage = rows
+	}
+	pageCount := (rows + rowsPerPage - 1) / rowsPerPage
+	pageHeight := lookbookHeight
+	if pageCount == 1 && rows > lookbookRows {
+		pageHeight = 2*lookbookMargin + lookbookHeader + int(math.Ceil(cellHeight))*rows
+	}
+
+	labels, err := newLookbookLabels()
+	if err != nil {
+		return nil, err
+	}
+	materials := make(map[string]models.Material)
+	pages := make([]*image.RGBA, pageCount)
+	for p := range pages {
+		im := image.NewRGBA(image.Rect(0, 0, lookbookWidth, pageHeight))
+		draw.Draw(im, im.Bounds(), &image.Uniform{lookbookBackground}, image.ZP, draw.Src)
+		title := coll.Name
+		if pageCount > 1 {
+			title = fmt.Sprintf("%v  (%d/%d)", coll.Name, p+1, pageCount)
+		}
+		drawLabel(im, labels.title, title, lookbookMargin, lookbookMargin+30)
+
+		first := p * rowsPerPage * lookbookColumns
+		last := int(math.Min(float64(first+rowsPerPage*lookbookColumns), float64(len(designs))))
+		for i, des := range designs[first:last] {
+			left := lookbookMargin + float64(i%lookbookColumns)*cellWidth
+			top := lookbookMargin + lookbookHeader + float64(i/lookbookColumns)*cellHeight
+			if err := drawLookbookCell(im, des, materials, labels, left, top, cellWidth, cellHeight); err != nil {
+				return nil, err
+			}
+		}
+		pages[p] = im
+	}
+	return pages, nil
+}
+
+// drawLookbookCell draws one design in its default material with its name
+// and key dimensions underneath.
+func drawLookbookCell(im *image.RGBA, des models.Design, materials map[string]models.Material, labels lookbookLabels,
+	left, top, width, height float64) error {
+	material, err := defaultMaterial(des, materials)
+	if err != nil {
+		return err
+	}
+	dc := material.TopColor
+	fillColor := color.RGBA{uint8(dc[0]), uint8(dc[1]), uint8(dc[2]), uint8(dc[3])}
+
+	gc := draw2d.NewGraphicContext(im)
+	if len(des.Front.Outercurve) > 0 {
+		gc.SetFillColor(fillColor)
+		gc.SetStrokeColor(fillColor)
+		miny := drawFront(gc, des.Front, lookbookPPMM, left+width/2, top+20)
+		cell := image.Rect(int(left), int(top), int(left+width), int(top+height))
+		applyTexture(im, cell, fillColor, material.TopTexture)
+		drawEngraving(gc, des.Front.Engraving, lookbookPPMM, left+width/2, top+20, miny, fillColor)
+	}
+
+	dims := frameMeasurements(des.Front, des.Temple)
+	drawLabel(im, labels.name, des.Name, left+20, top+height-50)
+	drawLabel(im, labels.dims, fmt.Sprintf("Eye %.0f  Bridge %.0f  B %.0f  Width %.0f mm",
+		dims.EyeSize.Millimetres(), dims.Bridge.Millimetres(), dims.BMeasurement.Millimetres(), dims.TotalWidth.Millimetres()),
+		left+20, top+height-25)
+	return nil
+}
+
+// getCollectionLookbook renders a printable sheet of every design in a
+// collection, as a single PNG or as a multi-page PDF with ?format=pdf.
+func getCollectionLookbook(ctx context.Context) error {
+	coll, err := models.FindCollection(ctx.PathValue("id"))
+	at, preview := catalogueView(ctx)
+	if err != nil || (!preview && !coll.IsPublishedAt(at)) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	designs, err := models.GetCollectionDesigns(coll)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if !preview {
+		designs = models.FilterPublishedDesigns(designs, at)
+	}
+	log.Printf("Rendering lookbook of %v designs in %v", len(designs), coll.Slug)
+
+	format := ctx.QueryValue("format")
+	rowsPerPage := 0
+	if format == "pdf" {
+		rowsPerPage = lookbookRows
+	}
+	pages, err := renderLookbook(coll, designs, rowsPerPage)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+
+	var out bytes.Buffer
+	rw := ctx.HttpResponseWriter()
+	switch format {
+	case "pdf":
+		images := make([]image.Image, len(pages))
+		for i, p := range pages {
+			images[i] = p
+		}
+		err = writePdf(&out, images, a4WidthPt, a4HeightPt)
+		rw.Header().Set("Content-Type", "application/pdf")
+	case "", "png":
+		format = "png"
+		err = png.Encode(&out, pages[0])
+		rw.Header().Set("Content-Type", "image/png")
+	default:
+		return goweb.API.RespondWithError(ctx, 400, "format must be png or pdf")
+	}
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	rw.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"%v-lookbook.%v\"", coll.Slug, format))
+	return goweb.Respond.With(ctx, 200, out.Bytes())
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"testing"
+)
+
+func TestLookbookLabels(t *testing.T) {
+	labels, err := newLookbookLabels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, face := range map[string]interface{}{"title": labels.title, "name": labels.name, "dims": labels.dims} {
+		if face == nil {
+			t.Errorf("no %v face", name)
+		}
+	}
+	im := image.NewRGBA(image.Rect(0, 0, 300, 60))
+	draw.Draw(im, im.Bounds(), &image.Uniform{lookbookBackground}, image.ZP, draw.Src)
+	drawLabel(im, labels.title, "Summer 2026", 10, 40)
+	inked, outside := 0, 0
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 300; x++ {
+			if im.RGBAAt(x, y) == lookbookBackground {
+				continue
+			}
+			inked++
+			if x < 10 || y > 40+8 {
+				outside++
+			}
+		}
+	}
+	if inked < 100 {
+		t.Errorf("label inked %v pixels", inked)
+	}
+	if outside > 0 {
+		t.Errorf("%v pixels inked outside the label", outside)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/base64"
 	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
@@ -74,18 +75,48 @@ func mapRoutes() {
 		return nil
 	})
 
+	goweb.Map([]string{"GET", "PUT"}, "/collections/{id}/designs", collectionDesigns)
+	goweb.Map("GET", "/collections/{id}/lookbook", getCollectionLookbook)
+	goweb.Map("GET", "/fronts/{id}/temples", compatibleTemples)
+	goweb.Map("POST", "/collections/{id}/fit", fitCollectionHandler)
+	goweb.Map("GET", "/designs/search", searchDesigns)
+	goweb.Map("GET", "/designs/compare", compareDesigns)
+	goweb.Map("GET", "/reviews", getReviewQueue)
+	goweb.Map("GET", "/notifications", getNotifications)
+	goweb.Map("POST", "/notifications/{id}/read", readNotification)
+
 	// Map controllers
 	goweb.MapController("/accounts", &accountController{})
 	goweb.MapController("/users", &userController{})
 	goweb.MapController("/collections", &collectionsController{})
+	goweb.MapController("/attributes", &attributesController{})
 	goweb.MapController("/materials", &materialsController{})
 	goweb.MapController("/orders", &ordersController{})
-	//	goweb.MapController("/designs", &designController{})
+	goweb.MapController("/designs", &designController{})
+	goweb.MapController("/fronts", &frontsController{})
+	goweb.MapController("/temples", &templesController{})
 
 	goweb.Map("/accounts/{id}/users", accountUsers)
 	goweb.Map("/importdesign", importDesign)
+	goweb.Map("POST", "/importsvg", importSvgDesign)
 	goweb.Map("/designs/{id}/render", getDesignRender)
-	goweb.Map("/designs", getCollectionDesigns)
+	goweb.Map("GET", "/designs/{id}/export", getDesignExport)
+	goweb.Map("POST", "/designs/{id}/validate", validateDesignGeometry)
+	goweb.Map("POST", "/designs/{id}/parts", extractDesignParts)
+	goweb.Map("POST", "/designs/{id}/fit", fitDesignHandler)
+	goweb.Map("GET", "/designs/{id}/measurements", getDesignMeasurements)
+	goweb.Map("GET", "/designs/{id}/revisions", getDesignRevisions)
+	goweb.Map("POST", "/designs/{id}/family", createDesignFamily)
+	goweb.Map("GET", "/designs/{id}/family", getDesignFamily)
+	goweb.Map("POST", "/designs/{id}/submit", submitDesign)
+	goweb.Map("POST", "/designs/{id}/review", reviewDesign)
+	goweb.Map("GET", "/designs/{id}/review", getDesignReview)
+	goweb.Map("POST", "/compose", composeFrame)
+	goweb.Map("GET", "/orders/{id}/geometry", getOrderGeometry)
+	goweb.Map("GET", "/orders/{id}/render", getOrderRender)
+	goweb.Map("GET", "/orders/{id}/export", getOrderExport)
+	goweb.Map("GET", "/orders/{id}/gcode", getOrderGcode)
+	goweb.Map("GET", "/orders/{id}/oma", getOrderLensTrace)
 
 	// Map status code responses for testing
 	goweb.Map("/status-code/{code}", func(c context.Context) error {
@@ -132,17 +163,67 @@ func addRoute(route string, next http.HandlerFunc) {
 }
 
 func main() {
+	migrate := flag.Bool("migrate", false,
+		"bring existing designs up to date with the current data model and exit")
+	importDir := flag.String("import", "",
+		"import the legacy designs in the .json files in this directory and exit")
+	designer := flag.String("designer", "", "account user id to record as the designer of imported designs")
+	dryRun := flag.Bool("dryrun", false, "check the designs to -import without saving them")
+	flag.Parse()
+
 	session, err := mgo.Dial("localhost")
 	if err != nil {
 		panic(err)
 	}
 	defer session.Close()
 
+	if *migrate {
+		n, err := models.MigrateDesignCollections()
+		if err != nil {
+			log.Fatalf("Error migrating collections: %v", err)
+		}
+		log.Printf("Migrated collections of %v designs", n)
+		if n, err = models.MigratePublishingStatus(); err != nil {
+			log.Fatalf("Error migrating publishing status: %v", err)
+		}
+		log.Printf("Published %v existing designs", n)
+		if n, err = models.MigrateComposedDesigns(); err != nil {
+			log.Fatalf("Error migrating composed designs: %v", err)
+		}
+		log.Printf("Took %v composed designs out of the catalogue", n)
+		if n, err = models.MigrateDesignReviews(); err != nil {
+			log.Fatalf("Error migrating design reviews: %v", err)
+		}
+		log.Printf("Approved %v published designs", n)
+		if n, err = migrateMeasurements(); err != nil {
+			log.Fatalf("Error measuring designs: %v", err)
+		}
+		log.Printf("Measured %v designs", n)
+		return
+	}
+
+	if len(*importDir) > 0 {
+		if len(*designer) == 0 {
+			log.Fatal("-import needs the -designer of the designs")
+		}
+		if err := importDesignDirectory(*importDir, *designer, *dryRun); err != nil {
+			log.Fatalf("Error importing designs: %v", err)
+		}
+		return
+	}
+
 	port := os.Getenv("PORT")
 	if len(port) == 0 {
 		port = "3000"
 	}
 
+	// Tools loaded in the CNC machine, if not the defaults
+	if tools := os.Getenv("TOOL_LIBRARY"); len(tools) > 0 {
+		if err := loadToolLibrary(tools); err != nil {
+			log.Fatalf("Error loading tool library %v: %v", tools, err)
+		}
+	}
+
 	// Set up the API responder
 	mapRoutes()
 
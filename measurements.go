@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+)
+
+// frameMeasurements computes the boxing system measurements of a front
+// and temple.  The temple length is the straight length of the temple
+// contour.  Where the sides of an asymmetric frame differ, the eye size, B
+// measurement, effective diameter and temple length are of the larger
+// side, since that is what the lenses and the case have to fit.
+func frameMeasurements(front models.Front, temple models.Temple) (m models.Measurements) {
+	left, right := polyline(front.Lens, true), polyline(frontRight(front).Lens, true)
+	if len(left) > 0 && len(right) > 0 {
+		var centres []geometry.Point
+		for _, lens := range [][]geometry.Point{left, right} {
+			lmin, lmax := boundsOf(lens)
+			m.EyeSize = maxHundredths(m.EyeSize, lmax[0]-lmin[0])
+			m.BMeasurement = maxHundredths(m.BMeasurement, lmax[1]-lmin[1])
+
+			centre := geometry.Point{(lmin[0] + lmax[0]) / 2, (lmin[1] + lmax[1]) / 2}
+			radius := 0.0
+			for _, pt := range lens {
+				radius = math.Max(radius, distance(pt, centre))
+			}
+			m.EffectiveDiameter = maxHundredths(m.EffectiveDiameter, 2*radius)
+			centres = append(centres, centre)
+		}
+		lmin, lmax := boundsOf(left)
+		rmin, rmax := boundsOf(right)
+		m.Bridge = models.LengthOf(math.Max(lmin[0]-rmax[0], rmin[0]-lmax[0]))
+		m.FramePD = models.LengthOf(math.Abs(centres[0][0] - centres[1][0]))
+	}
+	if outline := frontOutline(front); len(outline) > 0 {
+		omin, omax := boundsOf(outline)
+		m.TotalWidth = models.LengthOf(omax[0] - omin[0])
+	}
+	for _, side := range []models.TempleSide{temple.TempleSide, templeRight(temple)} {
+		if contour := polyline(side.Contour, false); len(contour) > 0 {
+			tmin, tmax := boundsOf(contour)
+			m.TempleLength = maxHundredths(m.TempleLength, tmax[0]-tmin[0])
+		}
+	}
+	return
+}
+
+// maxHundredths is the larger of a measurement and a length in millimetres.
+func maxHundredths(m models.Length, mm float64) models.Length {
+	if h := models.LengthOf(mm); h > m {
+		return h
+	}
+	return m
+}
+
+// analyzeDesign checks and measures a design before it is saved.
+func analyzeDesign(des *models.Design) {
+	des.Findings = append(validateDesign(*des), checkEngravingMaterials(*des)...)
+	des.Measurements = frameMeasurements(des.Front, des.Temple)
+}
+
+// getDesignMeasurements returns the measurements of a design, or of the
+// design customized with ?scale= and ?ypos= as for an order.
+func getDesignMeasurements(ctx context.Context) error {
+	des, err := models.FindDesignById(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if des.StatusAt(time.Now()) == models.PUBLISH_DRAFT && !canEditDesign(des, ctx) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	scale, _ := strconv.ParseFloat(ctx.QueryValue("scale"), 64)
+	yPos, _ := strconv.ParseFloat(ctx.QueryValue("ypos"), 64)
+	geom, err := customizeDesign(des, scale, yPos, nil)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	return writeInUnits(ctx, 200, frameMeasurements(geom.Front, geom.Temple))
+}
+
+// migrateMeasurements measures every stored design, for -migrate.
+func migrateMeasurements() (n int, err error) {
+	designs, err := models.GetAllDesigns()
+	if err != nil {
+		return
+	}
+	for _, des := range designs {
+		des.Measurements = frameMeasurements(des.Front, des.Temple)
+		if err = models.UpdateDesign(&des); err != nil {
+			log.Printf("Error measuring design %v: %v", des.Id.Hex(), err)
+			return
+		}
+		n++
+	}
+	return
+}
@@ -0,0 +1,260 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Kinds of attribute that designs are described with
+const (
+	ATTRIBUTE_SHAPE      = "shape"      // round, cat-eye, aviator...
+	ATTRIBUTE_GENDER     = "gender"     // women, men, unisex
+	ATTRIBUTE_AGE_GROUP  = "age_group"  // adult, teen, child
+	ATTRIBUTE_FACE_WIDTH = "face_width" // narrow, medium, wide
+	ATTRIBUTE_STYLE      = "style"      // classic, vintage, sport...
+)
+
+// AttributeKinds lists the kinds of attribute in the order the configurator
+// shows them.
+var AttributeKinds = []string{ATTRIBUTE_SHAPE, ATTRIBUTE_GENDER, ATTRIBUTE_AGE_GROUP, ATTRIBUTE_FACE_WIDTH, ATTRIBUTE_STYLE}
+
+type (
+	// Attribute is one value of the controlled vocabulary that designs are
+	// described with for merchandising, e.g. "cat-eye" is a shape.  Face
+	// width attributes also give the range of face widths they suit, in
+	// 1/100 mm.  Designs reference attributes by slug within their kind.
+	// Attribute is a MongoDB collection.
+	Attribute struct {
+		Id           bson.ObjectId `bson:"_id" json:"id"`
+		Kind         string        `bson:"kind" json:"kind"`
+		Slug         string        `bson:"slug" json:"slug"`
+		Name         string        `bson:"name" json:"name"`
+		SortOrder    int           `bson:"sort_order" json:"sort_order"`
+		MinFaceWidth Length        `bson:"min_face_width,omitempty" json:"min_face_width,omitempty"`
+		MaxFaceWidth Length        `bson:"max_face_width,omitempty" json:"max_face_width,omitempty"`
+		Updated      time.Time     `bson:"updated" json:"updated"`
+	}
+
+	// Attributes are the attribute slugs of a design by kind, e.g.
+	// {"shape": ["round"], "gender": ["unisex"]}.
+	Attributes map[string][]string
+)
+
+// IsAttributeKind is true for the kinds in AttributeKinds.
+func IsAttributeKind(kind string) bool {
+	for _, k := range AttributeKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks an attribute before it is saved, filling in its slug
+// from its name if it has none.
+func (a *Attribute) Validate() error {
+	if !IsAttributeKind(a.Kind) {
+		return fmt.Errorf("attribute kind must be one of %v", AttributeKinds)
+	}
+	if len(a.Name) == 0 {
+		return errors.New("attribute name required")
+	}
+	if len(a.Slug) == 0 {
+		a.Slug = Slugify(a.Name)
+	}
+	if a.Slug != Slugify(a.Slug) {
+		return fmt.Errorf("attribute slug %q must be lower case letters, digits and dashes", a.Slug)
+	}
+	if a.Kind == ATTRIBUTE_FACE_WIDTH {
+		if a.MaxFaceWidth <= a.MinFaceWidth {
+			return errors.New("face width attributes need a max_face_width more than their min_face_width")
+		}
+	} else if a.MinFaceWidth != 0 || a.MaxFaceWidth != 0 {
+		return errors.New("only face width attributes have face widths")
+	}
+	return nil
+}
+
+// Has is true if the attributes include the slug of the kind.
+func (attrs Attributes) Has(kind, slug string) bool {
+	for _, s := range attrs[kind] {
+		if s == slug {
+			return true
+		}
+	}
+	return false
+}
+
+// Attribute objects
+func CreateAttribute(attr *Attribute) (err error) {
+	if err = attr.Validate(); err != nil {
+		return
+	}
+	if _, err = FindAttribute(attr.Kind, attr.Slug); err == nil {
+		return fmt.Errorf("%v attribute %v already exists", attr.Kind, attr.Slug)
+	}
+	attr.Id = bson.NewObjectId()
+	attr.Updated = time.Now()
+	log.Printf("Creating %v attribute %v", attr.Kind, attr.Slug)
+	withCollection("attributes", func(c *mgo.Collection) {
+		err = c.Insert(attr)
+	})
+	return
+}
+
+// FindAttribute looks up an attribute by its kind and slug.
+func FindAttribute(kind, slug string) (attr Attribute, err error) {
+	withCollection("attributes", func(c *mgo.Collection) {
+		err = c.Find(bson.M{"kind": kind, "slug": slug}).One(&attr)
+	})
+	return
+}
+
+func FindAttributeById(id string) (attr Attribute, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return attr, mgo.ErrNotFound
+	}
+	withCollection("attributes", func(c *mgo.Collection) {
+		err = c.FindId(bson.ObjectIdHex(id)).One(&attr)
+	})
+	return
+}
+
+// GetAttributes returns the vocabulary in display order, only of one kind
+// if kind isn't empty.
+func GetAttributes(kind string) (attrs []Attribute, err error) {
+	query := bson.M{}
+	if len(kind) > 0 {
+		query["kind"] = kind
+	}
+	withCollection("attributes", func(c *mgo.Collection) {
+		err = c.Find(query).All(&attrs)
+	})
+	sort.Sort(attributeOrder(attrs))
+	return
+}
+
+type attributeOrder []Attribute
+
+func (a attributeOrder) Len() int      { return len(a) }
+func (a attributeOrder) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a attributeOrder) Less(i, j int) bool {
+	ki, kj := kindIndex(a[i].Kind), kindIndex(a[j].Kind)
+	if ki != kj {
+		return ki < kj
+	}
+	if a[i].SortOrder != a[j].SortOrder {
+		return a[i].SortOrder < a[j].SortOrder
+	}
+	return a[i].Name < a[j].Name
+}
+
+func kindIndex(kind string) int {
+	for i, k := range AttributeKinds {
+		if k == kind {
+			return i
+		}
+	}
+	return len(AttributeKinds)
+}
+
+// UpdateAttribute saves an attribute.  If its slug changed, designs that
+// used the old slug are moved to the new one.
+func UpdateAttribute(attr *Attribute, oldSlug string) (err error) {
+	if err = attr.Validate(); err != nil {
+		return
+	}
+	if attr.Slug != oldSlug {
+		if _, err = FindAttribute(attr.Kind, attr.Slug); err == nil {
+			return fmt.Errorf("%v attribute %v already exists", attr.Kind, attr.Slug)
+		}
+		field := "attributes." + attr.Kind
+		withCollection("designs", func(c *mgo.Collection) {
+			_, err = c.UpdateAll(bson.M{field: oldSlug}, bson.M{"$set": bson.M{field + ".$": attr.Slug}})
+		})
+		if err != nil {
+			return
+		}
+	}
+	attr.Updated = time.Now()
+	withCollection("attributes", func(c *mgo.Collection) {
+		err = c.UpdateId(attr.Id, attr)
+	})
+	return
+}
+
+// DeleteAttribute removes an attribute from the vocabulary and from every
+// design described with it.
+func DeleteAttribute(attr Attribute) (err error) {
+	withCollection("attributes", func(c *mgo.Collection) {
+		err = c.RemoveId(attr.Id)
+	})
+	if err != nil {
+		return
+	}
+	withCollection("designs", func(c *mgo.Collection) {
+		_, err = c.UpdateAll(bson.M{"attributes." + attr.Kind: attr.Slug},
+			bson.M{"$pull": bson.M{"attributes." + attr.Kind: attr.Slug}})
+	})
+	return
+}
+
+// CheckAttributes makes sure every attribute of a design is in the
+// vocabulary.
+func CheckAttributes(attrs Attributes, vocabulary []Attribute) error {
+	known := make(map[string]bool, len(vocabulary))
+	for _, a := range vocabulary {
+		known[a.Kind+"/"+a.Slug] = true
+	}
+	for kind, slugs := range attrs {
+		if !IsAttributeKind(kind) {
+			return fmt.Errorf("unknown attribute kind %q", kind)
+		}
+		for _, slug := range slugs {
+			if !known[kind+"/"+slug] {
+				return fmt.Errorf("unknown %v attribute %q", kind, slug)
+			}
+		}
+	}
+	return nil
+}
+
+// FilterDesignsByAttributes returns the designs that have one of the
+// wanted attributes of each kind, preserving their order.
+func FilterDesignsByAttributes(designs []Design, wanted Attributes) []Design {
+	if len(wanted) == 0 {
+		return designs
+	}
+	found := make([]Design, 0, len(designs))
+designs:
+	for _, d := range designs {
+		for kind, slugs := range wanted {
+			match := false
+			for _, slug := range slugs {
+				match = match || d.Attributes.Has(kind, slug)
+			}
+			if !match {
+				continue designs
+			}
+		}
+		found = append(found, d)
+	}
+	return found
+}
+
+// FaceWidthAttributes returns the slugs of the face width attributes
+// whose range includes a face width in 1/100 mm.
+func FaceWidthAttributes(vocabulary []Attribute, width Length) (slugs []string) {
+	for _, a := range vocabulary {
+		if a.Kind == ATTRIBUTE_FACE_WIDTH && a.MinFaceWidth <= width && width < a.MaxFaceWidth {
+			slugs = append(slugs, a.Slug)
+		}
+	}
+	return
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAttributeValidate(t *testing.T) {
+	cases := []struct {
+		attr Attribute
+		ok   bool
+		slug string
+	}{
+		{Attribute{Kind: ATTRIBUTE_SHAPE, Name: "Cat Eye"}, true, "cat-eye"},
+		{Attribute{Kind: ATTRIBUTE_SHAPE, Name: "Round", Slug: "round"}, true, "round"},
+		{Attribute{Kind: ATTRIBUTE_SHAPE, Name: "Round", Slug: "Round"}, false, "Round"},
+		{Attribute{Kind: "colour", Name: "Red"}, false, ""},
+		{Attribute{Kind: ATTRIBUTE_GENDER}, false, ""},
+		{Attribute{Kind: ATTRIBUTE_FACE_WIDTH, Name: "Narrow", MaxFaceWidth: 13000}, true, "narrow"},
+		{Attribute{Kind: ATTRIBUTE_FACE_WIDTH, Name: "Wide", MinFaceWidth: 14000}, false, "wide"},
+		{Attribute{Kind: ATTRIBUTE_STYLE, Name: "Sport", MaxFaceWidth: 13000}, false, "sport"},
+	}
+	for i, c := range cases {
+		err := c.attr.Validate()
+		if (err == nil) != c.ok {
+			t.Errorf("case %v: Validate = %v, want ok %v", i, err, c.ok)
+		}
+		if c.ok && c.attr.Slug != c.slug {
+			t.Errorf("case %v: slug = %q, want %q", i, c.attr.Slug, c.slug)
+		}
+	}
+}
+
+func TestCheckAttributes(t *testing.T) {
+	vocabulary := []Attribute{
+		{Kind: ATTRIBUTE_SHAPE, Slug: "round"},
+		{Kind: ATTRIBUTE_GENDER, Slug: "unisex"},
+	}
+	cases := []struct {
+		attrs Attributes
+		ok    bool
+	}{
+		{nil, true},
+		{Attributes{ATTRIBUTE_SHAPE: {"round"}, ATTRIBUTE_GENDER: {"unisex"}}, true},
+		{Attributes{ATTRIBUTE_SHAPE: {"square"}}, false},
+		{Attributes{ATTRIBUTE_GENDER: {"round"}}, false},
+		{Attributes{"colour": {"round"}}, false},
+	}
+	for i, c := range cases {
+		if err := CheckAttributes(c.attrs, vocabulary); (err == nil) != c.ok {
+			t.Errorf("case %v: CheckAttributes = %v, want ok %v", i, err, c.ok)
+		}
+	}
+}
+
+func TestFilterDesignsByAttributes(t *testing.T) {
+	designs := []Design{
+		{Name: "a", Attributes: Attributes{ATTRIBUTE_SHAPE: {"round"}, ATTRIBUTE_GENDER: {"unisex"}}},
+		{Name: "b", Attributes: Attributes{ATTRIBUTE_SHAPE: {"cat-eye"}, ATTRIBUTE_GENDER: {"women"}}},
+		{Name: "c", Attributes: Attributes{ATTRIBUTE_SHAPE: {"round", "cat-eye"}}},
+		{Name: "d"},
+	}
+	names := func(ds []Design) (n []string) {
+		for _, d := range ds {
+			n = append(n, d.Name)
+		}
+		return
+	}
+	cases := []struct {
+		wanted Attributes
+		want   []string
+	}{
+		{nil, []string{"a", "b", "c", "d"}},
+		{Attributes{ATTRIBUTE_SHAPE: {"round"}}, []string{"a", "c"}},
+		{Attributes{ATTRIBUTE_SHAPE: {"round", "cat-eye"}}, []string{"a", "b", "c"}},
+		{Attributes{ATTRIBUTE_SHAPE: {"cat-eye"}, ATTRIBUTE_GENDER: {"women"}}, []string{"b"}},
+		{Attributes{ATTRIBUTE_STYLE: {"sport"}}, nil},
+	}
+	for i, c := range cases {
+		if got := names(FilterDesignsByAttributes(designs, c.wanted)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("case %v: got %v, want %v", i, got, c.want)
+		}
+	}
+}
+
+func TestFaceWidthAttributes(t *testing.T) {
+	vocabulary := []Attribute{
+		{Kind: ATTRIBUTE_FACE_WIDTH, Slug: "narrow", MinFaceWidth: 0, MaxFaceWidth: 13000},
+		{Kind: ATTRIBUTE_FACE_WIDTH, Slug: "medium", MinFaceWidth: 12800, MaxFaceWidth: 14000},
+		{Kind: ATTRIBUTE_SHAPE, Slug: "round"},
+	}
+	cases := []struct {
+		width Length
+		want  []string
+	}{
+		{12500, []string{"narrow"}},
+		{12900, []string{"narrow", "medium"}},
+		{13000, []string{"medium"}},
+		{15000, nil},
+	}
+	for i, c := range cases {
+		if got := FaceWidthAttributes(vocabulary, c.width); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("case %v: got %v, want %v", i, got, c.want)
+		}
+	}
+}
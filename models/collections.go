@@ -0,0 +1,255 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Types related to collections of designs
+type (
+	// Collection is a named, ordered group of designs that is sold together,
+	// for example the "Toronto Collection". The Designs array is the display
+	// order of the designs within the collection; each member design also
+	// references the collection in its own Collections array so that designs
+	// can be queried by collection.  Its Lifecycle controls when the
+	// collection is launched and retired.  Collection is a MongoDB collection.
+	Collection struct {
+		Id          bson.ObjectId `bson:"_id" json:"id"`
+		Slug        string        `bson:"slug" json:"slug"`
+		Name        string        `bson:"name" json:"name"`
+		Description string        `bson:"description,omitempty" json:"description,omitempty"`
+		HeroImage   string        `bson:"hero_image,omitempty" json:"hero_image,omitempty"`
+		SortOrder   int           `bson:"sort_order" json:"sort_order"`
+		Lifecycle   `bson:",inline"`
+		Designs     []bson.ObjectId `bson:"designs" json:"designs"`
+		Updated     time.Time       `bson:"updated" json:"updated"`
+	}
+)
+
+// Slugify turns a human-readable collection name into the url-safe
+// identifier used in place of the id, e.g. "Toronto Collection" becomes
+// "toronto-collection".
+func Slugify(name string) string {
+	var slug []rune
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			slug = append(slug, r)
+			dash = false
+		} else if !dash && len(slug) > 0 {
+			slug = append(slug, '-')
+			dash = true
+		}
+	}
+	return strings.TrimRight(string(slug), "-")
+}
+
+// CheckCollectionSlug gives a collection without a slug one made from its
+// name, and checks that no other collection has its slug.
+func CheckCollectionSlug(coll *Collection) error {
+	if len(coll.Slug) == 0 {
+		coll.Slug = Slugify(coll.Name)
+	}
+	if other, err := FindCollection(coll.Slug); err == nil && other.Id != coll.Id {
+		return errors.New("collection slug already exists")
+	}
+	return nil
+}
+
+// Collection objects
+func CreateCollection(coll *Collection) (err error) {
+	if len(coll.Name) == 0 {
+		return errors.New("collection name required")
+	}
+	if err = CheckCollectionSlug(coll); err != nil {
+		return
+	}
+	coll.Id = bson.NewObjectId()
+	coll.Updated = time.Now()
+	if coll.Designs == nil {
+		coll.Designs = []bson.ObjectId{}
+	}
+	log.Printf("Creating collection %v", coll.Slug)
+	withCollection("collections", func(c *mgo.Collection) {
+		err = c.Insert(coll)
+	})
+	return
+}
+
+// FindCollection looks up a collection by either its id or its slug.
+func FindCollection(idOrSlug string) (coll Collection, err error) {
+	withCollection("collections", func(c *mgo.Collection) {
+		if bson.IsObjectIdHex(idOrSlug) {
+			err = c.FindId(bson.ObjectIdHex(idOrSlug)).One(&coll)
+		} else {
+			err = c.Find(bson.M{"slug": idOrSlug}).One(&coll)
+		}
+	})
+	return
+}
+
+func FindCollectionByName(name string) (coll Collection, err error) {
+	withCollection("collections", func(c *mgo.Collection) {
+		err = c.Find(bson.M{"name": name}).One(&coll)
+	})
+	return
+}
+
+// GetAllCollections returns every collection, whatever its publishing
+// status, in display order.
+func GetAllCollections() (colls []Collection, err error) {
+	withCollection("collections", func(c *mgo.Collection) {
+		err = c.Find(nil).Sort("sort_order", "name").All(&colls)
+	})
+	return
+}
+
+// GetPublishedCollections returns the collections that are published at
+// time t in display order.
+func GetPublishedCollections(t time.Time) (colls []Collection, err error) {
+	withCollection("collections", func(c *mgo.Collection) {
+		err = c.Find(publishedQuery(t)).Sort("sort_order", "name").All(&colls)
+	})
+	return
+}
+
+func UpdateCollection(coll *Collection) (err error) {
+	coll.Updated = time.Now()
+	withCollection("collections", func(c *mgo.Collection) {
+		err = c.UpdateId(coll.Id, coll)
+	})
+	return
+}
+
+// DeleteCollection removes the collection and its reference from all
+// member designs.  The designs themselves are not deleted.
+func DeleteCollection(id bson.ObjectId) (err error) {
+	withCollection("collections", func(c *mgo.Collection) {
+		err = c.RemoveId(id)
+	})
+	if err != nil {
+		return
+	}
+	withCollection("designs", func(c *mgo.Collection) {
+		_, err = c.UpdateAll(bson.M{"collections": id}, bson.M{"$pull": bson.M{"collections": id}})
+	})
+	return
+}
+
+// SetCollectionDesigns replaces the ordered membership of a collection.
+// Designs that are no longer members lose their reference to the collection
+// and new members gain one.
+func SetCollectionDesigns(coll *Collection, designs []bson.ObjectId) (err error) {
+	withCollection("designs", func(c *mgo.Collection) {
+		_, err = c.UpdateAll(bson.M{"collections": coll.Id, "_id": bson.M{"$nin": designs}},
+			bson.M{"$pull": bson.M{"collections": coll.Id}})
+		if err != nil {
+			return
+		}
+		_, err = c.UpdateAll(bson.M{"_id": bson.M{"$in": designs}},
+			bson.M{"$addToSet": bson.M{"collections": coll.Id}})
+	})
+	if err != nil {
+		return
+	}
+	coll.Designs = designs
+	return UpdateCollection(coll)
+}
+
+// AddDesignToCollection appends a design to the end of the collection's
+// ordering if it is not already a member.
+func AddDesignToCollection(coll *Collection, design bson.ObjectId) error {
+	for _, id := range coll.Designs {
+		if id == design {
+			return nil
+		}
+	}
+	return SetCollectionDesigns(coll, append(coll.Designs, design))
+}
+
+// GetCollectionDesigns returns the member designs of a collection in
+// the collection's display order.
+func GetCollectionDesigns(coll Collection) (designs []Design, err error) {
+	var found []Design
+	withCollection("designs", func(c *mgo.Collection) {
+		err = c.Find(bson.M{"_id": bson.M{"$in": coll.Designs}}).All(&found)
+	})
+	if err != nil {
+		return
+	}
+	byId := make(map[bson.ObjectId]Design, len(found))
+	for _, d := range found {
+		byId[d.Id] = d
+	}
+	designs = make([]Design, 0, len(found))
+	for _, id := range coll.Designs {
+		if d, ok := byId[id]; ok {
+			designs = append(designs, d)
+		}
+	}
+	return
+}
+
+// EnsureCollectionNamed returns the collection with the given display name,
+// creating a draft collection if there isn't one yet.
+func EnsureCollectionNamed(name string) (coll Collection, err error) {
+	if coll, err = FindCollectionByName(name); err != mgo.ErrNotFound {
+		return
+	}
+	coll = Collection{Name: name}
+	err = CreateCollection(&coll)
+	return
+}
+
+// MigrateDesignCollections converts designs whose collections are still
+// stored as free-text names into references to Collection documents,
+// creating the collections as required.  Existing designs are appended to
+// their collections in the order they are found.  It returns the number of
+// designs converted.
+func MigrateDesignCollections() (migrated int, err error) {
+	var legacy []struct {
+		Id          bson.ObjectId `bson:"_id"`
+		Collections []interface{} `bson:"collections"`
+	}
+	withCollection("designs", func(c *mgo.Collection) {
+		err = c.Find(bson.M{"collections": bson.M{"$type": "string"}}).All(&legacy)
+	})
+	if err != nil {
+		return
+	}
+
+	for _, d := range legacy {
+		var refs []bson.ObjectId
+		for _, ci := range d.Collections {
+			switch cv := ci.(type) {
+			case bson.ObjectId:
+				refs = append(refs, cv)
+			case string:
+				coll, err := EnsureCollectionNamed(cv)
+				if err != nil {
+					return migrated, err
+				}
+				coll.Designs = append(coll.Designs, d.Id)
+				if err = UpdateCollection(&coll); err != nil {
+					return migrated, err
+				}
+				refs = append(refs, coll.Id)
+			}
+		}
+		withCollection("designs", func(c *mgo.Collection) {
+			err = c.UpdateId(d.Id, bson.M{"$set": bson.M{"collections": refs}})
+		})
+		if err != nil {
+			return
+		}
+		log.Printf("Migrated collections of design %v", d.Id.Hex())
+		migrated++
+	}
+	return
+}
@@ -0,0 +1,17 @@
+package models
+
+import "testing"
+
+func TestSlugify(t *testing.T) {
+	cases := map[string]string{
+		"Toronto Collection":  "toronto-collection",
+		"GUILD Everyday":      "guild-everyday",
+		"  Sun & Shade 2015 ": "sun-shade-2015",
+		"Experimental":        "experimental",
+	}
+	for name, want := range cases {
+		if got := Slugify(name); got != want {
+			t.Errorf("Slugify(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Limits on how far a size can be scaled from the design it is made from.
+const (
+	MinFamilyScale = 0.8
+	MaxFamilyScale = 1.25
+)
+
+type (
+	// FamilySize is one size of a family of designs.  It is given either by
+	// the eye size it has, in 1/100 mm, or by the scale of its lenses
+	// relative to the base design.
+	FamilySize struct {
+		Name    string  `bson:"size" json:"size"`
+		EyeSize Length  `bson:"eye_size,omitempty" json:"eye_size,omitempty"`
+		Scale   float64 `bson:"scale,omitempty" json:"scale,omitempty"`
+	}
+
+	// FamilyMember makes a design one size of a family of designs.  The
+	// sizes are generated from the Base design, which is a member of its
+	// own family, and are siblings of each other.
+	// This is not a MongoDB collection but rather an embedded document
+	// within a Design document.
+	FamilyMember struct {
+		Base       bson.ObjectId `bson:"base" json:"base"`
+		FamilySize `bson:",inline"`
+	}
+)
+
+// DefaultFamilySizes are small, medium and large sizes around a design,
+// with eye sizes step apart.  The design itself is the medium.
+func DefaultFamilySizes(eyeSize, step Length) []FamilySize {
+	return []FamilySize{
+		{Name: "S", EyeSize: eyeSize - step},
+		{Name: "M", EyeSize: eyeSize},
+		{Name: "L", EyeSize: eyeSize + step},
+	}
+}
+
+// ResolveFamilySizes works out both the eye size and the scale of sizes
+// of a design with the given eye size, smallest first.  One of the sizes
+// must be the design itself.
+func ResolveFamilySizes(eyeSize Length, sizes []FamilySize) ([]FamilySize, error) {
+	if eyeSize <= 0 {
+		return nil, errors.New("design has no eye size to size it from")
+	}
+	if len(sizes) == 0 {
+		return nil, errors.New("family needs at least one size")
+	}
+	resolved := make([]FamilySize, len(sizes))
+	names := make(map[string]bool)
+	eyeSizes := make(map[Length]string)
+	for i, size := range sizes {
+		switch {
+		case len(size.Name) == 0:
+			return nil, errors.New("family sizes need a name")
+		case names[size.Name]:
+			return nil, fmt.Errorf("family has more than one size %v", size.Name)
+		case size.EyeSize > 0:
+			size.Scale = float64(size.EyeSize) / float64(eyeSize)
+		case size.Scale > 0:
+			size.EyeSize = LengthOf(eyeSize.Millimetres() * size.Scale)
+		default:
+			return nil, fmt.Errorf("size %v needs an eye size or a scale", size.Name)
+		}
+		if size.Scale < MinFamilyScale || size.Scale > MaxFamilyScale {
+			return nil, fmt.Errorf("size %v would scale the lenses by %.2f, limit is %.2f to %.2f",
+				size.Name, size.Scale, MinFamilyScale, MaxFamilyScale)
+		}
+		if other, ok := eyeSizes[size.EyeSize]; ok {
+			return nil, fmt.Errorf("sizes %v and %v have the same eye size", other, size.Name)
+		}
+		names[size.Name] = true
+		eyeSizes[size.EyeSize] = size.Name
+		resolved[i] = size
+	}
+	if _, ok := eyeSizes[eyeSize]; !ok {
+		return nil, errors.New("one of the sizes must have the eye size of the design itself")
+	}
+	sort.Sort(familySizeOrder(resolved))
+	return resolved, nil
+}
+
+type familySizeOrder []FamilySize
+
+func (f familySizeOrder) Len() int           { return len(f) }
+func (f familySizeOrder) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f familySizeOrder) Less(i, j int) bool { return f[i].EyeSize < f[j].EyeSize }
+
+// GetFamilyDesigns returns the sizes of the family made from a base
+// design, smallest first.
+func GetFamilyDesigns(base bson.ObjectId) (designs []Design, err error) {
+	withCollection("designs", func(c *mgo.Collection) {
+		err = c.Find(bson.M{"family.base": base}).Sort("family.eye_size").All(&designs)
+	})
+	return
+}
+
+// FindFamilySize returns the design that is the named size of the family
+// that a design is a member of.
+func FindFamilySize(des Design, size string) (d Design, err error) {
+	if des.Family == nil {
+		return d, fmt.Errorf("design %v doesn't come in sizes", des.Name)
+	}
+	withCollection("designs", func(c *mgo.Collection) {
+		err = c.Find(bson.M{"family.base": des.Family.Base, "family.size": size}).One(&d)
+	})
+	if err == mgo.ErrNotFound {
+		err = fmt.Errorf("design %v doesn't come in size %v", des.Name, size)
+	}
+	return
+}
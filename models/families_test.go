@@ -0,0 +1,39 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveFamilySizes(t *testing.T) {
+	cases := []struct {
+		sizes []FamilySize
+		want  []FamilySize
+	}{
+		{DefaultFamilySizes(5000, 200), []FamilySize{
+			{"S", 4800, 0.96}, {"M", 5000, 1}, {"L", 5200, 1.04},
+		}},
+		{[]FamilySize{{Name: "54", Scale: 1.08}, {Name: "50", EyeSize: 5000}}, []FamilySize{
+			{"50", 5000, 1}, {"54", 5400, 1.08},
+		}},
+		{[]FamilySize{{Name: "M", Scale: 1}, {Name: "XL", EyeSize: 7000}}, nil},
+		{[]FamilySize{{Name: "S", EyeSize: 4800}}, nil},
+		{[]FamilySize{{Name: "M", Scale: 1}, {Name: "Regular", EyeSize: 5000}}, nil},
+		{[]FamilySize{{Name: "S", EyeSize: 5000}, {Name: "S", EyeSize: 4900}}, nil},
+		{[]FamilySize{{EyeSize: 4800}}, nil},
+		{[]FamilySize{{Name: "M"}}, nil},
+		{nil, nil},
+	}
+	for i, c := range cases {
+		got, err := ResolveFamilySizes(5000, c.sizes)
+		if (err == nil) != (c.want != nil) {
+			t.Errorf("case %v: ResolveFamilySizes error = %v, want ok %v", i, err, c.want != nil)
+		}
+		if c.want != nil && !reflect.DeepEqual(got, c.want) {
+			t.Errorf("case %v: got %v, want %v", i, got, c.want)
+		}
+	}
+	if _, err := ResolveFamilySizes(0, DefaultFamilySizes(0, 200)); err == nil {
+		t.Errorf("sizing a design without an eye size should fail")
+	}
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"crypto/sha512"
 	"encoding/hex"
+	"errors"
 	"log"
 	"time"
 
@@ -57,15 +58,15 @@ type (
 	// is describing a customer. This is not a MongoDB collection
 	// but rather an embedded document within a PersonInfo document.
 	SizeInfo struct {
-		PD           int16 `bson:"pd" json:"pd,omitempty"`
-		Splay        int16 `bson:"splayangle" json:"splayangle,omitempty"`
-		Ridge        int16 `bson:"ridgeangle" json:"ridgeangle,omitempty"`
-		NoseHeight   int16 `bson:"noseheight" json:"noseheight,omitempty"`
-		NoseRadius   int16 `bson:"noseradius" json:"noseradius,omitempty"`
-		TempleLength int16 `bson:"templelength" json:"templelength,omitempty"`
-		EarHeight    int16 `bson:"earheight" json:"earheight,omitempty"`
-		TempleWidth  int16 `bson:"templewidth" json:"templewidth,omitempty"`
-		FaceWidth    int16 `bson:"facewidth" json:"facewidth,omitempty"`
+		PD           Length `bson:"pd" json:"pd,omitempty"`
+		Splay        Angle  `bson:"splayangle" json:"splayangle,omitempty"`
+		Ridge        Angle  `bson:"ridgeangle" json:"ridgeangle,omitempty"`
+		NoseHeight   Length `bson:"noseheight" json:"noseheight,omitempty"`
+		NoseRadius   Length `bson:"noseradius" json:"noseradius,omitempty"`
+		TempleLength Length `bson:"templelength" json:"templelength,omitempty"`
+		EarHeight    Length `bson:"earheight" json:"earheight,omitempty"`
+		TempleWidth  Length `bson:"templewidth" json:"templewidth,omitempty"`
+		FaceWidth    Length `bson:"facewidth" json:"facewidth,omitempty"`
 	}
 
 	// Account is a customer of GUILD eyewear, usually a optometry store.
@@ -101,6 +102,20 @@ type (
 	}
 )
 
+// HasLevel is true if a user's type has the bit for a user level.  Admins
+// have the levels below theirs as well, so a system admin is an account
+// admin and a normal user too.
+func (u User) HasLevel(level byte) bool {
+	granted := u.Type
+	if granted&USER_SYSTEM_ADMIN != 0 {
+		granted |= USER_ACCOUNT_ADMIN
+	}
+	if granted&USER_ACCOUNT_ADMIN != 0 {
+		granted |= USER_NORMAL
+	}
+	return level != 0 && granted&level == level
+}
+
 // Account objects
 func FindAccountById(id string) (a Account, err error) {
 	log.Printf("Looking for account with id %v", id)
@@ -133,6 +148,14 @@ func FindUserById(id string) (u User, err error) {
 	return
 }
 
+// FindUsersByIds returns the users with any of the ids.
+func FindUsersByIds(ids []string) (users []User, err error) {
+	withCollection("users", func(c *mgo.Collection) {
+		err = c.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&users)
+	})
+	return
+}
+
 func FindUsersbyAccount(id string) (users []User, err error) {
 	withCollection("users", func(c *mgo.Collection) {
 		err = c.Find(bson.M{"account_id": bson.ObjectIdHex(id)}).All(&users)
@@ -167,52 +190,140 @@ type (
 	// This is not a MongoDB collection but rather an embedded document
 	// within the Temple and Front documents.
 	Engraving struct {
-		Depth int16              `bson:"depth" json:"depth"`
-		Angle int16              `bson:"cutter_angle" json:"cutter_angle"`
+		Depth Length             `bson:"depth" json:"depth"`
+		Angle Angle              `bson:"cutter_angle" json:"cutter_angle"`
 		Paths []geometry.BSpline `bson:"paths" json:"paths"`
 	}
 
+	// TempleSide is the shape of one temple and what is engraved on it.
+	// This is not a MongoDB collection but rather is inlined into the Temple
+	// document, or embedded as its right temple.
+	TempleSide struct {
+		Contour   geometry.BSpline `bson:"contour" json:"contour"`
+		Engraving Engraving        `bson:"engraving,omitempty" json:"engraving,omitempty"`
+	}
+
 	// Temple describes the arms of the glasses.  The assumption is that
 	// both temples are identical, so there is only one document rather than one
-	// for left and one for right. The Materials refernece the Materials documents
+	// for left and one for right, unless the temples are asymmetric and the
+	// Right one is given as well.  The right temple is drawn the same way as
+	// the left, so that identical temples would have the same contour.
+	// The Materials refernece the Materials documents
 	// that are acceptable for this particular design: an individual order would
 	// choose one of the acceptable materials.
 	// Temple is not a MongoDB collection but rather is an embedded document within
 	// a Design document.
 	Temple struct {
-		Contour          geometry.BSpline `bson:"contour" json:"contour"`
-		Materials        []bson.ObjectId  `bson:"materials" json:"materials"`
-		Engraving        Engraving        `bson:"engraving,omitempty" json:"engraving,omitempty"`
-		LeftText         string           `bson:"left_text,omitempty" json:"left_text,omitempty"`
-		RightText        string           `bson:"right_text,omitempty" json:"right_text,omitempty"`
-		TempleSeparation int16            `bson:"temple_separation" json:"temple_separation"`
-		TempleHeight     int16            `bson:"temple_height" json:"temple_height"`
-	}
-	// Front describes the main front of the glasses.
+		TempleSide       `bson:",inline"`
+		Right            *TempleSide     `bson:"right,omitempty" json:"right,omitempty"`
+		Materials        []bson.ObjectId `bson:"materials" json:"materials"`
+		LeftText         string          `bson:"left_text,omitempty" json:"left_text,omitempty"`
+		RightText        string          `bson:"right_text,omitempty" json:"right_text,omitempty"`
+		TempleSeparation Length          `bson:"temple_separation" json:"temple_separation"`
+		TempleHeight     Length          `bson:"temple_height" json:"temple_height"`
+	}
+	// Bridge makes the nose bridge of a front parametric, so that it can be
+	// cut to the shape of a customer's nose.  The part of the outer curve
+	// under the bridge, within Extent of the centre line, is replaced by an
+	// arch Height tall, round at the top with Radius and with its sides
+	// splayed out by Splay degrees from vertical.  Lengths are in 1/100 mm.
+	// This is not a MongoDB collection but rather an embedded document
+	// within Front and Order documents.
+	Bridge struct {
+		Extent Length `bson:"extent,omitempty" json:"extent,omitempty"`
+		Height Length `bson:"height,omitempty" json:"height,omitempty"`
+		Radius Length `bson:"radius,omitempty" json:"radius,omitempty"`
+		Splay  Angle  `bson:"splay,omitempty" json:"splay,omitempty"`
+	}
+
+	// FrontSide is the geometry of one side of a front: its half of the
+	// outer curve, which runs between two points on the centre line, its
+	// lens and its holes.  The holes are polyline contours describing
+	// cutouts in the design.
+	// This is not a MongoDB collection but rather is inlined into the Front
+	// document, or embedded as its right side.
+	FrontSide struct {
+		Outercurve geometry.BSpline   `bson:"outer_curve" json:"outer_curve"`
+		Lens       geometry.BSpline   `bson:"lens" json:"lens"`
+		Holes      []geometry.BSpline `bson:"holes,omitempty" json:"holes,omitempty"`
+	}
+
+	// Front describes the main front of the glasses.  Its own side is the
+	// left, and the right side is its mirror image unless the front is
+	// asymmetric and the Right side is given as well, in place on the other
+	// side of the centre line.
 	// The Materials refernece the Materials documents
 	// that are acceptable for this particular design: an individual order would
-	// choose one of the acceptable materials. The holes are polyline contours
-	// describing cutouts in the design.
+	// choose one of the acceptable materials.  If the front has a Bridge, the
+	// outer curve under the bridge is generated from it.
 	// Front is not a MongoDB collection but rather is an embedded document within
 	// a Design document.
 	Front struct {
-		Outercurve geometry.BSpline   `bson:"outer_curve" json:"outer_curve"`
-		Lens       geometry.BSpline   `bson:"lens" json:"lens"`
-		Holes      []geometry.BSpline `bson:"holes,omitempty" json:"holes,omitempty"`
-		Engraving  Engraving          `bson:"engraving,omitempty" json:"engraving,omitempty"`
-		Materials  []bson.ObjectId    `bson:"materials" json:"materials"`
+		FrontSide `bson:",inline"`
+		Right     *FrontSide      `bson:"right,omitempty" json:"right,omitempty"`
+		Engraving Engraving       `bson:"engraving,omitempty" json:"engraving,omitempty"`
+		Materials []bson.ObjectId `bson:"materials" json:"materials"`
+		Bridge    *Bridge         `bson:"bridge,omitempty" json:"bridge,omitempty"`
+	}
+
+	// Measurements are the boxing system numbers opticians describe frames
+	// with, computed from the curves, in 1/100 mm.  EyeSize and
+	// BMeasurement are the width and height of the box around the lens,
+	// Bridge is the distance between the lens boxes, FramePD is the distance
+	// between the box centres, and EffectiveDiameter is twice the distance
+	// from the box centre to the furthest point of the lens.
+	// Measurements is not a MongoDB collection but rather is an embedded
+	// document within Design and Order documents.
+	Measurements struct {
+		EyeSize           Length `bson:"eye_size" json:"eye_size"`
+		BMeasurement      Length `bson:"b_measurement" json:"b_measurement"`
+		Bridge            Length `bson:"bridge" json:"bridge"`
+		TempleLength      Length `bson:"temple_length" json:"temple_length"`
+		FramePD           Length `bson:"frame_pd" json:"frame_pd"`
+		EffectiveDiameter Length `bson:"effective_diameter" json:"effective_diameter"`
+		TotalWidth        Length `bson:"total_width" json:"total_width"`
+	}
+
+	// Finding is a problem found by checking the geometry of a design, such
+	// as a lens that pokes outside the front. The Location is where the
+	// problem is, in design coordinates.  Findings with error severity
+	// prevent the design from being published.
+	// Finding is not a MongoDB collection but rather is an embedded document
+	// within a Design document.
+	Finding struct {
+		Check    string          `bson:"check" json:"check"`
+		Severity string          `bson:"severity" json:"severity"`
+		Part     string          `bson:"part" json:"part"`
+		Message  string          `bson:"message" json:"message"`
+		Location *geometry.Point `bson:"location,omitempty" json:"location,omitempty"`
 	}
 
 	// Design describes a complete frame design, including the geometry, size
-	// and acceptable materials.  Design is a MongoDB collection.
+	// and acceptable materials.  The Collections reference the Collection
+	// documents the design is a member of, the Attributes describe it from
+	// the merchandising vocabulary, and the Composition the library parts it
+	// was assembled from, if any.  If the design comes in several sizes, its
+	// Family says which size it is.  Its Review is where it is in the
+	// approval workflow, and its Lifecycle controls when the design can be
+	// seen and ordered. Design is a MongoDB collection.
 	Design struct {
-		Id          bson.ObjectId `bson:"_id,omitempty" json:"id"`
-		Designer    string        `bson:"designer_accountuser_id" json:"-"`
-		Name        string        `bson:"name" json:"name"`
-		Front       Front         `bson:"front" json:"front"`
-		Temple      Temple        `bson:"temple" json:"temple"`
-		Collections []string      `bson:"collections,omitempty" json:"collections,omitempty"`
-		Updated     time.Time     `bson:"updated" json:"updated"`
+		Id           bson.ObjectId   `bson:"_id,omitempty" json:"id"`
+		Designer     string          `bson:"designer_accountuser_id" json:"-"`
+		Name         string          `bson:"name" json:"name"`
+		LegacyId     int             `bson:"legacy_id,omitempty" json:"legacy_id,omitempty"`
+		Revision     int             `bson:"revision" json:"revision"`
+		Front        Front           `bson:"front" json:"front"`
+		Temple       Temple          `bson:"temple" json:"temple"`
+		Collections  []bson.ObjectId `bson:"collections,omitempty" json:"collections,omitempty"`
+		Tags         []string        `bson:"tags,omitempty" json:"tags,omitempty"`
+		Attributes   Attributes      `bson:"attributes,omitempty" json:"attributes,omitempty"`
+		Composition  *Composition    `bson:"composition,omitempty" json:"composition,omitempty"`
+		Family       *FamilyMember   `bson:"family,omitempty" json:"family,omitempty"`
+		Review       *Review         `bson:"review,omitempty" json:"review,omitempty"`
+		Lifecycle    `bson:",inline"`
+		Findings     []Finding    `bson:"findings,omitempty" json:"findings,omitempty"`
+		Measurements Measurements `bson:"measurements" json:"measurements"`
+		Updated      time.Time    `bson:"updated" json:"updated"`
 	}
 
 	// Material describes an available plastic blank that a temple or front
@@ -246,6 +357,9 @@ type (
 // Materials objects
 func FindMaterialById(id string) (m Material, err error) {
 	log.Printf("Looking for material with id %v", id)
+	if !bson.IsObjectIdHex(id) {
+		return m, mgo.ErrNotFound
+	}
 	withCollection("materials", func(c *mgo.Collection) {
 		err = c.FindId(bson.ObjectIdHex(id)).One(&m)
 	})
@@ -276,20 +390,120 @@ func CreateMaterial(mat *Material) (err error) {
 
 func InsertDesign(design *Design) (err error) {
 	log.Printf("Trying to insert design %v", design)
+	if len(design.Id) == 0 {
+		design.Id = bson.NewObjectId()
+	}
 	withCollection("designs", func(c *mgo.Collection) {
 		err = c.Insert(design)
 	})
 	return
 }
 
+// Finding severities
+const (
+	FINDING_ERROR   = "error"   // The design can't be made
+	FINDING_WARNING = "warning" // The design can be made but should be checked
+)
+
+// HasErrors is true if any of the geometry findings of the design are errors.
+func (d *Design) HasErrors() bool {
+	for _, f := range d.Findings {
+		if f.Severity == FINDING_ERROR {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that a design has everything needed to render and make
+// it, returning an error describing the first problem found.
+func (d *Design) Validate() error {
+	switch {
+	case len(d.Name) == 0:
+		return errors.New("design name required")
+	case len(d.Front.Outercurve) < 4:
+		return errors.New("front outer_curve needs at least 4 control points")
+	case len(d.Front.Lens) < 4:
+		return errors.New("front lens needs at least 4 control points")
+	case len(d.Temple.Contour) < 4:
+		return errors.New("temple contour needs at least 4 control points")
+	case d.Front.Right != nil && len(d.Front.Right.Outercurve) < 4:
+		return errors.New("front right outer_curve needs at least 4 control points")
+	case d.Front.Right != nil && len(d.Front.Right.Lens) < 4:
+		return errors.New("front right lens needs at least 4 control points")
+	case d.Temple.Right != nil && len(d.Temple.Right.Contour) < 4:
+		return errors.New("temple right contour needs at least 4 control points")
+	}
+	sides := []FrontSide{d.Front.FrontSide}
+	if d.Front.Right != nil {
+		sides = append(sides, *d.Front.Right)
+	}
+	for _, side := range sides {
+		for _, hole := range side.Holes {
+			if len(hole) < 3 {
+				return errors.New("front holes need at least 3 points")
+			}
+		}
+	}
+	for _, m := range append(d.Front.Materials, d.Temple.Materials...) {
+		if !m.Valid() {
+			return errors.New("invalid material id")
+		}
+	}
+	return nil
+}
+
+func UpdateDesign(design *Design) (err error) {
+	design.Updated = time.Now()
+	withCollection("designs", func(c *mgo.Collection) {
+		err = c.UpdateId(design.Id, design)
+	})
+	return
+}
+
+func DeleteDesign(id bson.ObjectId) (err error) {
+	withCollection("designs", func(c *mgo.Collection) {
+		err = c.RemoveId(id)
+	})
+	if err != nil {
+		return
+	}
+	withCollection("collections", func(c *mgo.Collection) {
+		_, err = c.UpdateAll(bson.M{"designs": id}, bson.M{"$pull": bson.M{"designs": id}})
+	})
+	if err != nil {
+		return
+	}
+	withCollection("design_revisions", func(c *mgo.Collection) {
+		_, err = c.RemoveAll(bson.M{"design_id": id})
+	})
+	return
+}
+
 func FindDesignById(id string) (d Design, err error) {
 	log.Printf("Looking for design with id %v", id)
+	if !bson.IsObjectIdHex(id) {
+		return d, mgo.ErrNotFound
+	}
 	withCollection("designs", func(c *mgo.Collection) {
 		err = c.FindId(bson.ObjectIdHex(id)).One(&d)
 	})
 	return
 }
 
+// FindLegacyDesign finds a design imported from the legacy system, by its
+// legacy id if it has one or else by name.
+func FindLegacyDesign(legacyId int, name string) (d Design, err error) {
+	query := bson.M{"name": name}
+	if legacyId != 0 {
+		query = bson.M{"legacy_id": legacyId}
+	}
+	withCollection("designs", func(c *mgo.Collection) {
+		err = c.Find(query).One(&d)
+	})
+	return
+}
+
 func GetAllDesigns() (designs []Design, err error) {
 	withCollection("designs", func(c *mgo.Collection) {
 		err = c.Find(nil).All(&designs)
@@ -297,14 +511,25 @@ func GetAllDesigns() (designs []Design, err error) {
 	return
 }
 
-func GetDesignsWithCollection(collection string) (designs []Design, err error) {
-	log.Printf("Getting designs inside collection %v", collection)
+// GetPublishedDesigns returns the designs that are published at time t.
+func GetPublishedDesigns(t time.Time) (designs []Design, err error) {
 	withCollection("designs", func(c *mgo.Collection) {
-		err = c.Find(bson.M{"collections": collection}).All(&designs)
+		err = c.Find(publishedQuery(t)).All(&designs)
 	})
 	return
 }
 
+// GetDesignsWithCollection returns the designs in the collection with the
+// given id or slug, in the collection's display order.
+func GetDesignsWithCollection(collection string) (designs []Design, err error) {
+	log.Printf("Getting designs inside collection %v", collection)
+	coll, err := FindCollection(collection)
+	if err != nil {
+		return
+	}
+	return GetCollectionDesigns(coll)
+}
+
 // Order status constants
 const (
 	ORDER_NEW            = iota
@@ -320,7 +545,8 @@ const (
 type (
 	// Order instantiates a design into a concrete frame for a customer. It contains
 	// references to the account, the user who entered the order, information about the customer,
-	// and various customizations to the design.
+	// and various customizations to the design.  An order for a design that
+	// comes in sizes can give the Size instead of a Scale.
 	Order struct {
 		Id              bson.ObjectId `bson:"_id,omitempty" json:"id,omitempty"`
 		AccountId       bson.ObjectId `bson:"account_id" json:"account_id"`
@@ -332,10 +558,14 @@ type (
 		UserId          string        `bson:"user_id" json:"user_id"`
 		FrontMaterial   bson.ObjectId `bson:"front_material_id" json:"front_material_id"`
 		TempleMaterial  bson.ObjectId `bson:"temple_material_id" json:"temple_material_id"`
+		Size            string        `bson:"size,omitempty" json:"size,omitempty"`
 		Scale           float64       `bson:"scale" json:"scale"`
-		YPosition       float64       `bson:"y_position" json:"y_position"`
+		YPosition       *float64      `bson:"y_position" json:"y_position"`
 		LeftTempleText  string        `bson:"left_temple_text" json:"left_temple_text"`
 		RightTempleText string        `bson:"right_temple_text" json:"right_temple_text"`
+		TempleFont      string        `bson:"temple_font,omitempty" json:"temple_font,omitempty"`
+		Bridge          *Bridge       `bson:"bridge,omitempty" json:"bridge,omitempty"`
+		Measurements    Measurements  `bson:"measurements" json:"measurements"`
 	}
 
 	Invoice struct {
@@ -365,6 +595,9 @@ func CreateOrder(order *Order) (err error) {
 }
 
 func FindOrderById(id string) (o Order, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return o, mgo.ErrNotFound
+	}
 	withCollection("orders", func(c *mgo.Collection) {
 		err = c.FindId(bson.ObjectIdHex(id)).One(&o)
 	})
@@ -378,6 +611,14 @@ func GetOrders(stat int) (os []Order, err error) {
 	return
 }
 
+// CountDesignOrders returns the number of orders that reference a design.
+func CountDesignOrders(id bson.ObjectId) (n int, err error) {
+	withCollection("orders", func(c *mgo.Collection) {
+		n, err = c.Find(bson.M{"design_id": id}).Count()
+	})
+	return
+}
+
 func GetAllOrders() (os []Order, err error) {
 	log.Println("Getting all orders")
 	withCollection("orders", func(c *mgo.Collection) {
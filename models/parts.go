@@ -0,0 +1,199 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Types related to the library of parts that are combined on the lego site
+type (
+	// FrontPart is a front that can be combined with any compatible temple.
+	// The hinge separation and height are where the front expects the
+	// temples to be mounted, in 1/100 mm like the Temple fields they are
+	// matched against.  FrontPart is a MongoDB collection.
+	FrontPart struct {
+		Id              bson.ObjectId `bson:"_id" json:"id"`
+		Name            string        `bson:"name" json:"name"`
+		Designer        string        `bson:"designer_accountuser_id" json:"-"`
+		SourceDesign    bson.ObjectId `bson:"source_design_id,omitempty" json:"source_design_id,omitempty"`
+		Front           Front         `bson:"front" json:"front"`
+		HingeSeparation Length        `bson:"hinge_separation" json:"hinge_separation"`
+		HingeHeight     Length        `bson:"hinge_height" json:"hinge_height"`
+		Lifecycle       `bson:",inline"`
+		Updated         time.Time `bson:"updated" json:"updated"`
+	}
+
+	// TemplePart is a temple that can be combined with any compatible front.
+	// TemplePart is a MongoDB collection.
+	TemplePart struct {
+		Id           bson.ObjectId `bson:"_id" json:"id"`
+		Name         string        `bson:"name" json:"name"`
+		Designer     string        `bson:"designer_accountuser_id" json:"-"`
+		SourceDesign bson.ObjectId `bson:"source_design_id,omitempty" json:"source_design_id,omitempty"`
+		Temple       Temple        `bson:"temple" json:"temple"`
+		Lifecycle    `bson:",inline"`
+		Updated      time.Time `bson:"updated" json:"updated"`
+	}
+
+	// Composition records the library parts that a design was assembled
+	// from. It is not a MongoDB collection but rather is an embedded document
+	// within a Design document.
+	Composition struct {
+		FrontPart  bson.ObjectId `bson:"front_part_id" json:"front_part_id"`
+		TemplePart bson.ObjectId `bson:"temple_part_id" json:"temple_part_id"`
+	}
+)
+
+// Front parts
+func CreateFrontPart(part *FrontPart) (err error) {
+	if len(part.Name) == 0 {
+		return errors.New("part name required")
+	}
+	part.Id = bson.NewObjectId()
+	part.Updated = time.Now()
+	withCollection("fronts", func(c *mgo.Collection) {
+		err = c.Insert(part)
+	})
+	return
+}
+
+func FindFrontPartById(id string) (p FrontPart, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return p, mgo.ErrNotFound
+	}
+	withCollection("fronts", func(c *mgo.Collection) {
+		err = c.FindId(bson.ObjectIdHex(id)).One(&p)
+	})
+	return
+}
+
+// GetFrontParts returns all front parts, or only those published at time
+// t if published is set.
+func GetFrontParts(published bool, t time.Time) (parts []FrontPart, err error) {
+	var query interface{}
+	if published {
+		query = publishedQuery(t)
+	}
+	withCollection("fronts", func(c *mgo.Collection) {
+		err = c.Find(query).Sort("name").All(&parts)
+	})
+	return
+}
+
+func UpdateFrontPart(part *FrontPart) (err error) {
+	part.Updated = time.Now()
+	withCollection("fronts", func(c *mgo.Collection) {
+		err = c.UpdateId(part.Id, part)
+	})
+	return
+}
+
+func DeleteFrontPart(id bson.ObjectId) (err error) {
+	withCollection("fronts", func(c *mgo.Collection) {
+		err = c.RemoveId(id)
+	})
+	return
+}
+
+// Temple parts
+func CreateTemplePart(part *TemplePart) (err error) {
+	if len(part.Name) == 0 {
+		return errors.New("part name required")
+	}
+	part.Id = bson.NewObjectId()
+	part.Updated = time.Now()
+	withCollection("temples", func(c *mgo.Collection) {
+		err = c.Insert(part)
+	})
+	return
+}
+
+func FindTemplePartById(id string) (p TemplePart, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return p, mgo.ErrNotFound
+	}
+	withCollection("temples", func(c *mgo.Collection) {
+		err = c.FindId(bson.ObjectIdHex(id)).One(&p)
+	})
+	return
+}
+
+// GetTempleParts returns all temple parts, or only those published at
+// time t if published is set.
+func GetTempleParts(published bool, t time.Time) (parts []TemplePart, err error) {
+	var query interface{}
+	if published {
+		query = publishedQuery(t)
+	}
+	withCollection("temples", func(c *mgo.Collection) {
+		err = c.Find(query).Sort("name").All(&parts)
+	})
+	return
+}
+
+func UpdateTemplePart(part *TemplePart) (err error) {
+	part.Updated = time.Now()
+	withCollection("temples", func(c *mgo.Collection) {
+		err = c.UpdateId(part.Id, part)
+	})
+	return
+}
+
+func DeleteTemplePart(id bson.ObjectId) (err error) {
+	withCollection("temples", func(c *mgo.Collection) {
+		err = c.RemoveId(id)
+	})
+	return
+}
+
+// ExtractDesignParts adds the front and temple of a design to the parts
+// library. The parts are drafts until they are published separately.
+func ExtractDesignParts(design Design) (front FrontPart, temple TemplePart, err error) {
+	front = FrontPart{
+		Name:            design.Name,
+		Designer:        design.Designer,
+		SourceDesign:    design.Id,
+		Front:           design.Front,
+		HingeSeparation: design.Temple.TempleSeparation,
+		HingeHeight:     design.Temple.TempleHeight,
+	}
+	if err = CreateFrontPart(&front); err != nil {
+		return
+	}
+	temple = TemplePart{
+		Name:         design.Name,
+		Designer:     design.Designer,
+		SourceDesign: design.Id,
+		Temple:       design.Temple,
+	}
+	err = CreateTemplePart(&temple)
+	return
+}
+
+// FindComposedDesign returns the design previously assembled from a front
+// and temple part, if there is one.
+func FindComposedDesign(front, temple bson.ObjectId) (d Design, err error) {
+	log.Printf("Looking for design composed of %v and %v", front.Hex(), temple.Hex())
+	withCollection("designs", func(c *mgo.Collection) {
+		err = c.Find(bson.M{"composition.front_part_id": front, "composition.temple_part_id": temple}).One(&d)
+	})
+	return
+}
+
+// MigrateComposedDesigns takes the designs composed from parts, which were
+// published when they were composed, back out of the catalogue.
+func MigrateComposedDesigns() (migrated int, err error) {
+	var info *mgo.ChangeInfo
+	withCollection("designs", func(c *mgo.Collection) {
+		info, err = c.UpdateAll(bson.M{"composition": bson.M{"$exists": true}, "status": PUBLISH_PUBLISHED},
+			bson.M{"$set": bson.M{"status": PUBLISH_DRAFT}})
+	})
+	if err == nil {
+		migrated = info.Updated
+	}
+	return
+}
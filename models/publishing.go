@@ -0,0 +1,99 @@
+package models
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Publishing status constants, shared by collections and designs
+const (
+	PUBLISH_DRAFT     = iota // Only visible to system admins
+	PUBLISH_PUBLISHED        // Visible to everyone and orderable
+	PUBLISH_ARCHIVED         // Retired, but still resolvable by id for existing orders
+)
+
+// Lifecycle is the publishing state of a collection or design.  The
+// stored Status can be moved forward by the schedule: a draft becomes
+// published once PublishAt has passed and anything becomes archived once
+// RetireAt has passed. The schedule is evaluated whenever the content is
+// read, so launches happen on time without a background job.
+// This is not a MongoDB collection but rather is inlined into the Collection
+// and Design documents.
+type Lifecycle struct {
+	Status    int16      `bson:"status" json:"status"`
+	PublishAt *time.Time `bson:"publish_at,omitempty" json:"publish_at,omitempty"`
+	RetireAt  *time.Time `bson:"retire_at,omitempty" json:"retire_at,omitempty"`
+}
+
+// StatusAt returns the effective publishing status at time t.
+func (l Lifecycle) StatusAt(t time.Time) int16 {
+	if l.Status == PUBLISH_ARCHIVED || (l.RetireAt != nil && !t.Before(*l.RetireAt)) {
+		return PUBLISH_ARCHIVED
+	}
+	if l.Status == PUBLISH_DRAFT && l.PublishAt != nil && !t.Before(*l.PublishAt) {
+		return PUBLISH_PUBLISHED
+	}
+	return l.Status
+}
+
+// IsPublishedAt is true if the content is publicly visible at time t.
+func (l Lifecycle) IsPublishedAt(t time.Time) bool {
+	return l.StatusAt(t) == PUBLISH_PUBLISHED
+}
+
+// publishedQuery selects the documents that are published at time t,
+// mirroring Lifecycle.StatusAt.
+func publishedQuery(t time.Time) bson.M {
+	return bson.M{
+		"$and": []bson.M{
+			{"$or": []bson.M{
+				{"status": PUBLISH_PUBLISHED},
+				{"status": PUBLISH_DRAFT, "publish_at": bson.M{"$lte": t}},
+			}},
+			{"$or": []bson.M{
+				{"retire_at": bson.M{"$exists": false}},
+				{"retire_at": bson.M{"$gt": t}},
+			}},
+		},
+	}
+}
+
+// FilterPublishedDesigns returns the designs that are published at time t,
+// preserving their order.
+func FilterPublishedDesigns(designs []Design, t time.Time) []Design {
+	published := make([]Design, 0, len(designs))
+	for _, d := range designs {
+		if d.IsPublishedAt(t) {
+			published = append(published, d)
+		}
+	}
+	return published
+}
+
+// IsOrderableAt is true if a design can be ordered at time t.  Designs
+// composed from library parts are drafts that aren't listed in the
+// catalogue, and can be ordered until they are archived as long as they
+// have no geometry errors; whether their parts are still published is
+// checked when ordering.  Other designs must be published and approved.
+func (d Design) IsOrderableAt(t time.Time) bool {
+	if d.Composition != nil {
+		return d.StatusAt(t) != PUBLISH_ARCHIVED && !d.HasErrors()
+	}
+	return d.IsPublishedAt(t) && d.ReviewState() == REVIEW_APPROVED
+}
+
+// MigratePublishingStatus marks designs that predate the publishing
+// lifecycle as published, so that they don't disappear from the catalogue.
+func MigratePublishingStatus() (migrated int, err error) {
+	var info *mgo.ChangeInfo
+	withCollection("designs", func(c *mgo.Collection) {
+		info, err = c.UpdateAll(bson.M{"status": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"status": PUBLISH_PUBLISHED}})
+	})
+	if err == nil {
+		migrated = info.Updated
+	}
+	return
+}
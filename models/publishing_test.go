@@ -0,0 +1,56 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLifecycleStatusAt(t *testing.T) {
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+
+	cases := []struct {
+		life Lifecycle
+		want int16
+	}{
+		{Lifecycle{Status: PUBLISH_DRAFT}, PUBLISH_DRAFT},
+		{Lifecycle{Status: PUBLISH_DRAFT, PublishAt: &after}, PUBLISH_DRAFT},
+		{Lifecycle{Status: PUBLISH_DRAFT, PublishAt: &before}, PUBLISH_PUBLISHED},
+		{Lifecycle{Status: PUBLISH_DRAFT, PublishAt: &now}, PUBLISH_PUBLISHED},
+		{Lifecycle{Status: PUBLISH_PUBLISHED, RetireAt: &after}, PUBLISH_PUBLISHED},
+		{Lifecycle{Status: PUBLISH_PUBLISHED, RetireAt: &before}, PUBLISH_ARCHIVED},
+		{Lifecycle{Status: PUBLISH_DRAFT, PublishAt: &before, RetireAt: &before}, PUBLISH_ARCHIVED},
+		{Lifecycle{Status: PUBLISH_ARCHIVED, PublishAt: &before}, PUBLISH_ARCHIVED},
+	}
+	for i, c := range cases {
+		if got := c.life.StatusAt(now); got != c.want {
+			t.Errorf("case %v: StatusAt = %v, want %v", i, got, c.want)
+		}
+	}
+}
+
+func TestDesignIsOrderableAt(t *testing.T) {
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	composed := &Composition{FrontPart: "f", TemplePart: "t"}
+	approved := &Review{State: REVIEW_APPROVED}
+	broken := []Finding{{Check: "closure", Severity: FINDING_ERROR}}
+
+	cases := []struct {
+		des  Design
+		want bool
+	}{
+		{Design{Lifecycle: Lifecycle{Status: PUBLISH_PUBLISHED}, Review: approved}, true},
+		{Design{Lifecycle: Lifecycle{Status: PUBLISH_PUBLISHED}}, false},
+		{Design{Lifecycle: Lifecycle{Status: PUBLISH_PUBLISHED}, Review: &Review{State: REVIEW_SUBMITTED}}, false},
+		{Design{Lifecycle: Lifecycle{Status: PUBLISH_DRAFT}, Review: approved}, false},
+		{Design{Lifecycle: Lifecycle{Status: PUBLISH_ARCHIVED}, Review: approved}, false},
+		{Design{Composition: composed}, true},
+		{Design{Composition: composed, Findings: broken}, false},
+		{Design{Composition: composed, Lifecycle: Lifecycle{Status: PUBLISH_ARCHIVED}}, false},
+	}
+	for i, c := range cases {
+		if got := c.des.IsOrderableAt(now); got != c.want {
+			t.Errorf("case %v: IsOrderableAt = %v, want %v", i, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Review states of a design
+const (
+	REVIEW_SUBMITTED         = "submitted"         // Waiting for a system admin to review it
+	REVIEW_CHANGES_REQUESTED = "changes_requested" // Sent back to the designer
+	REVIEW_APPROVED          = "approved"          // Can be published and added to collections
+)
+
+// Steps in a design's review.  Designers submit their designs, and system
+// admins make the other decisions.
+const (
+	DECISION_SUBMIT          = "submit"
+	DECISION_APPROVE         = "approve"
+	DECISION_REQUEST_CHANGES = "request_changes"
+	DECISION_COMMENT         = "comment"
+)
+
+type (
+	// Review is where a design is in the approval workflow.  Designs are
+	// submitted by their designer for the Collections they should be in,
+	// and a system admin approves them or requests changes.  Only approved
+	// designs can be published.  Revision is the revision of the design that
+	// was submitted or approved.
+	// This is not a MongoDB collection but rather an embedded document
+	// within a Design document.
+	Review struct {
+		State       string          `bson:"state" json:"state"`
+		Revision    int             `bson:"revision" json:"revision"`
+		Collections []bson.ObjectId `bson:"collections,omitempty" json:"collections,omitempty"`
+		Updated     time.Time       `bson:"updated" json:"updated"`
+	}
+
+	// ReviewEvent records a step of a design's review: the state it moved
+	// to, or a comment that leaves the state as it was.  ReviewEvent is a
+	// MongoDB collection.
+	ReviewEvent struct {
+		Id       bson.ObjectId `bson:"_id" json:"id"`
+		DesignId bson.ObjectId `bson:"design_id" json:"design_id"`
+		Revision int           `bson:"revision" json:"revision"`
+		User     string        `bson:"user" json:"user"`
+		From     string        `bson:"from,omitempty" json:"from,omitempty"`
+		State    string        `bson:"state" json:"state"`
+		Comment  string        `bson:"comment,omitempty" json:"comment,omitempty"`
+		Created  time.Time     `bson:"created" json:"created"`
+	}
+
+	// Notification tells a user about something that happened to one of
+	// their designs, or that there is a design to review.  Notification is
+	// a MongoDB collection.
+	Notification struct {
+		Id       bson.ObjectId `bson:"_id" json:"id"`
+		User     string        `bson:"user" json:"-"`
+		DesignId bson.ObjectId `bson:"design_id,omitempty" json:"design_id,omitempty"`
+		Message  string        `bson:"message" json:"message"`
+		Read     bool          `bson:"read" json:"read"`
+		Created  time.Time     `bson:"created" json:"created"`
+	}
+)
+
+// ReviewState is the review state of a design, or "" if it has never been
+// submitted.
+func (d Design) ReviewState() string {
+	if d.Review == nil {
+		return ""
+	}
+	return d.Review.State
+}
+
+// NextReviewState is the state that a design in state moves to when it is
+// submitted, or a system admin makes a decision about it.
+func NextReviewState(state, decision string) (string, error) {
+	switch decision {
+	case DECISION_SUBMIT:
+		if state == REVIEW_SUBMITTED || state == REVIEW_APPROVED {
+			return "", fmt.Errorf("design is already %v", state)
+		}
+		return REVIEW_SUBMITTED, nil
+	case DECISION_APPROVE, DECISION_REQUEST_CHANGES:
+		if state != REVIEW_SUBMITTED {
+			return "", fmt.Errorf("design has not been submitted for review")
+		}
+		if decision == DECISION_APPROVE {
+			return REVIEW_APPROVED, nil
+		}
+		return REVIEW_CHANGES_REQUESTED, nil
+	case DECISION_COMMENT:
+		if len(state) == 0 {
+			return "", fmt.Errorf("design has not been submitted for review")
+		}
+		return state, nil
+	}
+	return "", fmt.Errorf("unknown decision %v, decisions are %v, %v and %v",
+		decision, DECISION_APPROVE, DECISION_REQUEST_CHANGES, DECISION_COMMENT)
+}
+
+// InsertReviewEvent records a step of a design's review.
+func InsertReviewEvent(event *ReviewEvent) (err error) {
+	event.Id = bson.NewObjectId()
+	event.Created = time.Now()
+	withCollection("design_reviews", func(c *mgo.Collection) {
+		err = c.Insert(event)
+	})
+	return
+}
+
+// GetReviewEvents returns the review history of a design, oldest first.
+func GetReviewEvents(id bson.ObjectId) (events []ReviewEvent, err error) {
+	withCollection("design_reviews", func(c *mgo.Collection) {
+		err = c.Find(bson.M{"design_id": id}).Sort("created").All(&events)
+	})
+	return
+}
+
+// GetSubmittedDesigns returns the designs waiting for review, longest
+// waiting first.
+func GetSubmittedDesigns() (designs []Design, err error) {
+	withCollection("designs", func(c *mgo.Collection) {
+		err = c.Find(bson.M{"review.state": REVIEW_SUBMITTED}).Sort("review.updated").All(&designs)
+	})
+	return
+}
+
+// GetSystemAdmins returns the users who review designs.
+func GetSystemAdmins() (users []User, err error) {
+	withCollection("users", func(c *mgo.Collection) {
+		err = c.Find(bson.M{"usertype": bson.M{"$bitsAllSet": USER_SYSTEM_ADMIN}}).All(&users)
+	})
+	return
+}
+
+// Notify leaves a message for each of the users.
+func Notify(users []string, design bson.ObjectId, message string) (err error) {
+	withCollection("notifications", func(c *mgo.Collection) {
+		for _, user := range users {
+			n := Notification{Id: bson.NewObjectId(), User: user, DesignId: design,
+				Message: message, Created: time.Now()}
+			if err = c.Insert(n); err != nil {
+				return
+			}
+		}
+	})
+	return
+}
+
+// GetNotifications returns a user's notifications, newest first, or only
+// the unread ones.
+func GetNotifications(user string, unreadOnly bool) (ns []Notification, err error) {
+	query := bson.M{"user": user}
+	if unreadOnly {
+		query["read"] = false
+	}
+	withCollection("notifications", func(c *mgo.Collection) {
+		err = c.Find(query).Sort("-created").All(&ns)
+	})
+	return
+}
+
+// MarkNotificationRead marks one of a user's notifications as read.
+func MarkNotificationRead(user, id string) (err error) {
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+	withCollection("notifications", func(c *mgo.Collection) {
+		err = c.Update(bson.M{"_id": bson.ObjectIdHex(id), "user": user}, bson.M{"$set": bson.M{"read": true}})
+	})
+	return
+}
+
+// MigrateDesignReviews approves the designs that were published or
+// scheduled before designs were reviewed, so that they stay in the
+// catalogue.
+func MigrateDesignReviews() (migrated int, err error) {
+	var info *mgo.ChangeInfo
+	withCollection("designs", func(c *mgo.Collection) {
+		info, err = c.UpdateAll(bson.M{
+			"review": bson.M{"$exists": false},
+			"$or": []bson.M{
+				{"status": bson.M{"$ne": PUBLISH_DRAFT}},
+				{"publish_at": bson.M{"$exists": true}},
+			},
+		}, bson.M{"$set": bson.M{"review": Review{State: REVIEW_APPROVED, Updated: time.Now()}}})
+	})
+	if err == nil {
+		migrated = info.Updated
+	}
+	return
+}
@@ -0,0 +1,27 @@
+package models
+
+import "testing"
+
+func TestNextReviewState(t *testing.T) {
+	cases := []struct {
+		state, decision, want string
+	}{
+		{"", DECISION_SUBMIT, REVIEW_SUBMITTED},
+		{REVIEW_CHANGES_REQUESTED, DECISION_SUBMIT, REVIEW_SUBMITTED},
+		{REVIEW_APPROVED, DECISION_SUBMIT, ""},
+		{REVIEW_SUBMITTED, DECISION_SUBMIT, ""},
+		{REVIEW_SUBMITTED, DECISION_APPROVE, REVIEW_APPROVED},
+		{REVIEW_SUBMITTED, DECISION_REQUEST_CHANGES, REVIEW_CHANGES_REQUESTED},
+		{REVIEW_CHANGES_REQUESTED, DECISION_APPROVE, ""},
+		{"", DECISION_REQUEST_CHANGES, ""},
+		{REVIEW_APPROVED, DECISION_COMMENT, REVIEW_APPROVED},
+		{"", DECISION_COMMENT, ""},
+		{REVIEW_SUBMITTED, "reject", ""},
+	}
+	for _, c := range cases {
+		got, err := NextReviewState(c.state, c.decision)
+		if (err == nil) != (c.want != "") || got != c.want {
+			t.Errorf("NextReviewState(%q, %q) = %q, %v, want %q", c.state, c.decision, got, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type (
+	// DesignRevision is a design as it was before it was edited.  Designs
+	// are revision 0 when they are created and count up with each edit, so
+	// the design itself is always its latest revision.  DesignRevision is a
+	// MongoDB collection.
+	DesignRevision struct {
+		Id       bson.ObjectId `bson:"_id" json:"-"`
+		DesignId bson.ObjectId `bson:"design_id" json:"design_id"`
+		Revision int           `bson:"revision" json:"revision"`
+		Design   Design        `bson:"design" json:"design"`
+		Saved    time.Time     `bson:"saved" json:"saved"`
+	}
+)
+
+// UpdateDesignRevision saves an edit of a design as its next revision,
+// then keeps a copy of the design as it was before the edit.  The copy is
+// only kept once the edit has been saved, so a failed edit doesn't leave
+// a revision behind that the design never moved on from.
+func UpdateDesignRevision(existing Design, edited *Design) (err error) {
+	edited.Revision = existing.Revision + 1
+	if err = UpdateDesign(edited); err != nil {
+		edited.Revision = existing.Revision
+		return
+	}
+	rev := DesignRevision{Id: bson.NewObjectId(), DesignId: existing.Id, Revision: existing.Revision,
+		Design: existing, Saved: time.Now()}
+	withCollection("design_revisions", func(c *mgo.Collection) {
+		err = c.Insert(rev)
+	})
+	return
+}
+
+// FindDesignRevision returns a design as it was at a revision, which may
+// be the design's current revision.
+func FindDesignRevision(id string, revision int) (d Design, err error) {
+	if d, err = FindDesignById(id); err != nil || d.Revision == revision {
+		return
+	}
+	var rev DesignRevision
+	withCollection("design_revisions", func(c *mgo.Collection) {
+		err = c.Find(bson.M{"design_id": d.Id, "revision": revision}).One(&rev)
+	})
+	return rev.Design, err
+}
+
+// GetDesignRevisions returns the earlier revisions of a design, oldest
+// first.
+func GetDesignRevisions(id bson.ObjectId) (revs []DesignRevision, err error) {
+	withCollection("design_revisions", func(c *mgo.Collection) {
+		err = c.Find(bson.M{"design_id": id}).Sort("revision").All(&revs)
+	})
+	return
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"fmt"
+	"math"
+)
+
+// Length is a length in 1/100 mm, the resolution that lengths are stored
+// at.  Curves are stored as b-splines in millimetres.
+type Length int16
+
+// The longest lengths that can be stored each way, about 327mm.
+const (
+	MaxLength Length = math.MaxInt16
+	MinLength Length = math.MinInt16
+)
+
+// Millimetres converts a length to millimetres.
+func (l Length) Millimetres() float64 {
+	return float64(l) / 100
+}
+
+// In converts a length to a unit.
+func (l Length) In(u Unit) float64 {
+	return l.Millimetres() * u.PerMillimetre
+}
+
+// LengthOf rounds millimetres to the nearest Length.  Lengths too long to
+// store are limited to the longest Length rather than overflowing.
+func LengthOf(mm float64) Length {
+	h := math.Floor(mm*100 + 0.5)
+	switch {
+	case math.IsNaN(h):
+		return 0
+	case h > float64(MaxLength):
+		return MaxLength
+	case h < float64(MinLength):
+		return MinLength
+	}
+	return Length(h)
+}
+
+// CheckedLength is LengthOf for lengths given to the server, which are
+// refused if they are too long to store.
+func CheckedLength(mm float64) (Length, error) {
+	if math.IsNaN(mm) || math.Abs(mm) > MaxLength.Millimetres() {
+		return 0, fmt.Errorf("length of %.2fmm is longer than the %.2fmm that can be stored", mm, MaxLength.Millimetres())
+	}
+	return LengthOf(mm), nil
+}
+
+// Angle is an angle in whole degrees.
+type Angle int16
+
+// Radians converts an angle to radians.
+func (a Angle) Radians() float64 {
+	return float64(a) * math.Pi / 180
+}
+
+// Unit is a unit that lengths can be given in to and from the API.
+type Unit struct {
+	Name          string
+	PerMillimetre float64
+}
+
+// Units that lengths can be given in
+var (
+	UNIT_MM         = Unit{"mm", 1}
+	UNIT_INCH       = Unit{"in", 1 / 25.4}
+	UNIT_HUNDREDTHS = Unit{"1/100mm", 100}
+	Units           = []Unit{UNIT_MM, UNIT_INCH, UNIT_HUNDREDTHS}
+)
+
+// ParseUnit finds a unit by name.
+func ParseUnit(name string) (Unit, error) {
+	for _, u := range Units {
+		if u.Name == name {
+			return u, nil
+		}
+	}
+	return Unit{}, fmt.Errorf("unknown unit %v, units are mm, in and 1/100mm", name)
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLengthOf(t *testing.T) {
+	cases := []struct {
+		mm   float64
+		want Length
+	}{
+		{0, 0},
+		{52.345, 5235},
+		{-12.004, -1200},
+		{327.67, MaxLength},
+		{1000, MaxLength},
+		{-1000, MinLength},
+		{math.Inf(1), MaxLength},
+		{math.NaN(), 0},
+	}
+	for _, c := range cases {
+		if got := LengthOf(c.mm); got != c.want {
+			t.Errorf("LengthOf(%v) = %v, want %v", c.mm, got, c.want)
+		}
+	}
+}
+
+func TestCheckedLength(t *testing.T) {
+	cases := []struct {
+		mm float64
+		ok bool
+	}{
+		{140, true},
+		{-327.67, true},
+		{327.68, false},
+		{-400, false},
+		{math.NaN(), false},
+	}
+	for _, c := range cases {
+		if _, err := CheckedLength(c.mm); (err == nil) != c.ok {
+			t.Errorf("CheckedLength(%v) error = %v, want ok %v", c.mm, err, c.ok)
+		}
+	}
+}
+
+func TestLengthIn(t *testing.T) {
+	l := Length(2540)
+	if got := l.In(UNIT_INCH); math.Abs(got-1) > 1e-12 {
+		t.Errorf("25.4mm in inches = %v, want 1", got)
+	}
+	if got := l.In(UNIT_HUNDREDTHS); got != 2540 {
+		t.Errorf("25.4mm in 1/100mm = %v, want 2540", got)
+	}
+	if _, err := ParseUnit("cm"); err == nil {
+		t.Errorf("ParseUnit(cm) should fail")
+	}
+	if u, err := ParseUnit("in"); err != nil || u != UNIT_INCH {
+		t.Errorf("ParseUnit(in) = %v, %v", u, err)
+	}
+}
@@ -0,0 +1,30 @@
+package models
+
+import "testing"
+
+func TestUserHasLevel(t *testing.T) {
+	cases := []struct {
+		usertype, level byte
+		want            bool
+	}{
+		{0, USER_NORMAL, false},
+		{USER_NORMAL, USER_NORMAL, true},
+		{USER_NORMAL, USER_ACCOUNT_ADMIN, false},
+		{USER_NORMAL, USER_SYSTEM_ADMIN, false},
+		{USER_ACCOUNT_ADMIN, USER_NORMAL, true},
+		{USER_ACCOUNT_ADMIN, USER_ACCOUNT_ADMIN, true},
+		{USER_ACCOUNT_ADMIN, USER_SYSTEM_ADMIN, false},
+		{USER_NORMAL | USER_ACCOUNT_ADMIN, USER_SYSTEM_ADMIN, false},
+		{USER_SYSTEM_ADMIN, USER_NORMAL, true},
+		{USER_SYSTEM_ADMIN, USER_ACCOUNT_ADMIN, true},
+		{USER_SYSTEM_ADMIN, USER_SYSTEM_ADMIN, true},
+		{8, USER_NORMAL, false},
+		{8, USER_SYSTEM_ADMIN, false},
+		{USER_NORMAL, 0, false},
+	}
+	for _, c := range cases {
+		if got := (User{Type: c.usertype}).HasLevel(c.level); got != c.want {
+			t.Errorf("User{Type: %v}.HasLevel(%v) = %v, want %v", c.usertype, c.level, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+)
+
+// orderGeometry is the final shape of a customized frame, in millimetres.
+// It is what production, rendering and exports of an order work from.
+//
+// The design is scaled about its datum, the point on the centre line at
+// the height of the middle of the lens box, so that the lenses stay
+// centred on the same line whatever the scale.  The front is then moved up
+// by YPosition millimetres. The temples are mounted on the customized front,
+// so their separation and height follow it, but the temple contour itself
+// is not scaled since temple length doesn't depend on the size of the front.
+type orderGeometry struct {
+	Datum     geometry.Point `json:"datum"`
+	Scale     float64        `json:"scale"`
+	YPosition float64        `json:"y_position"`
+	Front     models.Front   `json:"front"`
+	Temple    models.Temple  `json:"temple"`
+
+	Measurements models.Measurements `json:"measurements"`
+}
+
+// designDatum is the point that designs are scaled about.
+func designDatum(front models.Front) geometry.Point {
+	lens := polyline(front.Lens, true)
+	if len(lens) == 0 {
+		return geometry.Point{}
+	}
+	min, max := boundsOf(lens)
+	return geometry.Point{0, (min[1] + max[1]) / 2}
+}
+
+// customizeDesign applies a scale and vertical position to a design, and
+// fits its bridge to a nose if it has a parametric bridge. A zero scale
+// means the design is not scaled, and a nil bridge keeps the design's.
+func customizeDesign(des models.Design, scale, yPos float64, bridge *models.Bridge) (geom orderGeometry, err error) {
+	if scale <= 0 {
+		scale = 1
+	}
+	datum := designDatum(des.Front)
+	transform := func(pt geometry.Point) geometry.Point {
+		return geometry.Point{
+			datum[0] + (pt[0]-datum[0])*scale,
+			datum[1] + (pt[1]-datum[1])*scale + yPos,
+		}
+	}
+
+	// B-splines are affine invariant, so transforming the control points
+	// transforms the curves exactly.
+	front := des.Front
+	front.FrontSide = transformSide(des.Front.FrontSide, transform)
+	if des.Front.Right != nil {
+		right := transformSide(*des.Front.Right, transform)
+		front.Right = &right
+	}
+	front.Engraving.Paths = make([]geometry.BSpline, len(des.Front.Engraving.Paths))
+	for i, path := range des.Front.Engraving.Paths {
+		front.Engraving.Paths[i] = transformSpline(path, transform)
+	}
+	if b := orderBridge(des.Front, bridge); b != nil {
+		if front, err = bridgeFront(front, *b, scale); err != nil {
+			return
+		}
+		front.Bridge = b
+	}
+
+	temple := des.Temple
+	hinge := transform(geometry.Point{temple.TempleSeparation.Millimetres() / 2, temple.TempleHeight.Millimetres()})
+	temple.TempleSeparation = models.LengthOf(hinge[0] * 2)
+	temple.TempleHeight = models.LengthOf(hinge[1])
+
+	return orderGeometry{datum, scale, yPos, front, temple, frameMeasurements(front, temple)}, nil
+}
+
+// transformSide transforms the curves of one side of a front.
+func transformSide(side models.FrontSide, transform func(geometry.Point) geometry.Point) models.FrontSide {
+	moved := models.FrontSide{
+		Outercurve: transformSpline(side.Outercurve, transform),
+		Lens:       transformSpline(side.Lens, transform),
+		Holes:      make([]geometry.BSpline, len(side.Holes)),
+	}
+	for i, hole := range side.Holes {
+		moved.Holes[i] = transformSpline(hole, transform)
+	}
+	return moved
+}
+
+func transformSpline(s geometry.BSpline, transform func(geometry.Point) geometry.Point) geometry.BSpline {
+	if s == nil {
+		return nil
+	}
+	out := make(geometry.BSpline, len(s))
+	for i, pt := range s {
+		out[i] = transform(pt)
+	}
+	return out
+}
+
+// orderDesignGeometry loads an order with its design and works out the
+// final geometry.  Archived designs are still found so that old orders can
+// be made.
+func orderDesignGeometry(id string) (order models.Order, geom orderGeometry, err error) {
+	if order, err = models.FindOrderById(id); err != nil {
+		return
+	}
+	des, err := models.FindDesignById(order.DesignId.Hex())
+	if err != nil {
+		return
+	}
+	var y float64
+	if order.YPosition != nil {
+		y = *order.YPosition
+	}
+	geom, err = customizeDesign(des, order.Scale, y, order.Bridge)
+	return
+}
+
+// getOrderGeometry returns the final customized geometry of an order.
+func getOrderGeometry(ctx context.Context) error {
+	_, geom, err := orderDesignGeometry(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, geom)
+}
+
+// getOrderRender renders the customized front of an order in its material,
+// or with ?part=temple its temples with their text.
+func getOrderRender(ctx context.Context) error {
+	log.Println("Getting order render")
+	order, geom, err := orderDesignGeometry(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, err.Error())
+	}
+	if ctx.QueryValue("part") == "temple" {
+		material, err := orderMaterial(order, "temple")
+		if err != nil {
+			return goweb.API.RespondWithError(ctx, 400, err.Error())
+		}
+		return renderTemples(ctx, "order-"+order.Id.Hex()+"-temples.png", geom.Temple,
+			orderTempleText(order, geom.Temple), material)
+	}
+	materialId := defaultMaterialId
+	if len(order.FrontMaterial) > 0 {
+		materialId = order.FrontMaterial.Hex()
+	}
+	return renderFront(ctx, "order-"+order.Id.Hex()+".png", geom.Front, materialId)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Controllers for the library of fronts and temples on the lego site
+type (
+	frontsController  struct{}
+	templesController struct{}
+)
+
+// How far a temple's designed mounting point can be from where a front
+// expects it and still fit, in 1/100 mm.
+const (
+	hingeSeparationTolerance = 200
+	hingeHeightTolerance     = 100
+)
+
+// assembleDesign builds a frame from a front and a temple.  The temples
+// are mounted where the front expects them.
+func assembleDesign(front models.FrontPart, temple models.TemplePart) models.Design {
+	des := models.Design{
+		Name:   fmt.Sprintf("%v / %v", front.Name, temple.Name),
+		Front:  front.Front,
+		Temple: temple.Temple,
+		Composition: &models.Composition{
+			FrontPart:  front.Id,
+			TemplePart: temple.Id,
+		},
+	}
+	des.Temple.TempleSeparation = front.HingeSeparation
+	des.Temple.TempleHeight = front.HingeHeight
+	return des
+}
+
+// partsCompatible checks whether a temple can be mounted on a front. It
+// returns the reasons it can't, or nothing if they fit together.
+func partsCompatible(front models.FrontPart, temple models.TemplePart) (problems []string) {
+	sep := int(front.HingeSeparation) - int(temple.Temple.TempleSeparation)
+	if sep < -hingeSeparationTolerance || sep > hingeSeparationTolerance {
+		problems = append(problems, fmt.Sprintf("temple separation differs from the front by %.2fmm", float64(sep)/100))
+	}
+	height := int(front.HingeHeight) - int(temple.Temple.TempleHeight)
+	if height < -hingeHeightTolerance || height > hingeHeightTolerance {
+		problems = append(problems, fmt.Sprintf("temple height differs from the front by %.2fmm", float64(height)/100))
+	}
+	for _, f := range validateDesign(assembleDesign(front, temple)) {
+		if f.Check == "hinge_fit" && f.Severity == models.FINDING_ERROR {
+			problems = append(problems, f.Message)
+		}
+	}
+	return
+}
+
+func containsId(ids []bson.ObjectId, id bson.ObjectId) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// composeFrame assembles a frame from a front and temple in the library
+// with the chosen materials.  Incompatible pairings are rejected with the
+// reasons they don't fit.  The assembled design is checked and stored as a
+// draft, which isn't listed in the catalogue but can be ordered while its
+// parts are published, and is reused if the same parts are chosen again,
+// rebuilt first if either part has been edited since.
+func composeFrame(ctx context.Context) error {
+	if !requireAuth(models.USER_NORMAL, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	var req struct {
+		FrontId        string        `json:"front_id"`
+		TempleId       string        `json:"temple_id"`
+		FrontMaterial  bson.ObjectId `json:"front_material_id,omitempty"`
+		TempleMaterial bson.ObjectId `json:"temple_material_id,omitempty"`
+	}
+	data, err := ctx.RequestBody()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+
+	at, preview := catalogueView(ctx)
+	front, err := models.FindFrontPartById(req.FrontId)
+	if err != nil || (!preview && !front.IsPublishedAt(at)) {
+		return goweb.API.RespondWithError(ctx, 404, "front not found")
+	}
+	temple, err := models.FindTemplePartById(req.TempleId)
+	if err != nil || (!preview && !temple.IsPublishedAt(at)) {
+		return goweb.API.RespondWithError(ctx, 404, "temple not found")
+	}
+	if problems := partsCompatible(front, temple); len(problems) > 0 {
+		log.Printf("Rejecting composition of %v and %v: %v", front.Name, temple.Name, problems)
+		return goweb.API.Respond(ctx, 409, nil, problems)
+	}
+	if len(req.FrontMaterial) > 0 && !containsId(front.Front.Materials, req.FrontMaterial) {
+		return goweb.API.RespondWithError(ctx, 400, "material is not available for this front")
+	}
+	if len(req.TempleMaterial) > 0 && !containsId(temple.Temple.Materials, req.TempleMaterial) {
+		return goweb.API.RespondWithError(ctx, 400, "material is not available for this temple")
+	}
+
+	status := 200
+	des, err := models.FindComposedDesign(front.Id, temple.Id)
+	if err == mgo.ErrNotFound {
+		status = 201
+	} else if err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	if status == 201 || composedDesignStale(des, front, temple) {
+		composed := assembleDesign(front, temple)
+		composed.Designer = ctx.Data()["user"].(models.User).Id
+		composed.Updated = time.Now()
+		if err = checkDesign(&composed); err != nil {
+			return goweb.API.RespondWithError(ctx, 400, err.Error())
+		}
+		if composed.HasErrors() {
+			return goweb.API.Respond(ctx, 409, composed.Findings, []string{"composed frame has geometry errors"})
+		}
+		if status == 201 {
+			err = models.InsertDesign(&composed)
+		} else {
+			// A part has been edited since the design was composed, so the
+			// design is rebuilt from the parts as its next revision
+			composed.Id, composed.Designer, composed.Lifecycle = des.Id, des.Designer, des.Lifecycle
+			err = models.UpdateDesignRevision(des, &composed)
+		}
+		if err != nil {
+			return goweb.API.RespondWithError(ctx, 500, err.Error())
+		}
+		des = composed
+	}
+
+	type composeResponse struct {
+		Design         models.Design `json:"design"`
+		FrontMaterial  bson.ObjectId `json:"front_material_id,omitempty"`
+		TempleMaterial bson.ObjectId `json:"temple_material_id,omitempty"`
+	}
+	return goweb.API.WriteResponseObject(ctx, status, composeResponse{des, req.FrontMaterial, req.TempleMaterial})
+}
+
+// composedDesignStale is true if the front or temple a design was composed
+// from has been edited since the design was.
+func composedDesignStale(des models.Design, front models.FrontPart, temple models.TemplePart) bool {
+	return front.Updated.After(des.Updated) || temple.Updated.After(des.Updated)
+}
+
+// composedPartsPublished is true if the parts a design was composed from
+// are still published at time t, or the design wasn't composed.
+func composedPartsPublished(des models.Design, t time.Time) bool {
+	if des.Composition == nil {
+		return true
+	}
+	front, err := models.FindFrontPartById(des.Composition.FrontPart.Hex())
+	if err != nil || !front.IsPublishedAt(t) {
+		return false
+	}
+	temple, err := models.FindTemplePartById(des.Composition.TemplePart.Hex())
+	return err == nil && temple.IsPublishedAt(t)
+}
+
+// compatibleTemples lists the published temples that fit a front.
+func compatibleTemples(ctx context.Context) error {
+	at, preview := catalogueView(ctx)
+	front, err := models.FindFrontPartById(ctx.PathValue("id"))
+	if err != nil || (!preview && !front.IsPublishedAt(at)) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	temples, err := models.GetTempleParts(!preview, at)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	compatible := []models.TemplePart{}
+	for _, temple := range temples {
+		if len(partsCompatible(front, temple)) == 0 {
+			compatible = append(compatible, temple)
+		}
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, compatible)
+}
+
+// extractDesignParts adds the front and temple of a design to the library.
+func extractDesignParts(ctx context.Context) error {
+	des, err := models.FindDesignById(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if !canEditDesign(des, ctx) {
+		return goweb.API.RespondWithError(ctx, 403, "Forbidden")
+	}
+	front, temple, err := models.ExtractDesignParts(des)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	type partsResponse struct {
+		Front  models.FrontPart  `json:"front"`
+		Temple models.TemplePart `json:"temple"`
+	}
+	return goweb.API.WriteResponseObject(ctx, 201, partsResponse{front, temple})
+}
+
+// Fronts controller
+func (f *frontsController) ReadMany(ctx context.Context) error {
+	at, preview := catalogueView(ctx)
+	parts, err := models.GetFrontParts(!preview, at)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, parts)
+}
+
+func (f *frontsController) Read(id string, ctx context.Context) error {
+	part, err := models.FindFrontPartById(id)
+	if err != nil || (part.StatusAt(time.Now()) == models.PUBLISH_DRAFT && !isOwnerOrAdmin(part.Designer, ctx)) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, part)
+}
+
+func (f *frontsController) Create(ctx context.Context) error {
+	if !requireAuth(models.USER_NORMAL, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	var part models.FrontPart
+	data, err := ctx.RequestBody()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if err := json.Unmarshal(data, &part); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	part.Designer = ctx.Data()["user"].(models.User).Id
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		part.Lifecycle = models.Lifecycle{}
+	}
+	if err := models.CreateFrontPart(&part); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 201, part)
+}
+
+// Update applies the fields present in the request body to the front.
+func (f *frontsController) Update(id string, ctx context.Context) error {
+	existing, err := models.FindFrontPartById(id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if !isOwnerOrAdmin(existing.Designer, ctx) {
+		return goweb.API.RespondWithError(ctx, 403, "Forbidden")
+	}
+	data, err := ctx.RequestBody()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	part := existing
+	if err := json.Unmarshal(data, &part); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	part.Id, part.Designer, part.SourceDesign = existing.Id, existing.Designer, existing.SourceDesign
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		part.Lifecycle = existing.Lifecycle
+	}
+	if err := models.UpdateFrontPart(&part); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, part)
+}
+
+// Delete removes a front from the library. Designs already composed from
+// it keep their own copy of the geometry.
+func (f *frontsController) Delete(id string, ctx context.Context) error {
+	part, err := models.FindFrontPartById(id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if !isOwnerOrAdmin(part.Designer, ctx) {
+		return goweb.API.RespondWithError(ctx, 403, "Forbidden")
+	}
+	if err := models.DeleteFrontPart(part.Id); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	return goweb.Respond.WithStatus(ctx, 200)
+}
+
+// Temples controller
+func (t *templesController) ReadMany(ctx context.Context) error {
+	at, preview := catalogueView(ctx)
+	parts, err := models.GetTempleParts(!preview, at)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, parts)
+}
+
+func (t *templesController) Read(id string, ctx context.Context) error {
+	part, err := models.FindTemplePartById(id)
+	if err != nil || (part.StatusAt(time.Now()) == models.PUBLISH_DRAFT && !isOwnerOrAdmin(part.Designer, ctx)) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, part)
+}
+
+func (t *templesController) Create(ctx context.Context) error {
+	if !requireAuth(models.USER_NORMAL, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	var part models.TemplePart
+	data, err := ctx.RequestBody()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if err := json.Unmarshal(data, &part); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	part.Designer = ctx.Data()["user"].(models.User).Id
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		part.Lifecycle = models.Lifecycle{}
+	}
+	if err := models.CreateTemplePart(&part); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 201, part)
+}
+
+// Update applies the fields present in the request body to the temple.
+func (t *templesController) Update(id string, ctx context.Context) error {
+	existing, err := models.FindTemplePartById(id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if !isOwnerOrAdmin(existing.Designer, ctx) {
+		return goweb.API.RespondWithError(ctx, 403, "Forbidden")
+	}
+	data, err := ctx.RequestBody()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	part := existing
+	if err := json.Unmarshal(data, &part); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	part.Id, part.Designer, part.SourceDesign = existing.Id, existing.Designer, existing.SourceDesign
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		part.Lifecycle = existing.Lifecycle
+	}
+	if err := models.UpdateTemplePart(&part); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, part)
+}
+
+// Delete removes a temple from the library. Designs already composed from
+// it keep their own copy of the geometry.
+func (t *templesController) Delete(id string, ctx context.Context) error {
+	part, err := models.FindTemplePartById(id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if !isOwnerOrAdmin(part.Designer, ctx) {
+		return goweb.API.RespondWithError(ctx, 403, "Forbidden")
+	}
+	if err := models.DeleteTemplePart(part.Id); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	return goweb.Respond.WithStatus(ctx, 200)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/guildeyewear/legoserver/models"
+)
+
+func TestComposedDesignStale(t *testing.T) {
+	composed := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	before, after := composed.Add(-time.Hour), composed.Add(time.Hour)
+	cases := []struct {
+		front, temple time.Time
+		want          bool
+	}{
+		{before, before, false},
+		{composed, composed, false},
+		{after, before, true},
+		{before, after, true},
+	}
+	for _, c := range cases {
+		des := models.Design{Updated: composed}
+		front, temple := models.FrontPart{Updated: c.front}, models.TemplePart{Updated: c.temple}
+		if got := composedDesignStale(des, front, temple); got != c.want {
+			t.Errorf("parts updated %v and %v: stale = %v, want %v", c.front, c.temple, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"io"
+)
+
+// writePdf writes the images as the pages of a PDF document, each page
+// being widthPt by heightPt points.  The images are embedded as deflated
+// RGB data, composited onto white, so that no external tools are needed.
+func writePdf(w io.Writer, pages []image.Image, widthPt, heightPt float64) error {
+	var buf bytes.Buffer
+	var offsets []int
+	beginObj := func() int {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n", len(offsets))
+		return len(offsets)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	beginObj()
+	buf.WriteString("<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+
+	// Each page uses three objects: the page, its content and its image
+	kids := ""
+	for i := range pages {
+		kids += fmt.Sprintf("%d 0 R ", 3+3*i)
+	}
+	beginObj()
+	fmt.Fprintf(&buf, "<< /Type /Pages /Kids [%v] /Count %d >>\nendobj\n", kids, len(pages))
+
+	for _, page := range pages {
+		pageObj := beginObj()
+		fmt.Fprintf(&buf, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>\nendobj\n",
+			widthPt, heightPt, pageObj+2, pageObj+1)
+
+		content := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", widthPt, heightPt)
+		beginObj()
+		fmt.Fprintf(&buf, "<< /Length %d >>\nstream\n%v\nendstream\nendobj\n", len(content)+1, content)
+
+		data, err := deflateRGB(page)
+		if err != nil {
+			return err
+		}
+		bounds := page.Bounds()
+		beginObj()
+		fmt.Fprintf(&buf, "<< /Type /XObject /Subtype /Image /Width %d /Height %d "+
+			"/ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode /Length %d >>\nstream\n",
+			bounds.Dx(), bounds.Dy(), len(data))
+		buf.Write(data)
+		buf.WriteString("\nendstream\nendobj\n")
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// deflateRGB compresses the pixels of an image as 8 bit RGB triplets,
+// blending any transparency onto a white background.
+func deflateRGB(im image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	bounds := im.Bounds()
+	row := make([]byte, 3*bounds.Dx())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := im.At(x, y).RGBA()
+			white := 0xffff - a
+			i := 3 * (x - bounds.Min.X)
+			row[i] = uint8((r + white) >> 8)
+			row[i+1] = uint8((g + white) >> 8)
+			row[i+2] = uint8((b + white) >> 8)
+		}
+		if _, err := zw.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// reviewLocked is true if a design can't be edited by the logged in user
+// because it is being reviewed or has been approved.  System admins can
+// still edit it.
+func reviewLocked(des models.Design, ctx context.Context) bool {
+	state := des.ReviewState()
+	return (state == models.REVIEW_SUBMITTED || state == models.REVIEW_APPROVED) &&
+		!requireAuth(models.USER_SYSTEM_ADMIN, ctx)
+}
+
+// reviewLockedError explains why a design can't be edited.
+func reviewLockedError(des models.Design) string {
+	if des.ReviewState() == models.REVIEW_APPROVED {
+		return fmt.Sprintf("design %v is approved and can only be changed by a system admin", des.Name)
+	}
+	return fmt.Sprintf("design %v is being reviewed and can't be changed until it has been", des.Name)
+}
+
+// submitForReview submits a design for review by the system admins, for
+// the collections it should be in.  Without collections it is submitted
+// for the collections it was submitted for before.  Designs with
+// geometry errors can't be submitted.
+func submitForReview(des *models.Design, user string, collections []bson.ObjectId, comment string) error {
+	from := des.ReviewState()
+	state, err := models.NextReviewState(from, models.DECISION_SUBMIT)
+	if err != nil {
+		return err
+	}
+	if des.HasErrors() {
+		return errors.New("design has geometry errors, fix them before submitting it")
+	}
+	if len(collections) == 0 && des.Review != nil {
+		collections = des.Review.Collections
+	}
+	des.Review = &models.Review{State: state, Revision: des.Revision, Collections: collections, Updated: time.Now()}
+	if err := models.UpdateDesign(des); err != nil {
+		return err
+	}
+	if err := recordReview(*des, user, from, comment); err != nil {
+		return err
+	}
+	admins, err := models.GetSystemAdmins()
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(admins))
+	for i, admin := range admins {
+		ids[i] = admin.Id
+	}
+	return models.Notify(ids, des.Id, fmt.Sprintf("%v submitted design %v for review", user, des.Name))
+}
+
+// approveIntoCollections approves a design that a system admin is adding to
+// collections themselves, recording the approval, so that it doesn't
+// skip the review that designers' designs go through.
+func approveIntoCollections(des *models.Design, user string, collections []bson.ObjectId, comment string) error {
+	if des.HasErrors() {
+		return errors.New("design has geometry errors and can't be approved")
+	}
+	from := des.ReviewState()
+	des.Review = &models.Review{State: models.REVIEW_APPROVED, Revision: des.Revision, Collections: collections, Updated: time.Now()}
+	if err := models.UpdateDesign(des); err != nil {
+		return err
+	}
+	if err := recordReview(*des, user, from, comment); err != nil {
+		return err
+	}
+	for _, id := range collections {
+		coll, err := models.FindCollection(id.Hex())
+		if err == nil {
+			err = models.AddDesignToCollection(&coll, des.Id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordReview records a step of a design's review, which has moved to
+// its current state from the state it was in.
+func recordReview(des models.Design, user, from, comment string) error {
+	event := models.ReviewEvent{DesignId: des.Id, Revision: des.Revision, User: user,
+		State: des.ReviewState(), Comment: comment}
+	if from != event.State {
+		event.From = from
+	}
+	return models.InsertReviewEvent(&event)
+}
+
+// submitDesign submits a design for review, for its designer.  The body
+// can give the collections, by id or slug, that the design should be
+// added to once it is approved, and a comment for the reviewers:
+// {"collections": ["summer"], "comment": "..."}.
+func submitDesign(ctx context.Context) error {
+	if !requireAuth(models.USER_NORMAL, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	des, err := models.FindDesignById(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if !canEditDesign(des, ctx) {
+		return goweb.API.RespondWithError(ctx, 403, "Forbidden")
+	}
+	var request struct {
+		Collections []string `json:"collections"`
+		Comment     string   `json:"comment"`
+	}
+	if data, err := ctx.RequestBody(); err == nil && len(data) > 0 {
+		if err := json.Unmarshal(data, &request); err != nil {
+			return goweb.API.RespondWithError(ctx, 400, err.Error())
+		}
+	}
+	var collections []bson.ObjectId
+	for _, c := range request.Collections {
+		coll, err := models.FindCollection(c)
+		if err != nil {
+			return goweb.API.RespondWithError(ctx, 400, "no collection "+c)
+		}
+		collections = append(collections, coll.Id)
+	}
+	user := ctx.Data()["user"].(models.User)
+	if err := submitForReview(&des, user.Id, collections, request.Comment); err != nil {
+		return goweb.API.RespondWithError(ctx, 409, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, des.Review)
+}
+
+// reviewDesign records a system admin's decision about a submitted design:
+// {"decision": "approve", "comment": "..."}.  Approving a design adds it to
+// the collections it was submitted for and publishes it, unless it is
+// scheduled to be published later.  Requesting changes needs a comment to
+// say what to change, and comments can be left on a design at any point
+// of its review.  The designer is notified of each decision.
+func reviewDesign(ctx context.Context) error {
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	des, err := models.FindDesignById(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	var request struct {
+		Decision string `json:"decision"`
+		Comment  string `json:"comment"`
+	}
+	data, err := ctx.RequestBody()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if err := json.Unmarshal(data, &request); err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if request.Decision != models.DECISION_APPROVE && len(request.Comment) == 0 {
+		return goweb.API.RespondWithError(ctx, 400, "a comment is needed to "+request.Decision)
+	}
+	from := des.ReviewState()
+	state, err := models.NextReviewState(from, request.Decision)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 409, err.Error())
+	}
+
+	message := fmt.Sprintf("comment on design %v: %v", des.Name, request.Comment)
+	if state != from {
+		review := *des.Review
+		review.State, review.Revision, review.Updated = state, des.Revision, time.Now()
+		des.Review = &review
+		message = fmt.Sprintf("changes were requested to design %v: %v", des.Name, request.Comment)
+	}
+	if request.Decision == models.DECISION_APPROVE {
+		if des.HasErrors() {
+			return goweb.API.RespondWithError(ctx, 409, "design has geometry errors and can't be approved")
+		}
+		if des.Status == models.PUBLISH_DRAFT && des.PublishAt == nil {
+			des.Status = models.PUBLISH_PUBLISHED
+		}
+		message = fmt.Sprintf("design %v was approved", des.Name)
+	}
+	if err := models.UpdateDesign(&des); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	if request.Decision == models.DECISION_APPROVE {
+		// Collections that have gone since the design was submitted are skipped
+		for _, id := range des.Review.Collections {
+			coll, err := models.FindCollection(id.Hex())
+			if err == nil {
+				err = models.AddDesignToCollection(&coll, des.Id)
+			}
+			if err != nil && err != mgo.ErrNotFound {
+				return goweb.API.RespondWithError(ctx, 500, err.Error())
+			}
+		}
+	}
+	user := ctx.Data()["user"].(models.User)
+	if err := recordReview(des, user.Id, from, request.Comment); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	if err := models.Notify([]string{des.Designer}, des.Id, message); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, des.Review)
+}
+
+// getDesignReview gives the review state and history of a design, for its
+// designer and system admins.
+func getDesignReview(ctx context.Context) error {
+	des, err := models.FindDesignById(ctx.PathValue("id"))
+	if err != nil || !canEditDesign(des, ctx) {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	history, err := models.GetReviewEvents(des.Id)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	if history == nil {
+		history = []models.ReviewEvent{}
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, map[string]interface{}{"review": des.Review, "history": history})
+}
+
+// getReviewQueue lists the designs waiting for review, for system admins.
+func getReviewQueue(ctx context.Context) error {
+	if !requireAuth(models.USER_SYSTEM_ADMIN, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	designs, err := models.GetSubmittedDesigns()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	if designs == nil {
+		designs = []models.Design{}
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, designs)
+}
+
+// getNotifications lists the logged in user's notifications, newest
+// first, or only the unread ones with ?unread=true.
+func getNotifications(ctx context.Context) error {
+	if !requireAuth(models.USER_NORMAL, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	user := ctx.Data()["user"].(models.User)
+	ns, err := models.GetNotifications(user.Id, ctx.QueryValue("unread") == "true")
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	if ns == nil {
+		ns = []models.Notification{}
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, ns)
+}
+
+// readNotification marks one of the logged in user's notifications as
+// read.
+func readNotification(ctx context.Context) error {
+	if !requireAuth(models.USER_NORMAL, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	user := ctx.Data()["user"].(models.User)
+	if err := models.MarkNotificationRead(user.Id, ctx.PathValue("id")); err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	return goweb.Respond.WithStatus(ctx, 200)
+}
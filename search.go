@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// dimensionBucket is the width of the buckets that dimension facets are
+// counted in, in millimetres.
+const dimensionBucket = 2.0
+
+// searchDimensions are the computed dimensions designs can be filtered on,
+// by their query parameter prefix.  Each can be limited with _min and _max,
+// e.g. ?lens_width_min=48&lens_width_max=52.
+var searchDimensions = []struct {
+	name  string
+	value func(models.Measurements) models.Length
+}{
+	{"lens_width", func(m models.Measurements) models.Length { return m.EyeSize }},
+	{"lens_height", func(m models.Measurements) models.Length { return m.BMeasurement }},
+	{"bridge", func(m models.Measurements) models.Length { return m.Bridge }},
+	{"total_width", func(m models.Measurements) models.Length { return m.TotalWidth }},
+	{"temple_length", func(m models.Measurements) models.Length { return m.TempleLength }},
+	{"effective_diameter", func(m models.Measurements) models.Length { return m.EffectiveDiameter }},
+}
+
+// facetCount is how many of the found designs have a value.
+type facetCount struct {
+	Value string `json:"value"`
+	Label string `json:"label,omitempty"`
+	Count int    `json:"count"`
+}
+
+// rangeCount is how many of the found designs have a dimension in
+// [Min, Max).
+type rangeCount struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+type searchFacets struct {
+	Collections []facetCount            `json:"collections"`
+	Designers   []facetCount            `json:"designers"`
+	Tags        []facetCount            `json:"tags"`
+	Attributes  map[string][]facetCount `json:"attributes"`
+	Dimensions  map[string][]rangeCount `json:"dimensions"`
+}
+
+type searchResponse struct {
+	Total   int             `json:"total"`
+	Designs []models.Design `json:"designs"`
+	Facets  searchFacets    `json:"facets"`
+}
+
+// designMeasurements returns the stored measurements of a design, or
+// measures it if it was saved before designs were measured.
+func designMeasurements(des models.Design) models.Measurements {
+	if des.Measurements.EyeSize > 0 {
+		return des.Measurements
+	}
+	return frameMeasurements(des.Front, des.Temple)
+}
+
+// searchable is a design with everything it can be searched on.
+type searchable struct {
+	design      models.Design
+	designer    string
+	collections []string
+	dims        models.Measurements
+}
+
+// matches is true if every word of the query is in the design's name,
+// designer, collections or tags.
+func (s searchable) matches(query string) bool {
+	text := strings.ToLower(strings.Join(append(append([]string{s.design.Name, s.designer},
+		s.collections...), s.design.Tags...), " "))
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// unnamedDesigner is the label of designers who haven't given their name.
+const unnamedDesigner = "Unnamed designer"
+
+// designerKey identifies a designer in search facets and ?designer=
+// without giving away their user id, which is their email address.
+func designerKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// designerNames looks up the names the designers of designs are shown by,
+// by user id, with one query.  Designers without a name are left out.
+func designerNames(designs []models.Design) (map[string]string, error) {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, des := range designs {
+		if len(des.Designer) > 0 && !seen[des.Designer] {
+			seen[des.Designer] = true
+			ids = append(ids, des.Designer)
+		}
+	}
+	names := make(map[string]string)
+	users, err := models.FindUsersByIds(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if full := strings.TrimSpace(u.Person.Firstname + " " + u.Person.Familyname); len(full) > 0 {
+			names[u.Id] = full
+		}
+	}
+	return names, nil
+}
+
+// countFacet turns counts of values into facets, most common first.
+func countFacet(counts map[string]int, labels map[string]string) []facetCount {
+	facets := make([]facetCount, 0, len(counts))
+	for value, n := range counts {
+		facets = append(facets, facetCount{value, labels[value], n})
+	}
+	sort.Sort(byCount(facets))
+	return facets
+}
+
+type byCount []facetCount
+
+func (f byCount) Len() int      { return len(f) }
+func (f byCount) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f byCount) Less(i, j int) bool {
+	return f[i].Count > f[j].Count || (f[i].Count == f[j].Count && f[i].Value < f[j].Value)
+}
+
+// searchDesigns finds designs by ?q= text, ?designer= (the value of a
+// designer facet), ?collection= (id or slug) and ?tag=, by attribute as in
+// attributeFilter, and by ranges of their dimensions.  Facet counts of
+// the designs found let the configurator offer further filters.
+func searchDesigns(ctx context.Context) error {
+	at, preview := catalogueView(ctx)
+	var designs []models.Design
+	var err error
+	if preview {
+		designs, err = models.GetAllDesigns()
+	} else {
+		designs, err = models.GetPublishedDesigns(at)
+	}
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	collections, err := models.GetAllCollections()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	names, err := designerNames(designs)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	collNames := make(map[bson.ObjectId]models.Collection)
+	for _, c := range collections {
+		if preview || c.IsPublishedAt(at) {
+			collNames[c.Id] = c
+		}
+	}
+
+	query := ctx.QueryValue("q")
+	designer := ctx.QueryValue("designer")
+	collection := ctx.QueryValue("collection")
+	tag := strings.ToLower(ctx.QueryValue("tag"))
+	wanted, err := attributeFilter(ctx)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	vocabulary, err := models.GetAttributes("")
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	attrLabels := make(map[string]map[string]string)
+	attrCounts := make(map[string]map[string]int)
+	for _, kind := range models.AttributeKinds {
+		attrLabels[kind] = make(map[string]string)
+		attrCounts[kind] = make(map[string]int)
+	}
+	for _, a := range vocabulary {
+		attrLabels[a.Kind][a.Slug] = a.Name
+	}
+	limits := make(map[string][2]float64)
+	for _, dim := range searchDimensions {
+		limit := [2]float64{math.Inf(-1), math.Inf(1)}
+		for i, suffix := range []string{"_min", "_max"} {
+			if v := ctx.QueryValue(dim.name + suffix); len(v) > 0 {
+				if limit[i], err = strconv.ParseFloat(v, 64); err != nil {
+					return goweb.API.RespondWithError(ctx, 400, dim.name+suffix+" must be a number")
+				}
+			}
+		}
+		limits[dim.name] = limit
+	}
+
+	response := searchResponse{Designs: []models.Design{}}
+	designerLabels := make(map[string]string)
+	collectionLabels := make(map[string]string)
+	collCounts := make(map[string]int)
+	designerCounts := make(map[string]int)
+	tagCounts := make(map[string]int)
+	dimCounts := make(map[string]map[float64]int)
+
+designs:
+	for _, des := range models.FilterDesignsByAttributes(designs, wanted) {
+		s := searchable{design: des, designer: names[des.Designer], dims: designMeasurements(des)}
+		key := designerKey(des.Designer)
+		inCollection := len(collection) == 0
+		for _, id := range des.Collections {
+			if c, ok := collNames[id]; ok {
+				s.collections = append(s.collections, c.Name)
+				inCollection = inCollection || collection == id.Hex() || collection == c.Slug
+			}
+		}
+		hasTag := len(tag) == 0
+		for _, t := range des.Tags {
+			hasTag = hasTag || strings.ToLower(t) == tag
+		}
+		if !inCollection || !hasTag || (len(designer) > 0 && key != designer) || !s.matches(query) {
+			continue
+		}
+		for _, dim := range searchDimensions {
+			v, limit := dim.value(s.dims).Millimetres(), limits[dim.name]
+			if v < limit[0] || v > limit[1] {
+				continue designs
+			}
+		}
+
+		response.Designs = append(response.Designs, des)
+		designerCounts[key]++
+		designerLabels[key] = s.designer
+		if len(s.designer) == 0 {
+			designerLabels[key] = unnamedDesigner
+		}
+		for _, id := range des.Collections {
+			if c, ok := collNames[id]; ok {
+				collCounts[c.Slug]++
+				collectionLabels[c.Slug] = c.Name
+			}
+		}
+		for _, t := range des.Tags {
+			tagCounts[strings.ToLower(t)]++
+		}
+		for kind, slugs := range des.Attributes {
+			if counts, ok := attrCounts[kind]; ok {
+				for _, slug := range slugs {
+					counts[slug]++
+				}
+			}
+		}
+		for _, dim := range searchDimensions {
+			if dimCounts[dim.name] == nil {
+				dimCounts[dim.name] = make(map[float64]int)
+			}
+			dimCounts[dim.name][math.Floor(dim.value(s.dims).Millimetres()/dimensionBucket)*dimensionBucket]++
+		}
+	}
+
+	response.Total = len(response.Designs)
+	response.Facets = searchFacets{
+		Collections: countFacet(collCounts, collectionLabels),
+		Designers:   countFacet(designerCounts, designerLabels),
+		Tags:        countFacet(tagCounts, nil),
+		Attributes:  make(map[string][]facetCount),
+		Dimensions:  make(map[string][]rangeCount),
+	}
+	for _, kind := range models.AttributeKinds {
+		response.Facets.Attributes[kind] = countFacet(attrCounts[kind], attrLabels[kind])
+	}
+	for _, dim := range searchDimensions {
+		buckets := []rangeCount{}
+		for min, n := range dimCounts[dim.name] {
+			buckets = append(buckets, rangeCount{min, min + dimensionBucket, n})
+		}
+		sort.Sort(byMin(buckets))
+		response.Facets.Dimensions[dim.name] = buckets
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, response)
+}
+
+type byMin []rangeCount
+
+func (r byMin) Len() int           { return len(r) }
+func (r byMin) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byMin) Less(i, j int) bool { return r[i].Min < r[j].Min }
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+)
+
+// Designers draw frames in Illustrator and export them as SVG. The importer
+// looks for shapes in layers (or with ids) named:
+//
+//	outercurve  the left half of the front, ending on the centre line
+//	lens        the left lens
+//	hole...     any through-holes in the left side of the front
+//	engraving...engraving paths on the front
+//	temple      the temple contour
+//	hinge       a small circle at the centre of the left hinge
+//
+// Illustrator escapes underscores in layer names as _x5F_, and Inkscape
+// keeps layer names in inkscape:label; both are understood.
+
+// svgFitTolerance is how far the imported b-splines can stray from the
+// drawn paths, in millimetres, before the designer is warned.
+const svgFitTolerance = 0.1
+
+// cubic is a cubic bezier section of a drawn path.
+type cubic [4]geometry.Point
+
+// svgShape is one drawn subpath in millimetres, tagged with the layer it
+// was found in.
+type svgShape struct {
+	layer  string
+	closed bool
+	curves []cubic
+}
+
+// svgElement is a generic SVG element, decoded with all of its attributes
+// and children so that groups can be walked recursively.
+type svgElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr   `xml:",any,attr"`
+	Children []svgElement `xml:",any"`
+}
+
+func (e svgElement) attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// svgImport holds the state of converting one SVG document.
+type svgImport struct {
+	shapes   []svgShape
+	problems []models.Finding
+}
+
+func (si *svgImport) problem(severity, part, format string, args ...interface{}) {
+	si.problems = append(si.problems, models.Finding{
+		Check:    "svg_import",
+		Severity: severity,
+		Part:     part,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// layerName normalizes a layer name or id so that "Outer_x5F_Curve",
+// "outer-curve" and "outercurve" all match.
+func layerName(name string) string {
+	name = strings.Replace(strings.ToLower(name), "_x5f_", "_", -1)
+	var out []rune
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			out = append(out, r)
+		}
+	}
+	return string(out)
+}
+
+// knownLayer returns the importer's name for a layer, or "" if it isn't one
+// the importer understands.
+func knownLayer(name string) string {
+	name = layerName(name)
+	for _, prefix := range []string{"outercurve", "lens", "hole", "engraving", "temple", "hinge"} {
+		if strings.HasPrefix(name, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// svgUnits are the sizes of the SVG units in millimetres.  Unitless
+// lengths are user units, which SVG makes the same as px, 96 to the inch.
+// Illustrator writes px at 72 to the inch, so it is asked for mm instead.
+var svgUnits = map[string]float64{
+	"mm": 1,
+	"cm": 10,
+	"in": 25.4,
+	"pt": 25.4 / 72,
+	"pc": 25.4 / 6,
+	"px": 25.4 / 96,
+	"":   25.4 / 96,
+}
+
+var lengthRe = regexp.MustCompile(`^\s*([-+]?[0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)\s*([a-z%]*)\s*$`)
+
+// documentScale works out the millimetres per user unit of the document
+// from its width and viewBox.
+func (si *svgImport) documentScale(root svgElement) float64 {
+	width := root.attr("width")
+	m := lengthRe.FindStringSubmatch(width)
+	if m == nil {
+		si.problem(models.FINDING_WARNING, "svg", "document has no width, assuming 96 units per inch")
+		return svgUnits[""]
+	}
+	unit, ok := svgUnits[m[2]]
+	if !ok {
+		si.problem(models.FINDING_ERROR, "svg", "document width %q uses unknown units", width)
+		return svgUnits[""]
+	}
+	if m[2] == "" || m[2] == "px" {
+		si.problem(models.FINDING_WARNING, "svg",
+			"document width %q has no physical units, assuming 96 units per inch; export in mm to be sure", width)
+	}
+	w, _ := strconv.ParseFloat(m[1], 64)
+	scale := unit
+	if vb := strings.Fields(strings.Replace(root.attr("viewBox"), ",", " ", -1)); len(vb) == 4 {
+		if vbw, err := strconv.ParseFloat(vb[2], 64); err == nil && vbw > 0 {
+			scale = w * unit / vbw
+		}
+	}
+	return scale
+}
+
+// affine is a 2D transform [a b c d e f] as in SVG's matrix().
+type affine [6]float64
+
+var identity = affine{1, 0, 0, 1, 0, 0}
+
+func (m affine) apply(pt geometry.Point) geometry.Point {
+	return geometry.Point{m[0]*pt[0] + m[2]*pt[1] + m[4], m[1]*pt[0] + m[3]*pt[1] + m[5]}
+}
+
+// then returns the transform that applies n and then m.
+func (m affine) then(n affine) affine {
+	return affine{
+		m[0]*n[0] + m[2]*n[1], m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3], m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4], m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+var transformRe = regexp.MustCompile(`(matrix|translate|scale|rotate)\s*\(([^)]*)\)`)
+
+func parseTransform(s string) affine {
+	m := identity
+	for _, t := range transformRe.FindAllStringSubmatch(s, -1) {
+		args := parseNumbers(t[2])
+		var n affine
+		switch {
+		case t[1] == "matrix" && len(args) == 6:
+			copy(n[:], args)
+		case t[1] == "translate" && len(args) >= 1:
+			n = affine{1, 0, 0, 1, args[0], 0}
+			if len(args) > 1 {
+				n[5] = args[1]
+			}
+		case t[1] == "scale" && len(args) >= 1:
+			n = affine{args[0], 0, 0, args[0], 0, 0}
+			if len(args) > 1 {
+				n[3] = args[1]
+			}
+		case t[1] == "rotate" && len(args) >= 1:
+			a := args[0] * math.Pi / 180
+			n = affine{math.Cos(a), math.Sin(a), -math.Sin(a), math.Cos(a), 0, 0}
+			if len(args) == 3 {
+				n = affine{1, 0, 0, 1, args[1], args[2]}.then(n).then(affine{1, 0, 0, 1, -args[1], -args[2]})
+			}
+		default:
+			continue
+		}
+		m = m.then(n)
+	}
+	return m
+}
+
+var numberRe = regexp.MustCompile(`[-+]?(?:[0-9]*\.[0-9]+|[0-9]+\.?)(?:[eE][-+]?[0-9]+)?`)
+
+func parseNumbers(s string) []float64 {
+	var nums []float64
+	for _, n := range numberRe.FindAllString(s, -1) {
+		if v, err := strconv.ParseFloat(n, 64); err == nil {
+			nums = append(nums, v)
+		}
+	}
+	return nums
+}
+
+// walk collects the shapes in an element and its children. Shapes outside
+// any known layer are ignored.
+func (si *svgImport) walk(e svgElement, m affine, layer string) {
+	m = m.then(parseTransform(e.attr("transform")))
+	for _, name := range []string{e.attr("label"), e.attr("id")} {
+		if l := knownLayer(name); len(l) > 0 {
+			layer = l
+			break
+		}
+	}
+
+	var paths []svgShape
+	switch e.XMLName.Local {
+	case "path":
+		paths = si.parsePath(e.attr("d"), layer)
+	case "polygon", "polyline":
+		pts := parseNumbers(e.attr("points"))
+		d := "M"
+		for i := 0; i+1 < len(pts); i += 2 {
+			d += fmt.Sprintf(" %g,%g", pts[i], pts[i+1])
+		}
+		if e.XMLName.Local == "polygon" {
+			d += " Z"
+		}
+		paths = si.parsePath(d, layer)
+	case "rect":
+		x, y := attrFloat(e, "x"), attrFloat(e, "y")
+		w, h := attrFloat(e, "width"), attrFloat(e, "height")
+		rx, ry := rectRadii(e, w, h)
+		if rx > 0 && ry > 0 {
+			paths = si.parsePath(fmt.Sprintf("M%g,%g H%g A%g,%g 0 0 1 %g,%g V%g A%g,%g 0 0 1 %g,%g H%g A%g,%g 0 0 1 %g,%g V%g A%g,%g 0 0 1 %g,%g Z",
+				x+rx, y, x+w-rx, rx, ry, x+w, y+ry, y+h-ry, rx, ry, x+w-rx, y+h,
+				x+rx, rx, ry, x, y+h-ry, y+ry, rx, ry, x+rx, y), layer)
+		} else {
+			paths = si.parsePath(fmt.Sprintf("M%g,%g H%g V%g H%g Z", x, y, x+w, y+h, x), layer)
+		}
+	case "circle", "ellipse":
+		cx, cy := attrFloat(e, "cx"), attrFloat(e, "cy")
+		rx, ry := attrFloat(e, "rx"), attrFloat(e, "ry")
+		if e.XMLName.Local == "circle" {
+			rx, ry = attrFloat(e, "r"), attrFloat(e, "r")
+		}
+		paths = []svgShape{ellipseShape(cx, cy, rx, ry, layer)}
+	}
+	for _, p := range paths {
+		if len(p.layer) == 0 || len(p.curves) == 0 {
+			continue
+		}
+		for i, c := range p.curves {
+			for j := range c {
+				p.curves[i][j] = m.apply(c[j])
+			}
+		}
+		si.shapes = append(si.shapes, p)
+	}
+	for _, child := range e.Children {
+		si.walk(child, m, layer)
+	}
+}
+
+func attrFloat(e svgElement, name string) float64 {
+	v, _ := strconv.ParseFloat(strings.TrimSpace(e.attr(name)), 64)
+	return v
+}
+
+// rectRadii returns the radii of the rounded corners of a rect.  As in
+// SVG, a radius that isn't given is the same as the other one, and they
+// are limited to half the width and height.
+func rectRadii(e svgElement, w, h float64) (rx, ry float64) {
+	rx, ry = attrFloat(e, "rx"), attrFloat(e, "ry")
+	if len(strings.TrimSpace(e.attr("rx"))) == 0 {
+		rx = ry
+	}
+	if len(strings.TrimSpace(e.attr("ry"))) == 0 {
+		ry = rx
+	}
+	return math.Min(rx, w/2), math.Min(ry, h/2)
+}
+
+// ellipseShape approximates an ellipse with four cubic beziers.
+func ellipseShape(cx, cy, rx, ry float64, layer string) svgShape {
+	const k = 0.5522847498 // 4/3 * (sqrt(2) - 1)
+	pt := func(x, y float64) geometry.Point { return geometry.Point{cx + x, cy + y} }
+	return svgShape{layer: layer, closed: true, curves: []cubic{
+		{pt(rx, 0), pt(rx, k*ry), pt(k*rx, ry), pt(0, ry)},
+		{pt(0, ry), pt(-k*rx, ry), pt(-rx, k*ry), pt(-rx, 0)},
+		{pt(-rx, 0), pt(-rx, -k*ry), pt(-k*rx, -ry), pt(0, -ry)},
+		{pt(0, -ry), pt(k*rx, -ry), pt(rx, -k*ry), pt(rx, 0)},
+	}}
+}
+
+var pathTokenRe = regexp.MustCompile(`[MmLlHhVvCcSsQqTtAaZz]|[-+]?(?:[0-9]*\.[0-9]+|[0-9]+\.?)(?:[eE][-+]?[0-9]+)?`)
+
+// parsePath converts SVG path data into cubic beziers, one shape per
+// subpath.  Lines, quadratic curves and arcs are raised to cubics.
+func (si *svgImport) parsePath(d, layer string) (shapes []svgShape) {
+	tokens := pathTokenRe.FindAllString(d, -1)
+	var cur, start, lastCtrl geometry.Point
+	var shape *svgShape
+	cmd := ""
+	i := 0
+	num := func() float64 {
+		if i >= len(tokens) {
+			return 0
+		}
+		v, _ := strconv.ParseFloat(tokens[i], 64)
+		i++
+		return v
+	}
+	// Arc flags are single digits, which can be run together with each
+	// other and the next number, as in "a5,5 0 011,1"
+	flag := func() bool {
+		if i >= len(tokens) {
+			return false
+		}
+		t := tokens[i]
+		if len(t) > 1 && (t[0] == '0' || t[0] == '1') && t[1] != '.' {
+			tokens[i] = t[1:]
+		} else {
+			i++
+		}
+		return t[0] == '1'
+	}
+	finish := func() {
+		if shape != nil && len(shape.curves) > 0 {
+			shapes = append(shapes, *shape)
+		}
+		shape = nil
+	}
+	line := func(to geometry.Point) {
+		if distance(cur, to) < 1e-9 {
+			return
+		}
+		shape.curves = append(shape.curves, cubic{cur,
+			geometry.Point{cur[0] + (to[0]-cur[0])/3, cur[1] + (to[1]-cur[1])/3},
+			geometry.Point{cur[0] + 2*(to[0]-cur[0])/3, cur[1] + 2*(to[1]-cur[1])/3}, to})
+		cur, lastCtrl = to, to
+	}
+
+	for i < len(tokens) {
+		if c := tokens[i]; len(c) == 1 && unicode.IsLetter(rune(c[0])) {
+			cmd = c
+			i++
+		} else if cmd == "" {
+			i++
+			continue
+		}
+		rel := strings.ToLower(cmd) == cmd
+		pt := func() geometry.Point {
+			x, y := num(), num()
+			if rel {
+				return geometry.Point{cur[0] + x, cur[1] + y}
+			}
+			return geometry.Point{x, y}
+		}
+		if shape == nil && strings.ToUpper(cmd) != "M" {
+			shape = &svgShape{layer: layer}
+			start = cur
+		}
+
+		switch strings.ToUpper(cmd) {
+		case "M":
+			finish()
+			cur = pt()
+			start, lastCtrl = cur, cur
+			shape = &svgShape{layer: layer}
+			// Further coordinate pairs are implicit line commands
+			if rel {
+				cmd = "l"
+			} else {
+				cmd = "L"
+			}
+		case "L":
+			line(pt())
+		case "H":
+			x := num()
+			if rel {
+				x += cur[0]
+			}
+			line(geometry.Point{x, cur[1]})
+		case "V":
+			y := num()
+			if rel {
+				y += cur[1]
+			}
+			line(geometry.Point{cur[0], y})
+		case "C":
+			c1, c2, to := pt(), pt(), pt()
+			shape.curves = append(shape.curves, cubic{cur, c1, c2, to})
+			cur, lastCtrl = to, c2
+		case "S":
+			c1 := geometry.Point{2*cur[0] - lastCtrl[0], 2*cur[1] - lastCtrl[1]}
+			c2, to := pt(), pt()
+			shape.curves = append(shape.curves, cubic{cur, c1, c2, to})
+			cur, lastCtrl = to, c2
+		case "Q", "T":
+			q := geometry.Point{2*cur[0] - lastCtrl[0], 2*cur[1] - lastCtrl[1]}
+			if strings.ToUpper(cmd) == "Q" {
+				q = pt()
+			}
+			to := pt()
+			shape.curves = append(shape.curves, cubic{cur,
+				geometry.Point{cur[0] + 2*(q[0]-cur[0])/3, cur[1] + 2*(q[1]-cur[1])/3},
+				geometry.Point{to[0] + 2*(q[0]-to[0])/3, to[1] + 2*(q[1]-to[1])/3}, to})
+			cur, lastCtrl = to, q
+		case "A":
+			rx, ry, rotation := num(), num(), num()
+			large, sweep := flag(), flag()
+			to := pt()
+			if distance(cur, to) < 1e-9 {
+				continue
+			}
+			if rx == 0 || ry == 0 {
+				line(to)
+				continue
+			}
+			shape.curves = append(shape.curves, arcCubics(cur, to, rx, ry, rotation, large, sweep)...)
+			cur, lastCtrl = to, to
+		case "Z":
+			if distance(cur, start) > 1e-9 {
+				line(start)
+			}
+			shape.closed = true
+			cur = start
+			finish()
+			cmd = ""
+		}
+	}
+	finish()
+	return
+}
+
+// arcCubics approximates an SVG elliptical arc from one point to another
+// with a cubic bezier for each quarter turn or less, converting it to its
+// centre as in the SVG implementation notes.
+func arcCubics(from, to geometry.Point, rx, ry, rotation float64, large, sweep bool) []cubic {
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	phi := rotation * math.Pi / 180
+	cos, sin := math.Cos(phi), math.Sin(phi)
+	dx, dy := (from[0]-to[0])/2, (from[1]-to[1])/2
+	x1, y1 := cos*dx+sin*dy, -sin*dx+cos*dy
+
+	// Radii too small to reach are scaled up until they just do
+	if l := x1*x1/(rx*rx) + y1*y1/(ry*ry); l > 1 {
+		rx, ry = rx*math.Sqrt(l), ry*math.Sqrt(l)
+	}
+	num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	den := rx*rx*y1*y1 + ry*ry*x1*x1
+	co := math.Sqrt(math.Max(0, num/den))
+	if large == sweep {
+		co = -co
+	}
+	cx1, cy1 := co*rx*y1/ry, -co*ry*x1/rx
+	cx := cos*cx1 - sin*cy1 + (from[0]+to[0])/2
+	cy := sin*cx1 + cos*cy1 + (from[1]+to[1])/2
+
+	start := math.Atan2((y1-cy1)/ry, (x1-cx1)/rx)
+	sweepAngle := math.Atan2((-y1-cy1)/ry, (-x1-cx1)/rx) - start
+	if sweep && sweepAngle < 0 {
+		sweepAngle += 2 * math.Pi
+	} else if !sweep && sweepAngle > 0 {
+		sweepAngle -= 2 * math.Pi
+	}
+
+	point := func(a float64) geometry.Point {
+		x, y := rx*math.Cos(a), ry*math.Sin(a)
+		return geometry.Point{cx + cos*x - sin*y, cy + sin*x + cos*y}
+	}
+	tangent := func(a float64) geometry.Point {
+		x, y := -rx*math.Sin(a), ry*math.Cos(a)
+		return geometry.Point{cos*x - sin*y, sin*x + cos*y}
+	}
+	n := int(math.Ceil(math.Abs(sweepAngle)/(math.Pi/2) - 1e-9))
+	step := sweepAngle / float64(n)
+	k := 4.0 / 3 * math.Tan(step/4)
+	curves := make([]cubic, n)
+	for j := range curves {
+		a, b := start+float64(j)*step, start+float64(j+1)*step
+		p, q := point(a), point(b)
+		ta, tb := tangent(a), tangent(b)
+		curves[j] = cubic{p, {p[0] + k*ta[0], p[1] + k*ta[1]}, {q[0] - k*tb[0], q[1] - k*tb[1]}, q}
+	}
+	// End exactly where the path says, not where rounding puts it
+	curves[0][0], curves[n-1][3] = from, to
+	return curves
+}
+
+// bsplineFromBeziers finds the control points of the uniform cubic b-spline
+// that the drawn beziers trace.  Each bezier section determines two of
+// the control points; where neighbouring sections disagree because the
+// drawing isn't smooth the estimates are averaged.  Open curves start and
+// end on their first and last control points.
+func bsplineFromBeziers(curves []cubic, closed bool) geometry.BSpline {
+	n := len(curves)
+	if n == 0 {
+		return nil
+	}
+	// For section i, P[i] = 2*B1 - B2 and P[i+1] = 2*B2 - B1
+	ahead := make([]geometry.Point, n)
+	behind := make([]geometry.Point, n)
+	for i, c := range curves {
+		ahead[i] = geometry.Point{2*c[1][0] - c[2][0], 2*c[1][1] - c[2][1]}
+		behind[i] = geometry.Point{2*c[2][0] - c[1][0], 2*c[2][1] - c[1][1]}
+	}
+	avg := func(a, b geometry.Point) geometry.Point {
+		return geometry.Point{(a[0] + b[0]) / 2, (a[1] + b[1]) / 2}
+	}
+
+	if closed {
+		spline := make(geometry.BSpline, n)
+		for i := range curves {
+			spline[i] = avg(ahead[i], behind[(i+n-1)%n])
+		}
+		return spline
+	}
+	spline := geometry.BSpline{curves[0][0], ahead[0]}
+	for i := 1; i < n; i++ {
+		spline = append(spline, avg(ahead[i], behind[i-1]))
+	}
+	return append(spline, behind[n-1], curves[n-1][3])
+}
+
+// sampleCubics samples drawn beziers the same way polyline samples splines.
+func sampleCubics(curves []cubic) []geometry.Point {
+	if len(curves) == 0 {
+		return nil
+	}
+	pts := []geometry.Point{curves[0][0]}
+	for _, c := range curves {
+		for i := 1; i <= curveSteps; i++ {
+			pts = append(pts, bezierPoint(c[0], c[1], c[2], c[3], float64(i)/curveSteps))
+		}
+	}
+	return pts
+}
+
+// toSpline converts a shape, scaled to millimetres and shifted by offset,
+// into a b-spline, warning if the spline doesn't follow the drawing.
+func (si *svgImport) toSpline(shape svgShape, scale float64, offset geometry.Point) geometry.BSpline {
+	curves := make([]cubic, len(shape.curves))
+	for i, c := range shape.curves {
+		for j, pt := range c {
+			curves[i][j] = geometry.Point{pt[0]*scale - offset[0], pt[1]*scale - offset[1]}
+		}
+	}
+	spline := bsplineFromBeziers(curves, shape.closed)
+	if deviation, at := closestApproachMax(sampleCubics(curves), polyline(spline, shape.closed)); deviation > svgFitTolerance {
+		si.problem(models.FINDING_WARNING, shape.layer,
+			"curve near (%.1f, %.1f) moved %.2fmm when converted, smooth the path in the drawing", at[0], at[1], deviation)
+	}
+	return spline
+}
+
+// closestApproachMax returns the largest distance from a point of p to the
+// polyline q, and where on p it is.
+func closestApproachMax(p, q []geometry.Point) (worst float64, at geometry.Point) {
+	for _, pt := range p {
+		if d, _ := closestApproach([]geometry.Point{pt}, q); d > worst {
+			worst, at = d, pt
+		}
+	}
+	return
+}
+
+// importSvg converts an SVG drawing into a design, returning the problems
+// found with it.  The design is positioned so that the ends of the outer
+// curve are on the centre line, x = 0.
+func importSvg(data []byte) (des models.Design, problems []models.Finding) {
+	si := &svgImport{problems: []models.Finding{}}
+	var root svgElement
+	if err := xml.Unmarshal(data, &root); err != nil || root.XMLName.Local != "svg" {
+		si.problem(models.FINDING_ERROR, "svg", "not an SVG document")
+		return des, si.problems
+	}
+	scale := si.documentScale(root)
+	si.walk(root, identity, "")
+
+	byLayer := make(map[string][]svgShape)
+	for _, s := range si.shapes {
+		byLayer[s.layer] = append(byLayer[s.layer], s)
+	}
+	single := func(layer string, closed bool) (svgShape, bool) {
+		shapes := byLayer[layer]
+		switch {
+		case len(shapes) == 0:
+			si.problem(models.FINDING_ERROR, layer, "no %v layer or path found", layer)
+			return svgShape{}, false
+		case len(shapes) > 1:
+			si.problem(models.FINDING_ERROR, layer, "%v layer has %d paths, expected one", layer, len(shapes))
+		}
+		if closed && !shapes[0].closed {
+			si.problem(models.FINDING_WARNING, layer, "%v path is not closed, closing it", layer)
+		}
+		return shapes[0], true
+	}
+
+	// Centre the front on the ends of the outer curve
+	var offset geometry.Point
+	outer, hasOuter := single("outercurve", false)
+	if hasOuter {
+		first, last := outer.curves[0][0], outer.curves[len(outer.curves)-1][3]
+		if math.Abs(first[0]-last[0])*scale > closeTolerance {
+			si.problem(models.FINDING_ERROR, "outercurve",
+				"outer curve ends are %.2fmm apart horizontally; draw only the left half, ending on the centre line",
+				math.Abs(first[0]-last[0])*scale)
+		}
+		offset = geometry.Point{(first[0] + last[0]) / 2 * scale, 0}
+		des.Front.Outercurve = si.toSpline(outer, scale, offset)
+	}
+	if lens, ok := single("lens", true); ok {
+		lens.closed = true
+		des.Front.Lens = si.toSpline(lens, scale, offset)
+	}
+	for _, hole := range byLayer["hole"] {
+		hole.closed = true
+		des.Front.Holes = append(des.Front.Holes, si.toSpline(hole, scale, offset))
+	}
+	for _, path := range byLayer["engraving"] {
+		des.Front.Engraving.Paths = append(des.Front.Engraving.Paths, si.toSpline(path, scale, offset))
+	}
+
+	// The temple is drawn on its own, so it keeps its own origin at the
+	// top of its hinge end
+	if temple, ok := single("temple", false); ok {
+		min, _ := boundsOf(sampleCubics(temple.curves))
+		des.Temple.Contour = si.toSpline(temple, scale, geometry.Point{min[0] * scale, min[1] * scale})
+	}
+	if hinges := byLayer["hinge"]; len(hinges) > 0 {
+		min, max := boundsOf(sampleCubics(hinges[0].curves))
+		x := (min[0]+max[0])/2*scale - offset[0]
+		y := (min[1] + max[1]) / 2 * scale
+		var err error
+		if des.Temple.TempleSeparation, err = models.CheckedLength(2 * math.Abs(x)); err != nil {
+			si.problem(models.FINDING_ERROR, "hinge", "temple separation: "+err.Error())
+		}
+		if des.Temple.TempleHeight, err = models.CheckedLength(y); err != nil {
+			si.problem(models.FINDING_ERROR, "hinge", "temple height: "+err.Error())
+		}
+	} else {
+		si.problem(models.FINDING_ERROR, "hinge", "no hinge marker found, add a small circle at the hinge centre")
+	}
+	return des, si.problems
+}
+
+// importSvgDesign creates a design from an SVG drawing in the request body.
+// With ?dryrun=true the design is only checked, not saved.  Designs with
+// import problems of error severity are not saved.
+func importSvgDesign(ctx context.Context) error {
+	if !requireAuth(models.USER_NORMAL, ctx) {
+		return goweb.API.RespondWithError(ctx, 401, "Unauthorized")
+	}
+	data, err := ctx.RequestBody()
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+
+	des, problems := importSvg(data)
+	des.Name = ctx.QueryValue("name")
+	des.Designer = ctx.Data()["user"].(models.User).Id
+	des.Updated = time.Now()
+	if len(des.Name) == 0 {
+		problems = append(problems, models.Finding{Check: "svg_import", Severity: models.FINDING_ERROR,
+			Part: "name", Message: "design name required, use ?name="})
+	}
+	analyzeDesign(&des)
+
+	type importResponse struct {
+		Design   models.Design    `json:"design"`
+		Problems []models.Finding `json:"problems"`
+	}
+	failed := false
+	for _, p := range problems {
+		failed = failed || p.Severity == models.FINDING_ERROR
+	}
+	if failed {
+		log.Printf("SVG import of %v failed with %v problems", des.Name, len(problems))
+		return goweb.API.WriteResponseObject(ctx, 422, importResponse{des, problems})
+	}
+	if ctx.QueryValue("dryrun") == "true" {
+		return goweb.API.WriteResponseObject(ctx, 200, importResponse{des, problems})
+	}
+	if err := models.InsertDesign(&des); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 201, importResponse{des, problems})
+}
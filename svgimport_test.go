@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/xml"
+	"math"
+	"testing"
+
+	"github.com/guildeyewear/geometry"
+)
+
+func near(a, b geometry.Point) bool {
+	return distance(a, b) < 1e-6
+}
+
+func TestDocumentScale(t *testing.T) {
+	cases := []struct {
+		width, viewBox string
+		scale          float64
+		warning        bool
+	}{
+		{"210mm", "0 0 210 297", 1, false},
+		{"21cm", "0 0 793.7 1122.5", 210 / 793.7, false},
+		{"8.5in", "0 0 816 1056", 25.4 * 8.5 / 816, false},
+		{"612pt", "", 25.4 / 72, false},
+		{"96px", "", 25.4 / 96, true},
+		{"96", "0,0,96,96", 25.4 / 96, true},
+		{"", "", 25.4 / 96, true},
+	}
+	for _, c := range cases {
+		si := &svgImport{}
+		root := svgElement{Attrs: []xml.Attr{{Name: xml.Name{Local: "width"}, Value: c.width},
+			{Name: xml.Name{Local: "viewBox"}, Value: c.viewBox}}}
+		if got := si.documentScale(root); math.Abs(got-c.scale) > 1e-9 {
+			t.Errorf("width %q viewBox %q: scale %v, want %v", c.width, c.viewBox, got, c.scale)
+		}
+		if warned := len(si.problems) > 0; warned != c.warning {
+			t.Errorf("width %q: problems %v, want a warning %v", c.width, si.problems, c.warning)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	si := &svgImport{}
+	shapes := si.parsePath("M0,0 L10,0 10,10 Z m20,0 h5 v5 q5,0 5,5", "lens")
+	if len(shapes) != 2 {
+		t.Fatalf("got %v shapes, want 2", len(shapes))
+	}
+	square, open := shapes[0], shapes[1]
+	if !square.closed || len(square.curves) != 3 || !near(square.curves[2][3], geometry.Point{0, 0}) {
+		t.Errorf("square = %+v", square)
+	}
+	// The second subpath is relative to where the first one closed
+	if open.closed || len(open.curves) != 3 || !near(open.curves[0][0], geometry.Point{20, 0}) ||
+		!near(open.curves[2][3], geometry.Point{30, 10}) || !near(open.curves[2][1], geometry.Point{25 + 10.0/3, 5}) {
+		t.Errorf("open path = %+v", open)
+	}
+	if len(si.problems) > 0 {
+		t.Errorf("problems %v", si.problems)
+	}
+}
+
+func TestParsePathArcs(t *testing.T) {
+	si := &svgImport{}
+	for _, d := range []string{"M0,0 a5,5 0 0,1 10,0", "M0,0 a5,5 0 0110,0", "M0 0A5 5 0 0 1 10 0", "M0,0 A1,1 0 0 1 10,0"} {
+		shapes := si.parsePath(d, "lens")
+		if len(shapes) != 1 || len(shapes[0].curves) != 2 {
+			t.Errorf("%q gave %+v, want a half circle in two curves", d, shapes)
+			continue
+		}
+		curves := shapes[0].curves
+		// Sweeping the positive way with y down goes over the top
+		if !near(curves[0][3], geometry.Point{5, -5}) || !near(curves[1][3], geometry.Point{10, 0}) {
+			t.Errorf("%q goes through %v to %v", d, curves[0][3], curves[1][3])
+		}
+		for _, c := range curves {
+			for _, u := range []float64{0.25, 0.5, 0.75} {
+				if r := distance(bezierPoint(c[0], c[1], c[2], c[3], u), geometry.Point{5, 0}); math.Abs(r-5) > 0.01 {
+					t.Errorf("%q strays %v from the circle", d, r-5)
+				}
+			}
+		}
+	}
+	shapes := si.parsePath("M0,0 A5,5 0 1 0 5,5", "lens")
+	if len(shapes) != 1 || len(shapes[0].curves) != 3 || !near(shapes[0].curves[2][3], geometry.Point{5, 5}) {
+		t.Errorf("three quarter arc gave %+v", shapes)
+	}
+	if shapes := si.parsePath("M0,0 A0,5 0 0 1 10,0", "lens"); len(shapes) != 1 || len(shapes[0].curves) != 1 {
+		t.Errorf("arc with no radius should be a line, got %+v", shapes)
+	}
+}
+
+func TestRectCorners(t *testing.T) {
+	cases := []struct {
+		rect   string
+		curves int
+		corner geometry.Point // Where the top edge starts
+	}{
+		{`<rect x="1" y="2" width="10" height="6"/>`, 4, geometry.Point{1, 2}},
+		{`<rect x="1" y="2" width="10" height="6" rx="2"/>`, 8, geometry.Point{3, 2}},
+		{`<rect x="1" y="2" width="10" height="6" ry="1" rx="4"/>`, 8, geometry.Point{5, 2}},
+		{`<rect x="1" y="2" width="10" height="6" ry="2"/>`, 8, geometry.Point{3, 2}},
+		{`<rect x="1" y="2" width="10" height="6" rx="8"/>`, 4, geometry.Point{6, 2}}, // An ellipse
+	}
+	for _, c := range cases {
+		var e svgElement
+		if err := xml.Unmarshal([]byte(`<g id="lens">`+c.rect+`</g>`), &e); err != nil {
+			t.Fatal(err)
+		}
+		si := &svgImport{}
+		si.walk(e, identity, "")
+		if len(si.shapes) != 1 {
+			t.Errorf("%v gave %v shapes", c.rect, len(si.shapes))
+			continue
+		}
+		shape := si.shapes[0]
+		if !shape.closed || len(shape.curves) != c.curves || !near(shape.curves[0][0], c.corner) {
+			t.Errorf("%v gave %v curves from %v, want %v from %v", c.rect, len(shape.curves), shape.curves[0][0], c.curves, c.corner)
+		}
+		min, max := boundsOf(sampleCubics(shape.curves))
+		if math.Abs(min[0]-1) > 1e-6 || math.Abs(min[1]-2) > 1e-6 || math.Abs(max[0]-11) > 1e-6 || math.Abs(max[1]-8) > 1e-6 {
+			t.Errorf("%v is from %v to %v", c.rect, min, max)
+		}
+	}
+}
+
+func TestBsplineFromBeziers(t *testing.T) {
+	// The sections of a closed uniform b-spline through p
+	p := []geometry.Point{{0, 0}, {10, 0}, {10, 10}, {0, 10}}
+	n := len(p)
+	mix := func(a, b, c geometry.Point, wa, wb, wc float64) geometry.Point {
+		return geometry.Point{(wa*a[0] + wb*b[0] + wc*c[0]) / 6, (wa*a[1] + wb*b[1] + wc*c[1]) / 6}
+	}
+	curves := make([]cubic, n)
+	for i := range curves {
+		prev, this, next, after := p[(i+n-1)%n], p[i], p[(i+1)%n], p[(i+2)%n]
+		curves[i] = cubic{mix(prev, this, next, 1, 4, 1), mix(this, next, next, 4, 2, 0),
+			mix(this, next, next, 2, 4, 0), mix(this, next, after, 1, 4, 1)}
+	}
+	spline := bsplineFromBeziers(curves, true)
+	if len(spline) != n {
+		t.Fatalf("closed spline has %v points, want %v", len(spline), n)
+	}
+	for i := range p {
+		if !near(spline[i], p[i]) {
+			t.Errorf("control point %v = %v, want %v", i, spline[i], p[i])
+		}
+	}
+
+	line := []cubic{{{0, 0}, {1, 0}, {2, 0}, {3, 0}}}
+	want := geometry.BSpline{{0, 0}, {0, 0}, {3, 0}, {3, 0}}
+	if got := bsplineFromBeziers(line, false); len(got) != len(want) || !near(got[1], want[1]) || !near(got[2], want[2]) {
+		t.Errorf("open line = %v, want %v", got, want)
+	}
+	if got := bsplineFromBeziers(nil, false); got != nil {
+		t.Errorf("no curves gave %v", got)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	xfont "golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+)
+
+// Limits on text engraved along temples, in millimetres.
+const (
+	templeTextHeight   = 2.5 // Cap height, if the temple is tall enough
+	minTempleTextSize  = 1.5 // Smallest cap height that engraves legibly
+	templeTextMargin   = 0.8 // Material left above and below the text
+	templeTextEndSpace = 8.0 // Kept clear at each end of the temple
+	templeTextMaxChars = 30
+	templeTextDepth    = 30 // 1/100 mm, when the temple has no engraving settings
+	templeTextAngle    = 60 // Degrees, when the temple has no engraving settings
+	defaultTempleFont  = "single-line"
+	glyphCurveSteps    = 4
+)
+
+// textGlyph is a character of a font in em units with y up, scaled so that
+// capitals are 1 tall.  Strokes are either lines to engrave along or, for
+// outline fonts, closed outlines to carve out.
+type textGlyph struct {
+	advance float64
+	strokes [][]geometry.Point
+}
+
+// textFont is a font that temple text can be set in.
+type textFont interface {
+	glyph(r rune) (textGlyph, bool)
+	outline() bool
+}
+
+// strokeFont is the bundled single-line font.  Each glyph is a set of
+// strokes through points on a 4 by 6 grid, each point written as two
+// digits.  There are only capitals, so lower case is set in capitals.
+type strokeFont map[rune]string
+
+var singleLineFont = strokeFont{
+	'A': "002640 1333", 'B': "0006 063645443303 033342413000", 'C': "4536160501103041",
+	'D': "00063645413000", 'E': "46060040 0333", 'F': "460600 0333",
+	'G': "45361605011030414323", 'H': "0006 4046 0343", 'I': "1030 2026 1636",
+	'J': "0110203136 2646", 'K': "0006 4602 1340", 'L': "060040",
+	'M': "0006234640", 'N': "00064046", 'O': "100105163645413010",
+	'P': "00063645443303", 'Q': "100105163645413010 2240", 'R': "00063645443303 2340",
+	'S': "453616050413334241301001", 'T': "0646 2620", 'U': "060110304146",
+	'V': "062046", 'W': "0610233046", 'X': "0046 0640",
+	'Y': "0623 4623 2320", 'Z': "06464000",
+	'0': "100105163645413010 0145", '1': "152620 1030", '2': "05163645440040",
+	'3': "0516364544334241301001 1333", '4': "30360242", '5': "4606033342413000",
+	'6': "4536160501103041423303", '7': "064610", '8': "13040516364544331302011030414233",
+	'9': "0110304145361605041343",
+	'.': "2021", ',': "2110", '-': "1333", '\'': "2625", '/': "0046", '+': "1333 2224",
+	'&': "4003041516263514011030 4142", ' ': "",
+}
+
+func (f strokeFont) outline() bool { return false }
+
+func (f strokeFont) glyph(r rune) (g textGlyph, ok bool) {
+	strokes, ok := f[r]
+	if !ok {
+		if strokes, ok = f[[]rune(strings.ToUpper(string(r)))[0]]; !ok {
+			return
+		}
+	}
+	g.advance = 1
+	for _, stroke := range strings.Fields(strokes) {
+		var pts []geometry.Point
+		for i := 0; i+1 < len(stroke); i += 2 {
+			pts = append(pts, geometry.Point{float64(stroke[i]-'0') / 6, float64(stroke[i+1]-'0') / 6})
+		}
+		g.strokes = append(g.strokes, pts)
+	}
+	return
+}
+
+// outlineFont is a bundled outline font, whose letters are carved out
+// rather than cut along.
+type outlineFont struct {
+	font      *sfnt.Font
+	capHeight float64 // In font units
+}
+
+// parseOutlineFont parses a bundled TrueType font.
+func parseOutlineFont(data []byte) (*outlineFont, error) {
+	font, err := sfnt.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	f := &outlineFont{font: font, capHeight: float64(font.UnitsPerEm()) * 0.7}
+	var buf sfnt.Buffer
+	if m, err := font.Metrics(&buf, f.ppem(), xfont.HintingNone); err == nil && m.CapHeight > 0 {
+		f.capHeight = float64(m.CapHeight) / 64
+	}
+	return f, nil
+}
+
+// ppem loads glyphs in font units.
+func (f *outlineFont) ppem() fixed.Int26_6 {
+	return fixed.Int26_6(f.font.UnitsPerEm()) << 6
+}
+
+func (f *outlineFont) outline() bool { return true }
+
+func (f *outlineFont) glyph(r rune) (g textGlyph, ok bool) {
+	var buf sfnt.Buffer
+	idx, err := f.font.GlyphIndex(&buf, r)
+	if err != nil || (idx == 0 && r != ' ') {
+		return
+	}
+	advance, err := f.font.GlyphAdvance(&buf, idx, f.ppem(), xfont.HintingNone)
+	if err != nil {
+		return
+	}
+	segments, err := f.font.LoadGlyph(&buf, idx, f.ppem(), nil)
+	if err != nil {
+		return
+	}
+	g.advance = float64(advance) / 64 / f.capHeight
+
+	// Segments have y down, and glyphs y up
+	pt := func(p fixed.Point26_6) geometry.Point {
+		return geometry.Point{float64(p.X) / 64 / f.capHeight, -float64(p.Y) / 64 / f.capHeight}
+	}
+	var stroke []geometry.Point
+	closeStroke := func() {
+		if len(stroke) > 2 {
+			if distance(stroke[0], stroke[len(stroke)-1]) > 1e-9 {
+				stroke = append(stroke, stroke[0])
+			}
+			g.strokes = append(g.strokes, stroke)
+		}
+		stroke = nil
+	}
+	for _, seg := range segments {
+		switch seg.Op {
+		case sfnt.SegmentOpMoveTo:
+			closeStroke()
+			stroke = []geometry.Point{pt(seg.Args[0])}
+		case sfnt.SegmentOpLineTo:
+			stroke = append(stroke, pt(seg.Args[0]))
+		case sfnt.SegmentOpQuadTo:
+			stroke = append(stroke, quadraticPoints(stroke[len(stroke)-1], pt(seg.Args[0]), pt(seg.Args[1]))...)
+		case sfnt.SegmentOpCubeTo:
+			a := stroke[len(stroke)-1]
+			for i := 1; i <= glyphCurveSteps; i++ {
+				stroke = append(stroke, bezierPoint(a, pt(seg.Args[0]), pt(seg.Args[1]), pt(seg.Args[2]), float64(i)/glyphCurveSteps))
+			}
+		}
+	}
+	closeStroke()
+	g.strokes = bridgeCounters(g.strokes)
+	return g, true
+}
+
+// bridgeCounters joins each counter of a glyph, such as the inside of an
+// O, to the outline around it with a slit.  Each shape is then a single
+// path, which carves out around its counters rather than filling them.
+func bridgeCounters(contours [][]geometry.Point) (shapes [][]geometry.Point) {
+	var counters [][]geometry.Point
+	for i, c := range contours {
+		depth := 0
+		for j, other := range contours {
+			if i != j && insidePolygon(c[0], other) {
+				depth++
+			}
+		}
+		if depth%2 == 1 {
+			counters = append(counters, c)
+		} else {
+			shapes = append(shapes, c)
+		}
+	}
+	for _, counter := range counters {
+		for i, shape := range shapes {
+			if !insidePolygon(counter[0], shape) {
+				continue
+			}
+			// Counters have to wind the other way to the outline
+			if signedArea(counter)*signedArea(shape) > 0 {
+				reversed := make([]geometry.Point, len(counter))
+				for j, pt := range counter {
+					reversed[len(counter)-1-j] = pt
+				}
+				counter = reversed
+			}
+			si, ci, closest := 0, 0, math.Inf(1)
+			for a, p := range shape[:len(shape)-1] {
+				for b, q := range counter[:len(counter)-1] {
+					if d := distance(p, q); d < closest {
+						si, ci, closest = a, b, d
+					}
+				}
+			}
+			joined := append([]geometry.Point{}, shape[:si+1]...)
+			joined = append(joined, counter[ci:len(counter)-1]...)
+			joined = append(joined, counter[:ci+1]...)
+			shapes[i] = append(joined, shape[si:]...)
+			break
+		}
+	}
+	return
+}
+
+func quadraticPoints(a, c, b geometry.Point) (pts []geometry.Point) {
+	for i := 1; i <= glyphCurveSteps; i++ {
+		t := float64(i) / glyphCurveSteps
+		pts = append(pts, geometry.Point{
+			(1-t)*(1-t)*a[0] + 2*(1-t)*t*c[0] + t*t*b[0],
+			(1-t)*(1-t)*a[1] + 2*(1-t)*t*c[1] + t*t*b[1],
+		})
+	}
+	return
+}
+
+// Bundled outline fonts, by name
+var outlineFontData = map[string][]byte{
+	"go-regular": goregular.TTF,
+	"go-bold":    gobold.TTF,
+}
+
+var (
+	loadedFonts = map[string]textFont{defaultTempleFont: singleLineFont}
+	fontsLock   sync.Mutex
+)
+
+// findFont returns one of the bundled fonts: the single-line font or one
+// of the outline fonts.
+func findFont(name string) (textFont, error) {
+	if len(name) == 0 {
+		name = defaultTempleFont
+	}
+	fontsLock.Lock()
+	defer fontsLock.Unlock()
+	if f, ok := loadedFonts[name]; ok {
+		return f, nil
+	}
+	data, ok := outlineFontData[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown font %q", name)
+	}
+	f, err := parseOutlineFont(data)
+	if err != nil {
+		return nil, fmt.Errorf("font %q: %v", name, err)
+	}
+	loadedFonts[name] = f
+	return f, nil
+}
+
+// templeCentreLine samples the line through the middle of a temple from
+// end to end, with the height of the temple at each point.
+func templeCentreLine(contour []geometry.Point) (line []geometry.Point, heights []float64) {
+	outline := append(append([]geometry.Point{}, contour...), contour[0])
+	min, max := boundsOf(outline)
+	for x := min[0] + templeTextEndSpace; x <= max[0]-templeTextEndSpace; x += 0.5 {
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for i := 0; i+1 < len(outline); i++ {
+			a, b := outline[i], outline[i+1]
+			if (a[0] <= x) == (b[0] <= x) {
+				continue
+			}
+			y := a[1] + (x-a[0])*(b[1]-a[1])/(b[0]-a[0])
+			lo, hi = math.Min(lo, y), math.Max(hi, y)
+		}
+		if hi > lo {
+			line = append(line, geometry.Point{x, (lo + hi) / 2})
+			heights = append(heights, hi-lo)
+		}
+	}
+	return
+}
+
+// layoutTempleText sets text along the middle of a temple contour, reading
+// in the direction of increasing x and centred along the temple.  The text
+// is as tall as templeTextHeight where the temple allows, and is returned
+// as engraving paths with their corners kept sharp.
+func layoutTempleText(contour []geometry.Point, text, fontName string) (paths []geometry.BSpline, err error) {
+	text = strings.TrimSpace(text)
+	if len(text) == 0 {
+		return nil, nil
+	}
+	if n := len([]rune(text)); n > templeTextMaxChars {
+		return nil, fmt.Errorf("text %q is %d characters, the limit is %d", text, n, templeTextMaxChars)
+	}
+	if len(fontName) == 0 {
+		fontName = defaultTempleFont
+	}
+	font, err := findFont(fontName)
+	if err != nil {
+		return nil, err
+	}
+	var glyphs []textGlyph
+	var missing []string
+	width := 0.0
+	for _, r := range text {
+		g, ok := font.glyph(r)
+		if !ok {
+			missing = append(missing, string(r))
+			continue
+		}
+		glyphs = append(glyphs, g)
+		width += g.advance
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("font %v has no %v", fontName, strings.Join(missing, " "))
+	}
+	if !font.outline() {
+		width -= 1.0 / 3 // No space after the last stroke font character
+	}
+
+	line, heights := templeCentreLine(contour)
+	if len(line) < 2 {
+		return nil, errors.New("temple is too short for text")
+	}
+	arc := make([]float64, len(line))
+	for i := 1; i < len(line); i++ {
+		arc[i] = arc[i-1] + distance(line[i-1], line[i])
+	}
+	length := arc[len(arc)-1]
+
+	// The text is as tall as the temple allows along its length, and then
+	// has to fit in the length of the temple
+	size := templeTextHeight
+	for _, h := range heights {
+		size = math.Min(size, h-2*templeTextMargin)
+	}
+	if size < minTempleTextSize {
+		return nil, fmt.Errorf("temple is too narrow for text, %.1fmm is the minimum text height", minTempleTextSize)
+	}
+	if width*size > length {
+		return nil, fmt.Errorf("text %q is %.1fmm long but only %.1fmm fits on the temple", text, width*size, length)
+	}
+
+	// Each point of the text is placed by how far along the centre line it
+	// is, and how far above the line
+	place := func(u, v float64) geometry.Point {
+		i := 1
+		for i < len(arc)-1 && arc[i] < u {
+			i++
+		}
+		a, b := line[i-1], line[i]
+		seg := arc[i] - arc[i-1]
+		t := (u - arc[i-1]) / seg
+		tx, ty := (b[0]-a[0])/seg, (b[1]-a[1])/seg
+		// Up is towards -y, to the left of the direction of the text
+		return geometry.Point{a[0] + t*(b[0]-a[0]) + ty*v, a[1] + t*(b[1]-a[1]) - tx*v}
+	}
+	u := (length - width*size) / 2
+	for _, g := range glyphs {
+		strokes := append([][]geometry.Point{}, g.strokes...)
+		for i := 0; i < len(strokes); i++ {
+			stroke := strokes[i]
+			// Engraving paths that close on themselves are carved out, so
+			// strokes such as O are cut as two lines
+			if n := len(stroke); !font.outline() && n > 2 && stroke[0] == stroke[n-1] {
+				strokes = append(strokes, stroke[n-2:])
+				stroke = stroke[:n-1]
+			}
+			spline := geometry.BSpline{}
+			for _, pt := range stroke {
+				p := place(u+pt[0]*size, (pt[1]-0.5)*size)
+				// A cubic b-spline passes through a control point repeated
+				// three times, so the text keeps its corners
+				spline = append(spline, p, p, p)
+			}
+			paths = append(paths, spline)
+		}
+		u += g.advance * size
+	}
+	return
+}
+
+// templeText is the text engraved on each temple of a frame.
+type templeText struct {
+	Left  string `json:"left_text"`
+	Right string `json:"right_text"`
+	Font  string `json:"font"`
+}
+
+// orderTempleText is the text an order has engraved on its temples, falling
+// back to the design's own text.
+func orderTempleText(order models.Order, temple models.Temple) templeText {
+	text := templeText{order.LeftTempleText, order.RightTempleText, order.TempleFont}
+	if len(text.Left) == 0 {
+		text.Left = temple.LeftText
+	}
+	if len(text.Right) == 0 {
+		text.Right = temple.RightText
+	}
+	return text
+}
+
+// templeTextEngravings lays out the text of each temple on a pair of
+// temples placed by templeSheet.  The text is cut with the temple's
+// engraving settings, if it has any.
+func templeTextEngravings(temple models.Temple, text templeText, toLeft, toRight func(geometry.Point) geometry.Point) (left, right models.Engraving, err error) {
+	if len(polyline(temple.Contour, false)) == 0 {
+		return left, right, errors.New("design has no temple")
+	}
+	left = models.Engraving{Depth: templeTextDepth, Angle: templeTextAngle}
+	if temple.Engraving.Depth > 0 {
+		left.Depth, left.Angle = temple.Engraving.Depth, temple.Engraving.Angle
+	}
+	right = left
+
+	sides := []struct {
+		engraving *models.Engraving
+		text      string
+		contour   []geometry.Point
+		transform func(geometry.Point) geometry.Point
+	}{
+		{&left, text.Left, polyline(temple.Contour, false), toLeft},
+		{&right, text.Right, polyline(templeRight(temple).Contour, false), toRight},
+	}
+	for _, side := range sides {
+		placed := make([]geometry.Point, len(side.contour))
+		for i, pt := range side.contour {
+			placed[i] = side.transform(pt)
+		}
+		if side.engraving.Paths, err = layoutTempleText(placed, side.text, text.Font); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// checkTempleText makes sure an order's text fits on its temples.
+func checkTempleText(temple models.Temple, text templeText) error {
+	if len(strings.TrimSpace(text.Left+text.Right)) == 0 {
+		return nil
+	}
+	if len(polyline(temple.Contour, false)) == 0 {
+		return errors.New("design has no temple for text")
+	}
+	toLeft, toRight := templeSheet(temple, 0)
+	_, _, err := templeTextEngravings(temple, text, toLeft, toRight)
+	return err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/guildeyewear/geometry"
+)
+
+func rectangle(width, height float64) []geometry.Point {
+	return []geometry.Point{{0, 0}, {width, 0}, {width, height}, {0, height}}
+}
+
+func TestLayoutTempleText(t *testing.T) {
+	cases := []struct {
+		name       string
+		contour    []geometry.Point
+		text, font string
+		paths      int
+		wantErr    string
+	}{
+		{"fits", rectangle(140, 10), "GUILD", "", 8, ""}, // D is cut as two lines
+		{"lower case", rectangle(140, 10), "guild", "single-line", 8, ""},
+		{"blank", rectangle(140, 10), "   ", "", 0, ""},
+		{"outline font", rectangle(140, 10), "Go", "go-regular", 2, ""},
+		{"too many characters", rectangle(300, 10), strings.Repeat("I", 31), "", 0, "31 characters, the limit is 30"},
+		{"too long for the temple", rectangle(40, 10), "WWWWWWWWWWWW", "", 0, "only 24.0mm fits"},
+		{"too narrow", rectangle(140, 3), "GUILD", "", 0, "too narrow"},
+		{"missing glyphs", rectangle(140, 10), "A#B~", "", 0, "has no # ~"},
+		{"unknown font", rectangle(140, 10), "GUILD", "comic", 0, `unknown font "comic"`},
+	}
+	for _, c := range cases {
+		paths, err := layoutTempleText(c.contour, c.text, c.font)
+		if len(c.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("%v: error %v, want one containing %q", c.name, err, c.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		if len(paths) != c.paths {
+			t.Errorf("%v: %v paths, want %v", c.name, len(paths), c.paths)
+		}
+		if len(paths) == 0 {
+			continue
+		}
+		// The text is centred on the temple, inside its margins
+		var pts []geometry.Point
+		for _, p := range paths {
+			pts = append(pts, p...)
+		}
+		min, max := boundsOf(pts)
+		if math.Abs((min[0]+max[0])/2-70) > 0.5 || min[1] < templeTextMargin || max[1] > 10-templeTextMargin {
+			t.Errorf("%v: text is from %v to %v", c.name, min, max)
+		}
+	}
+}
+
+func TestStrokeFontGlyph(t *testing.T) {
+	g, ok := singleLineFont.glyph('T')
+	if !ok || len(g.strokes) != 2 || g.advance != 1 {
+		t.Errorf("T = %+v, %v, want 2 strokes", g, ok)
+	}
+	if g.strokes[0][0] != (geometry.Point{0, 1}) || g.strokes[0][1] != (geometry.Point{4.0 / 6, 1}) {
+		t.Errorf("top of T is %v", g.strokes[0])
+	}
+	if lower, ok := singleLineFont.glyph('t'); !ok || len(lower.strokes) != 2 {
+		t.Errorf("t should be set as T, got %+v, %v", lower, ok)
+	}
+	if space, ok := singleLineFont.glyph(' '); !ok || len(space.strokes) != 0 {
+		t.Errorf("space = %+v, %v", space, ok)
+	}
+	for _, r := range "#é€" {
+		if _, ok := singleLineFont.glyph(r); ok {
+			t.Errorf("single-line font shouldn't have %q", r)
+		}
+	}
+}
+
+func TestOutlineFontGlyph(t *testing.T) {
+	font, err := findFont("go-regular")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !font.outline() {
+		t.Errorf("go-regular should be an outline font")
+	}
+	h, ok := font.glyph('H')
+	if !ok || len(h.strokes) != 1 {
+		t.Fatalf("H = %v strokes, %v, want 1", len(h.strokes), ok)
+	}
+	_, max := boundsOf(h.strokes[0])
+	if math.Abs(max[1]-1) > 0.02 {
+		t.Errorf("H is %v tall, want capitals 1 tall", max[1])
+	}
+	// The counter of an O is bridged to its outline
+	if o, ok := font.glyph('O'); !ok || len(o.strokes) != 1 {
+		t.Errorf("O = %v strokes, %v, want 1", len(o.strokes), ok)
+	}
+	if _, ok := font.glyph(''); ok {
+		t.Errorf("go-regular shouldn't have a private use character")
+	}
+}
+
+func TestBridgeCounters(t *testing.T) {
+	square := func(x0, y0, size float64) []geometry.Point {
+		return []geometry.Point{{x0, y0}, {x0 + size, y0}, {x0 + size, y0 + size}, {x0, y0 + size}, {x0, y0}}
+	}
+	shapes := bridgeCounters([][]geometry.Point{square(0, 0, 10), square(3, 3, 4)})
+	if len(shapes) != 1 || len(shapes[0]) != 11 {
+		t.Fatalf("square with a counter gave %v", shapes)
+	}
+	// The counter winds the other way to the outline once it is joined
+	if a := signedArea(shapes[0]); math.Abs(a) != 100-16 {
+		t.Errorf("bridged square has area %v, want 84", a)
+	}
+	if shapes := bridgeCounters([][]geometry.Point{square(0, 0, 4), square(10, 0, 4)}); len(shapes) != 2 {
+		t.Errorf("separate squares gave %v shapes, want 2", len(shapes))
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+)
+
+var (
+	lengthType = reflect.TypeOf(models.Length(0))
+	pointType  = reflect.TypeOf(geometry.Point{})
+)
+
+// requestUnit is the unit asked for with ?units=, or nil if lengths are
+// in the units they are stored in: millimetres for curves and 1/100 mm
+// for everything else.
+func requestUnit(ctx context.Context) (*models.Unit, error) {
+	name := ctx.QueryValue("units")
+	if len(name) == 0 {
+		return nil, nil
+	}
+	unit, err := models.ParseUnit(name)
+	if err != nil {
+		return nil, err
+	}
+	return &unit, nil
+}
+
+// writeInUnits writes a response object with its lengths in the unit
+// asked for with ?units=.
+func writeInUnits(ctx context.Context, status int, obj interface{}) error {
+	unit, err := requestUnit(ctx)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 400, err.Error())
+	}
+	if unit == nil {
+		return goweb.API.WriteResponseObject(ctx, status, obj)
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	if v, err = (unitConversion{unit: *unit}).convert(v, reflect.TypeOf(obj)); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, status, v)
+}
+
+// readInUnits decodes a request body with its lengths in the unit asked
+// for with ?units= into obj.  Lengths too long to store are refused.
+func readInUnits(ctx context.Context, data []byte, obj interface{}) error {
+	unit, err := requestUnit(ctx)
+	if err != nil {
+		return err
+	}
+	return decodeInUnits(unit, data, obj)
+}
+
+// decodeInUnits decodes JSON with its lengths in unit, or in the units
+// they are stored in if unit is nil, into obj.
+func decodeInUnits(unit *models.Unit, data []byte, obj interface{}) (err error) {
+	if unit == nil {
+		return json.Unmarshal(data, obj)
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v, err = (unitConversion{unit: *unit, in: true}).convert(v, reflect.TypeOf(obj)); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(v); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, obj)
+}
+
+// unitConversion converts the lengths in decoded JSON between a unit and
+// the units they are stored in, using the Go type the JSON is of to find
+// them.
+type unitConversion struct {
+	unit models.Unit
+	in   bool // To the stored units, rather than from them
+}
+
+func (uc unitConversion) length(v float64) (interface{}, error) {
+	if uc.in {
+		return models.CheckedLength(v / uc.unit.PerMillimetre)
+	}
+	return models.Length(v).In(uc.unit), nil
+}
+
+func (uc unitConversion) coordinate(v float64) float64 {
+	if uc.in {
+		return v / uc.unit.PerMillimetre
+	}
+	return v * uc.unit.PerMillimetre
+}
+
+// convert converts the lengths in v, which was decoded from a t.
+func (uc unitConversion) convert(v interface{}, t reflect.Type) (interface{}, error) {
+	switch t {
+	case lengthType:
+		if f, ok := v.(float64); ok {
+			return uc.length(f)
+		}
+		return v, nil
+	case pointType:
+		if pt, ok := v.([]interface{}); ok {
+			for i := range pt {
+				if f, ok := pt[i].(float64); ok {
+					pt[i] = uc.coordinate(f)
+				}
+			}
+		}
+		return v, nil
+	}
+
+	var err error
+	switch t.Kind() {
+	case reflect.Ptr:
+		return uc.convert(v, t.Elem())
+	case reflect.Slice, reflect.Array:
+		if a, ok := v.([]interface{}); ok {
+			for i := range a {
+				if a[i], err = uc.convert(a[i], t.Elem()); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case reflect.Map:
+		if m, ok := v.(map[string]interface{}); ok {
+			for k := range m {
+				if m[k], err = uc.convert(m[k], t.Elem()); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case reflect.Struct:
+		if m, ok := v.(map[string]interface{}); ok {
+			err = uc.convertFields(m, t)
+		}
+	}
+	return v, err
+}
+
+// convertFields converts the fields of a struct decoded into m, including
+// the fields of embedded structs that JSON puts alongside them.
+func (uc unitConversion) convertFields(m map[string]interface{}, t reflect.Type) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || (len(f.PkgPath) > 0 && !f.Anonymous) {
+			continue
+		}
+		if len(name) == 0 {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if f.Anonymous && ft.Kind() == reflect.Struct {
+				if err := uc.convertFields(m, ft); err != nil {
+					return err
+				}
+				continue
+			}
+			name = f.Name
+		}
+		if v, ok := m[name]; ok {
+			converted, err := uc.convert(v, f.Type)
+			if err != nil {
+				return fmt.Errorf("%v: %v", name, err)
+			}
+			m[name] = converted
+		}
+	}
+	return nil
+}
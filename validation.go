@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+	"github.com/stretchr/goweb"
+	"github.com/stretchr/goweb/context"
+)
+
+// Manufacturing limits used when checking designs, in millimetres.
+const (
+	closeTolerance   = 0.05 // How far a curve end can be from where it should meet
+	minRimWall       = 1.5  // Material left between a lens and the outer edge
+	minBridgeWidth   = 4.0  // Material left between the two lenses
+	minHoleClearance = 1.5  // Material left around a through-hole
+	minHingeMargin   = 3.0  // Material needed around the hinge to mount it
+	templeHingeReach = 5.0  // Length of the end of the temple that meets the front
+)
+
+// designCheck accumulates the findings while checking a design.
+type designCheck struct {
+	findings []models.Finding
+}
+
+func (dc *designCheck) add(check, severity, part string, at *geometry.Point, format string, args ...interface{}) {
+	var loc *geometry.Point
+	if at != nil {
+		pt := *at
+		loc = &pt
+	}
+	dc.findings = append(dc.findings, models.Finding{
+		Check:    check,
+		Severity: severity,
+		Part:     part,
+		Message:  fmt.Sprintf(format, args...),
+		Location: loc,
+	})
+}
+
+// frontHalf is one side of a front sampled into polylines, with the name
+// of its part for findings.
+type frontHalf struct {
+	name  string // left or right
+	part  string
+	outer []geometry.Point
+	lens  []geometry.Point
+	holes [][]geometry.Point
+	drawn geometry.BSpline // the lens control points as drawn
+}
+
+func sampleHalf(name, part string, side models.FrontSide) frontHalf {
+	h := frontHalf{name: name, part: part, outer: polyline(side.Outercurve, false), lens: polyline(side.Lens, true), drawn: side.Lens}
+	for _, hole := range side.Holes {
+		h.holes = append(h.holes, polyline(hole, true))
+	}
+	return h
+}
+
+// validateDesign checks the geometry of a design for problems that would
+// stop it being made: curves that don't close or that cross themselves,
+// lenses and holes that don't fit inside the front with enough material
+// around them, a temple hinge that doesn't sit on the front, and
+// engravings that can't be cut or run off their part.  The right side of
+// an asymmetric design is checked as well as the left.
+func validateDesign(des models.Design) []models.Finding {
+	dc := &designCheck{findings: []models.Finding{}}
+	front := des.Front
+	left := sampleHalf("left", "front", front.FrontSide)
+	right := sampleHalf("right", "front.right", frontRight(front))
+	halves := []frontHalf{left}
+	if front.Right != nil {
+		halves = append(halves, right)
+	}
+
+	// The outer curves are the halves of the front, so both ends must be on
+	// the centre line to join up.
+	for _, h := range halves {
+		if len(h.outer) < 2 || len(h.lens) == 0 {
+			dc.add("closure", models.FINDING_ERROR, h.part, nil, "front outer curve and lens are required")
+			return dc.findings
+		}
+	}
+	for _, h := range halves {
+		for _, end := range []geometry.Point{h.outer[0], h.outer[len(h.outer)-1]} {
+			if math.Abs(end[0]) > closeTolerance {
+				dc.add("closure", models.FINDING_ERROR, h.part+".outer_curve", &end,
+					"outer curve ends %.2fmm from the centre line", math.Abs(end[0]))
+			}
+		}
+	}
+	outline := frontOutline(front)
+	for _, pt := range selfIntersections(outline, true) {
+		dc.add("self_intersection", models.FINDING_ERROR, "front.outer_curve", &pt, "outer curve crosses itself")
+	}
+	checkRange(dc, "front.outer_curve", outline)
+	checkRange(dc, "temple.contour", polyline(des.Temple.Contour, false))
+	if des.Temple.Right != nil {
+		checkRange(dc, "temple.right.contour", polyline(des.Temple.Right.Contour, false))
+	}
+
+	for _, h := range halves {
+		// A lens is a closed spline, which wraps round to join its ends once
+		// it has the four control points of a curve; short of that it is just
+		// the points as drawn, which leave a gap between the first and last.
+		lens := h.lens
+		if n := len(h.drawn); n < 4 {
+			gap := distance(h.drawn[0], h.drawn[n-1])
+			dc.add("closure", models.FINDING_ERROR, h.part+".lens", &h.drawn[n-1], "lens does not close, gap of %.2fmm", gap)
+		}
+		for _, pt := range selfIntersections(lens, true) {
+			dc.add("self_intersection", models.FINDING_ERROR, h.part+".lens", &pt, "lens crosses itself")
+		}
+
+		// The lens has to be inside the front with enough rim around it
+		for _, pt := range lens {
+			if !insidePolygon(pt, outline) {
+				dc.add("lens_containment", models.FINDING_ERROR, h.part+".lens", &pt, "lens extends outside the front")
+				break
+			}
+		}
+		if wall, at := closestApproach(lens, outline); wall < minRimWall {
+			dc.add("rim_wall", models.FINDING_ERROR, h.part+".lens", &at,
+				"rim wall is %.2fmm, minimum is %.2fmm", wall, minRimWall)
+		}
+	}
+	// and the lenses far enough apart to leave a bridge
+	if bridge, at := closestApproach(left.lens, right.lens); bridge < minBridgeWidth {
+		dc.add("bridge_width", models.FINDING_ERROR, "front.lens", &at,
+			"bridge is %.2fmm wide, minimum is %.2fmm", bridge, minBridgeWidth)
+	}
+
+	checkHoles(dc, left, right, outline)
+	if front.Right != nil {
+		checkHoles(dc, right, left, outline)
+		checkHolePairs(dc, left, right)
+	} else {
+		checkMirroredHoles(dc, left)
+	}
+	hinge := templeHinge(des)
+	checkHinge(dc, "temple", hinge, des.Temple.TempleSide, outline, left.lens)
+	if des.Temple.Right != nil || front.Right != nil {
+		checkHinge(dc, "temple.right", geometry.Point{-hinge[0], hinge[1]}, templeRight(des.Temple), outline, right.lens)
+	}
+
+	var openings [][]geometry.Point
+	for _, h := range []frontHalf{left, right} {
+		openings = append(append(openings, h.lens), h.holes...)
+	}
+	checkEngraving(dc, front.Engraving, "front.engraving", outline, openings)
+	if contour := polyline(des.Temple.Contour, false); len(contour) > 0 {
+		checkEngraving(dc, des.Temple.Engraving, "temple.engraving", contour, nil)
+	}
+	if des.Temple.Right != nil {
+		if contour := polyline(des.Temple.Right.Contour, false); len(contour) > 0 {
+			checkEngraving(dc, des.Temple.Right.Engraving, "temple.right.engraving", contour, nil)
+		}
+	}
+	// The design's own temple text is engraved on orders that don't give
+	// their own, so it has to fit
+	if err := checkTempleText(des.Temple, templeText{Left: des.Temple.LeftText, Right: des.Temple.RightText}); err != nil {
+		dc.add("temple_text", models.FINDING_ERROR, "temple", nil, "%v", err)
+	}
+	return dc.findings
+}
+
+// checkRange makes sure a part is small enough for its measurements to be
+// stored, since lengths are stored in 1/100 mm and would otherwise be cut
+// short.
+func checkRange(dc *designCheck, part string, pts []geometry.Point) {
+	if len(pts) == 0 {
+		return
+	}
+	min, max := boundsOf(pts)
+	limit := models.MaxLength.Millimetres()
+	if size := math.Max(max[0]-min[0], max[1]-min[1]); size > limit {
+		dc.add("range", models.FINDING_ERROR, part, &max,
+			"part is %.2fmm long, the longest that can be measured is %.2fmm", size, limit)
+	}
+}
+
+// checkHoles makes sure every through-hole on one side is a closed shape
+// inside the front, clear of the edge, the lenses and the other holes on
+// its side.
+func checkHoles(dc *designCheck, h, other frontHalf, outline []geometry.Point) {
+	for i, pts := range h.holes {
+		part := fmt.Sprintf("%v.holes[%d]", h.part, i)
+		if len(pts) < 3 {
+			dc.add("closure", models.FINDING_ERROR, part, nil, "hole has too few points")
+			continue
+		}
+		for _, pt := range selfIntersections(pts, true) {
+			dc.add("self_intersection", models.FINDING_ERROR, part, &pt, "hole crosses itself")
+		}
+		if !insidePolygon(pts[0], outline) {
+			dc.add("hole_clearance", models.FINDING_ERROR, part, &pts[0], "hole is outside the front")
+			continue
+		}
+		if insidePolygon(pts[0], h.lens) {
+			dc.add("hole_clearance", models.FINDING_ERROR, part, &pts[0], "hole is inside the lens")
+			continue
+		}
+		if d, at := closestApproach(pts, outline); d < minHoleClearance {
+			dc.add("hole_clearance", models.FINDING_ERROR, part, &at,
+				"hole is %.2fmm from the edge, minimum is %.2fmm", d, minHoleClearance)
+		}
+		if d, at := closestApproach(pts, h.lens); d < minHoleClearance {
+			dc.add("hole_clearance", models.FINDING_ERROR, part, &at,
+				"hole is %.2fmm from the lens, minimum is %.2fmm", d, minHoleClearance)
+		}
+		// Holes near the centre line can come close to the other lens
+		if d, at := closestApproach(pts, other.lens); d < minHoleClearance {
+			dc.add("hole_clearance", models.FINDING_ERROR, part, &at,
+				"hole is %.2fmm from the %v lens, minimum is %.2fmm", d, other.name, minHoleClearance)
+		}
+		for j := 0; j < i; j++ {
+			if len(h.holes[j]) < 3 {
+				continue
+			}
+			if d, at := closestApproach(pts, h.holes[j]); d < minHoleClearance {
+				dc.add("hole_clearance", models.FINDING_ERROR, part, &at,
+					"hole is %.2fmm from hole %d, minimum is %.2fmm", d, j, minHoleClearance)
+			}
+		}
+	}
+}
+
+// checkMirroredHoles makes sure the holes of a symmetric front are clear
+// of the mirror images of the holes.
+func checkMirroredHoles(dc *designCheck, h frontHalf) {
+	for i, pts := range h.holes {
+		if len(pts) < 3 {
+			continue
+		}
+		part := fmt.Sprintf("%v.holes[%d]", h.part, i)
+		if d, at := closestApproach(pts, mirrorX(pts)); d < minHoleClearance {
+			dc.add("hole_clearance", models.FINDING_ERROR, part, &at,
+				"hole is %.2fmm from its mirror image, minimum is %.2fmm", d, minHoleClearance)
+		}
+		for j := 0; j < i; j++ {
+			if len(h.holes[j]) < 3 {
+				continue
+			}
+			if d, at := closestApproach(pts, mirrorX(h.holes[j])); d < minHoleClearance {
+				dc.add("hole_clearance", models.FINDING_ERROR, part, &at,
+					"hole is %.2fmm from the mirror image of hole %d, minimum is %.2fmm", d, j, minHoleClearance)
+			}
+		}
+	}
+}
+
+// checkHolePairs makes sure the holes on the left of an asymmetric front
+// are clear of the holes on the right.
+func checkHolePairs(dc *designCheck, left, right frontHalf) {
+	for i, pts := range left.holes {
+		if len(pts) < 3 {
+			continue
+		}
+		part := fmt.Sprintf("%v.holes[%d]", left.part, i)
+		for j, other := range right.holes {
+			if len(other) < 3 {
+				continue
+			}
+			if d, at := closestApproach(pts, other); d < minHoleClearance {
+				dc.add("hole_clearance", models.FINDING_ERROR, part, &at,
+					"hole is %.2fmm from right hole %d, minimum is %.2fmm", d, j, minHoleClearance)
+			}
+		}
+	}
+}
+
+// checkHinge makes sure a temple mounts onto the front: the hinge point
+// given by the temple separation and height has to be on the front, clear
+// of the lens, and the front has to be at least as tall as the end of the
+// temple there.
+func checkHinge(dc *designCheck, part string, hinge geometry.Point, temple models.TempleSide, outline, lens []geometry.Point) {
+	if !insidePolygon(hinge, outline) {
+		dc.add("hinge_fit", models.FINDING_ERROR, part, &hinge, "temple hinge is not on the front")
+		return
+	}
+	if d, _ := closestApproach([]geometry.Point{hinge}, lens); d < minHingeMargin {
+		dc.add("hinge_fit", models.FINDING_ERROR, part, &hinge,
+			"temple hinge is %.2fmm from the lens, minimum is %.2fmm", d, minHingeMargin)
+	}
+
+	contour := polyline(temple.Contour, false)
+	if len(contour) == 0 {
+		dc.add("hinge_fit", models.FINDING_ERROR, part+".contour", nil, "temple contour is required")
+		return
+	}
+	for _, pt := range selfIntersections(contour, false) {
+		dc.add("self_intersection", models.FINDING_ERROR, part+".contour", &pt, "temple contour crosses itself")
+	}
+	templeEnd := templeEndHeight(contour)
+	if frontHeight := heightAt(outline, hinge[0]); frontHeight < templeEnd {
+		dc.add("hinge_fit", models.FINDING_ERROR, part, &hinge,
+			"temple end is %.2fmm tall but the front is only %.2fmm tall at the hinge", templeEnd, frontHeight)
+	}
+}
+
+// templeHinge is where the left temple meets the front, on the same side of
+// the centre line as the left lens.
+func templeHinge(des models.Design) geometry.Point {
+	x := des.Temple.TempleSeparation.Millimetres() / 2
+	if lmin, lmax := boundsOf(polyline(des.Front.Lens, true)); lmin[0]+lmax[0] < 0 {
+		x = -x
+	}
+	return geometry.Point{x, des.Temple.TempleHeight.Millimetres()}
+}
+
+// templeEndHeight is the height of the part of the temple contour that
+// butts up against the front.
+func templeEndHeight(contour []geometry.Point) float64 {
+	min, _ := boundsOf(contour)
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, pt := range contour {
+		if pt[0]-min[0] <= templeHingeReach {
+			lo, hi = math.Min(lo, pt[1]), math.Max(hi, pt[1])
+		}
+	}
+	return hi - lo
+}
+
+// heightAt is the vertical extent of a closed outline along the line x.
+func heightAt(outline []geometry.Point, x float64) float64 {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for i := 0; i+1 < len(outline); i++ {
+		a, b := outline[i], outline[i+1]
+		if (a[0] <= x) == (b[0] <= x) {
+			continue
+		}
+		y := a[1] + (x-a[0])*(b[1]-a[1])/(b[0]-a[0])
+		lo, hi = math.Min(lo, y), math.Max(hi, y)
+	}
+	if hi < lo {
+		return 0
+	}
+	return hi - lo
+}
+
+// checkDesign validates and measures the geometry of a design that is
+// being saved, generating the outer curve under a parametric bridge, and
+// makes sure its attributes are in the vocabulary.
+// Designs with geometry errors are saved as work in progress, but can't be
+// published.
+func checkDesign(des *models.Design) error {
+	vocabulary, err := models.GetAttributes("")
+	if err != nil {
+		return err
+	}
+	if err := models.CheckAttributes(des.Attributes, vocabulary); err != nil {
+		return err
+	}
+	orientRight(&des.Front)
+	if des.Front.Bridge != nil {
+		if des.Front, err = bridgeFront(des.Front, *des.Front.Bridge, 1); err != nil {
+			return err
+		}
+	}
+	analyzeDesign(des)
+	if des.Status == models.PUBLISH_PUBLISHED || des.PublishAt != nil {
+		if des.HasErrors() {
+			return errors.New("design has geometry errors and can't be published")
+		}
+		if des.ReviewState() != models.REVIEW_APPROVED {
+			return errors.New("design must be approved before it can be published")
+		}
+	}
+	return nil
+}
+
+// validateDesignGeometry re-checks a stored design and saves the findings.
+func validateDesignGeometry(ctx context.Context) error {
+	des, err := models.FindDesignById(ctx.PathValue("id"))
+	if err != nil {
+		return goweb.API.RespondWithError(ctx, 404, "Not Found")
+	}
+	if !canEditDesign(des, ctx) {
+		return goweb.API.RespondWithError(ctx, 403, "Forbidden")
+	}
+	analyzeDesign(&des)
+	if err := models.UpdateDesign(&des); err != nil {
+		return goweb.API.RespondWithError(ctx, 500, err.Error())
+	}
+	return goweb.API.WriteResponseObject(ctx, 200, des.Findings)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/guildeyewear/geometry"
+	"github.com/guildeyewear/legoserver/models"
+)
+
+func TestValidateLensClosure(t *testing.T) {
+	tests := []struct {
+		name   string
+		lens   geometry.BSpline
+		closed bool
+	}{
+		{"closed spline", geometry.BSpline{{-15, -10}, {-50, -10}, {-50, 10}, {-15, 10}}, true},
+		{"too few points", geometry.BSpline{{-15, -10}, {-50, -10}, {-50, 10}}, false},
+	}
+	for _, test := range tests {
+		var des models.Design
+		des.Front.Outercurve = geometry.BSpline{{0, -20}, {-30, -25}, {-75, -25}, {-75, 25}, {-30, 25}, {0, 20}}
+		des.Front.Lens = test.lens
+		closed := true
+		for _, f := range validateDesign(des) {
+			if f.Check == "closure" {
+				closed = false
+			}
+		}
+		if closed != test.closed {
+			t.Errorf("%s: lens closed %v, want %v", test.name, closed, test.closed)
+		}
+	}
+}